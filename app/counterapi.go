@@ -1,17 +1,66 @@
 package main
 
 import (
+	"context"
 	"counterapi/modules"
+	"crypto/tls"
+	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
-	envPrefix       string = "COUNTERAPI"
-	envRedisAddress string = "REDIS_ADDRESS"
-	envRedisDB      string = "REDIS_DB"
-	envListenPort   string = "PORT"
+	envPrefix                             string = "COUNTERAPI"
+	envRedisMode                          string = "REDIS_MODE"
+	envRedisAddress                       string = "REDIS_ADDRESS"
+	envRedisAddresses                     string = "REDIS_ADDRESSES"
+	envRedisMasterName                    string = "REDIS_MASTER_NAME"
+	envRedisDB                            string = "REDIS_DB"
+	envRedisUsername                      string = "REDIS_USERNAME"
+	envRedisPassword                      string = "REDIS_PASSWORD"
+	envRedisPoolSize                      string = "REDIS_POOL_SIZE"
+	envRedisDialTimeoutMillisecond        string = "REDIS_DIAL_TIMEOUT_MILLISECOND"
+	envRedisReadTimeoutMillisecond        string = "REDIS_READ_TIMEOUT_MILLISECOND"
+	envRedisWriteTimeoutMillisecond       string = "REDIS_WRITE_TIMEOUT_MILLISECOND"
+	envRedisConnectRetryNum               string = "REDIS_CONNECT_RETRY_NUM"
+	envRedisConnectRetryIntervalSecond    string = "REDIS_CONNECT_RETRY_INTERVAL_SECOND"
+	envRedisConnectRetryBackoff           string = "REDIS_CONNECT_RETRY_BACKOFF"
+	envRedisConnectRetryMaxIntervalSecond string = "REDIS_CONNECT_RETRY_MAX_INTERVAL_SECOND"
+	envRedisKeyPrefix                     string = "REDIS_KEY_PREFIX"
+	envRedisMigrateUnprefixedKeys         string = "REDIS_MIGRATE_UNPREFIXED_KEYS"
+	envRedisTLS                           string = "REDIS_TLS"
+	envRedisTLSCAFile                     string = "REDIS_TLS_CA_FILE"
+	envRedisTLSCertFile                   string = "REDIS_TLS_CERT_FILE"
+	envRedisTLSKeyFile                    string = "REDIS_TLS_KEY_FILE"
+	envListenPort                         string = "PORT"
+	envGRPCListenPort                     string = "GRPC_PORT"
+	envClientIPHeader                     string = "CLIENT_IP_HEADER"
+	envTLSCertFile                        string = "TLS_CERT_FILE"
+	envTLSKeyFile                         string = "TLS_KEY_FILE"
+	envTLSMinVersion                      string = "TLS_MIN_VERSION"
+	envTLSClientCAFile                    string = "TLS_CLIENT_CA_FILE"
+	envStore                              string = "STORE"
+	envShutdownTimeoutSecond              string = "SHUTDOWN_TIMEOUT_SECOND"
+	envRequestTimeoutMillisecond          string = "REQUEST_TIMEOUT_MILLISECOND"
+	envLogLevel                           string = "LOG_LEVEL"
+	envConfigFile                         string = "CONFIG_FILE"
+	envWebhookTimeoutMillisecond          string = "WEBHOOK_TIMEOUT_MILLISECOND"
+	envWebhookMaxAttempts                 string = "WEBHOOK_MAX_ATTEMPTS"
+	envIdempotencyWindowSecond            string = "IDEMPOTENCY_WINDOW_SECOND"
+	envAPIKeysFile                        string = "API_KEYS_FILE"
+	envAdminToken                         string = "ADMIN_TOKEN"
+	envRateLimitCreatePerMinute           string = "RATE_LIMIT_CREATE_PER_MINUTE"
+	envRateLimitReadPerMinute             string = "RATE_LIMIT_READ_PER_MINUTE"
+	envBatchMaxSize                       string = "BATCH_MAX_SIZE"
+)
+
+const (
+	storeRedis  string = "redis"
+	storeMemory string = "memory"
 )
 
 func main() {
@@ -19,25 +68,215 @@ func main() {
 	// Get parameters from environment variables
 	viper.SetEnvPrefix(envPrefix)
 	viper.AutomaticEnv()
-	redisAddress := viper.GetString(envRedisAddress)
-	redisDB := viper.GetInt(envRedisDB)
+	viper.SetDefault(envRedisMode, modules.RedisModeStandalone)
+	viper.SetDefault(envRedisKeyPrefix, "counterapi:counter:")
+	viper.SetDefault(envRedisConnectRetryNum, 6)
+	viper.SetDefault(envRedisConnectRetryIntervalSecond, 5)
+	viper.SetDefault(envRedisConnectRetryBackoff, modules.RetryBackoffConstant)
+	viper.SetDefault(envRedisConnectRetryMaxIntervalSecond, 60)
+	viper.SetDefault(envShutdownTimeoutSecond, 20)
+	viper.SetDefault(envTLSMinVersion, "1.2")
+	viper.SetDefault(envRequestTimeoutMillisecond, 5000)
+	viper.SetDefault(envLogLevel, "info")
+	viper.SetDefault(envWebhookTimeoutMillisecond, 5000)
+	viper.SetDefault(envWebhookMaxAttempts, 5)
+	viper.SetDefault(envIdempotencyWindowSecond, 24*60*60)
+	viper.SetDefault(envBatchMaxSize, 100)
+
+	// Parameters can be also written in the config file, such as YAML, with the keys like "redis_address".
+	// Environment variables take precedence over it.
+	if configFile := viper.GetString(envConfigFile); configFile != "" {
+		viper.SetConfigFile(configFile)
+		if err := viper.ReadInConfig(); err != nil {
+			logrus.Fatalf("Can't read the config file %s: %s", configFile, err)
+		}
+	}
+
+	if err := modules.ConfigureLogger(viper.GetString(envLogLevel)); err != nil {
+		logrus.Fatalf("Invalid %s_%s: %s", envPrefix, envLogLevel, err)
+	}
+	// Gin prints the routes and warnings in plain text in the debug mode, which breaks the JSON logs.
+	gin.SetMode(gin.ReleaseMode)
+	// Comma-separated like "sentinel-1:26379,sentinel-2:26379"
+	redisAddresses := strings.FieldsFunc(viper.GetString(envRedisAddresses), func(r rune) bool { return r == ',' || r == ' ' })
+	redisConfig := modules.RedisConfig{
+		Mode:                    viper.GetString(envRedisMode),
+		Address:                 viper.GetString(envRedisAddress),
+		Addresses:               redisAddresses,
+		MasterName:              viper.GetString(envRedisMasterName),
+		Username:                viper.GetString(envRedisUsername),
+		Password:                viper.GetString(envRedisPassword),
+		DB:                      int(getInt(envRedisDB)),
+		KeyPrefix:               viper.GetString(envRedisKeyPrefix),
+		PoolSize:                int(getInt(envRedisPoolSize)),
+		DialTimeout:             time.Duration(getInt(envRedisDialTimeoutMillisecond)) * time.Millisecond,
+		ReadTimeout:             time.Duration(getInt(envRedisReadTimeoutMillisecond)) * time.Millisecond,
+		WriteTimeout:            time.Duration(getInt(envRedisWriteTimeoutMillisecond)) * time.Millisecond,
+		ConnectRetryNum:         int(getInt(envRedisConnectRetryNum)),
+		ConnectRetryInterval:    time.Duration(getInt(envRedisConnectRetryIntervalSecond)) * time.Second,
+		ConnectRetryBackoff:     viper.GetString(envRedisConnectRetryBackoff),
+		ConnectRetryMaxInterval: time.Duration(getInt(envRedisConnectRetryMaxIntervalSecond)) * time.Second,
+		TLS:                     viper.GetBool(envRedisTLS),
+		TLSFiles: modules.TLSFiles{
+			CertFile: viper.GetString(envRedisTLSCertFile),
+			KeyFile:  viper.GetString(envRedisTLSKeyFile),
+			CAFile:   viper.GetString(envRedisTLSCAFile),
+		},
+	}
+	redisMigrateUnprefixedKeys := viper.GetBool(envRedisMigrateUnprefixedKeys)
+	store := viper.GetString(envStore)
 	listenPort := viper.GetString(envListenPort)
+	grpcListenPort := viper.GetString(envGRPCListenPort)
+	// HTTPS is served only if the certificate is given
+	var tlsConfig *tls.Config
+	if viper.GetString(envTLSCertFile) != "" || viper.GetString(envTLSKeyFile) != "" {
+		var err error
+		tlsConfig, err = modules.NewServerTLSConfig(modules.ServerTLSConfig{
+			TLSFiles: modules.TLSFiles{
+				CertFile: viper.GetString(envTLSCertFile),
+				KeyFile:  viper.GetString(envTLSKeyFile),
+				CAFile:   viper.GetString(envTLSClientCAFile),
+			},
+			MinVersion: viper.GetString(envTLSMinVersion),
+		})
+		if err != nil {
+			logrus.Fatalf("Invalid TLS settings: %s", err)
+		}
+	}
+	shutdownTimeout := time.Duration(getInt(envShutdownTimeoutSecond)) * time.Second
+	if shutdownTimeout < 0 {
+		logrus.Fatalf("Invalid %s_%s: it must be 0 or more", envPrefix, envShutdownTimeoutSecond)
+	}
+	// 0 disables the timeout
+	requestTimeout := time.Duration(getInt(envRequestTimeoutMillisecond)) * time.Millisecond
+	if requestTimeout < 0 {
+		logrus.Fatalf("Invalid %s_%s: it must be 0 or more", envPrefix, envRequestTimeoutMillisecond)
+	}
+	webhookTimeout := time.Duration(getInt(envWebhookTimeoutMillisecond)) * time.Millisecond
+	webhookMaxAttempts := int(getInt(envWebhookMaxAttempts))
+	if webhookTimeout <= 0 || webhookMaxAttempts < 1 {
+		logrus.Fatalf("Invalid %s_%s or %s_%s: they must be positive", envPrefix, envWebhookTimeoutMillisecond, envPrefix, envWebhookMaxAttempts)
+	}
+	idempotencyWindow := time.Duration(getInt(envIdempotencyWindowSecond)) * time.Second
+	if idempotencyWindow < 0 {
+		logrus.Fatalf("Invalid %s_%s: it must be 0 or more", envPrefix, envIdempotencyWindowSecond)
+	}
+	apiKeysFile := viper.GetString(envAPIKeysFile)
+	adminToken := viper.GetString(envAdminToken)
+	rateLimitCreatePerMinute := getInt(envRateLimitCreatePerMinute)
+	rateLimitReadPerMinute := getInt(envRateLimitReadPerMinute)
+	if rateLimitCreatePerMinute < 0 || rateLimitReadPerMinute < 0 {
+		logrus.Fatalf("Invalid %s_%s or %s_%s: they must be 0 or more", envPrefix, envRateLimitCreatePerMinute, envPrefix, envRateLimitReadPerMinute)
+	}
+	batchMaxSize := int(getInt(envBatchMaxSize))
+	if batchMaxSize < 0 {
+		logrus.Fatalf("Invalid %s_%s: it must be 0 or more", envPrefix, envBatchMaxSize)
+	}
 	hostname, err := os.Hostname()
 	if err != nil {
 		logrus.Fatal("Can't get hostname. exit")
 	}
 
 	// Inject dependencies
-	redisClient, err := modules.NewRedisClient(redisAddress, redisDB)
-	if err != nil {
-		logrus.Fatal(err)
+	var dao modules.Dao
+	switch store {
+	case storeMemory:
+		// Run without Redis. Counters are lost when the process exits.
+		logrus.Warn("Using in-memory store. Counters are not shared among replicas.")
+		dao = modules.NewMemoryStore()
+	case storeRedis, "":
+		if err := redisConfig.Validate(); err != nil {
+			logrus.Fatalf("Invalid Redis settings (%s_REDIS_*): %s", envPrefix, err)
+		}
+		redisClient, err := modules.NewRedisClient(redisConfig)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		// Counters created before the key prefix was introduced are invisible until they are migrated.
+		if redisMigrateUnprefixedKeys {
+			migrated, err := redisClient.MigrateUnprefixedKeys(context.Background())
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			logrus.Infof("Migrated %d counters into the namespace %s", migrated, redisConfig.KeyPrefix)
+		}
+		dao = redisClient
+	default:
+		logrus.Fatalf("Unknown store %s. Use %s or %s.", store, storeRedis, storeMemory)
+	}
+	metrics := modules.NewMetrics()
+	dao = modules.NewInstrumentedDao(dao, metrics)
+	counter := modules.NewCounterCalculator(dao)
+
+	// API keys are required only if they are given by the file or can be created by the admin
+	var apiKeys *modules.APIKeyStore
+	if apiKeysFile != "" || adminToken != "" {
+		apiKeys = modules.NewAPIKeyStore(dao, adminToken)
+		if apiKeysFile != "" {
+			loaded, revoked, err := apiKeys.LoadFile(context.Background(), apiKeysFile)
+			if err != nil {
+				logrus.Fatalf("Can't load API keys: %s", err)
+			}
+			logrus.Infof("Loaded %d API keys from %s, and revoked %d removed from it", loaded, apiKeysFile, revoked)
+		}
+	}
+
+	// Rate limits are shared among replicas through DB. 0 means unlimited.
+	var rateLimiter *modules.RateLimiter
+	if rateLimitCreatePerMinute > 0 || rateLimitReadPerMinute > 0 {
+		rateLimiter = modules.NewRateLimiter(dao, rateLimitCreatePerMinute, rateLimitReadPerMinute)
+	}
+	router := modules.NewController(counter, modules.ControllerConfig{
+		ListenPort:        listenPort,
+		TLSConfig:         tlsConfig,
+		Hostname:          hostname,
+		ClientIPHeader:    viper.GetString(envClientIPHeader),
+		ShutdownTimeout:   shutdownTimeout,
+		RequestTimeout:    requestTimeout,
+		IdempotencyWindow: idempotencyWindow,
+		APIKeys:           apiKeys,
+		RateLimiter:       rateLimiter,
+		MaxBatchSize:      batchMaxSize,
+		Metrics:           metrics,
+	})
+	webhookDispatcher := modules.NewWebhookDispatcher(dao, webhookTimeout, webhookMaxAttempts)
+	webhookDispatcher.Start()
+
+	// The gRPC API is served on its own port only if it's given, sharing the same DB connection
+	var grpcServer *modules.GRPCServer
+	if grpcListenPort != "" {
+		grpcServer = modules.NewGRPCServer(counter, grpcListenPort, apiKeys, rateLimiter, metrics, requestTimeout)
+		if err := grpcServer.Start(); err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Infof("Serving gRPC on port %s", grpcListenPort)
 	}
-	counter := modules.NewCounterCalculator(redisClient)
-	router := modules.NewController(counter, listenPort, hostname)
 
-	// Run
+	// Run until SIGTERM or SIGINT comes
 	if err := router.Run(); err != nil {
-		logrus.Fatal("Failed to start.")
+		logrus.Fatal(err)
 	}
 
+	// Close the connection to DB after all requests are drained and callbacks in progress are delivered
+	if grpcServer != nil {
+		grpcServer.Stop(shutdownTimeout)
+	}
+	webhookDispatcher.Stop()
+	if err := dao.Close(); err != nil {
+		logrus.Error(err)
+	}
+
+}
+
+// Return the integer setting. It exits if the value isn't an integer, rather than using 0 silently.
+func getInt(key string) int64 {
+	s := strings.TrimSpace(viper.GetString(key))
+	if s == "" {
+		return 0
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		logrus.Fatalf("Invalid %s_%s: %q is not an integer", envPrefix, key, s)
+	}
+	return v
 }
@@ -3,10 +3,16 @@ module counterapi
 go 1.13
 
 require (
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/gin-gonic/gin v1.6.3
 	github.com/go-redis/redis/v8 v8.0.0-beta.2
+	github.com/golang/protobuf v1.4.2
 	github.com/google/uuid v1.1.1
-	github.com/sirupsen/logrus v1.2.0
+	github.com/gorilla/websocket v1.4.2
+	github.com/prometheus/client_golang v1.7.1
+	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/viper v1.4.0
 	github.com/stretchr/testify v1.4.0
+	google.golang.org/grpc v1.29.1
+	google.golang.org/protobuf v1.23.0
 )
@@ -0,0 +1,362 @@
+package modules
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	apiKeyHeader        string = "X-API-Key"
+	apiKeyPrefix        string = "apikey:"
+	apiKeyIDPrefix      string = "apikeyid:"
+	apiKeyFileSetKey    string = "apikeys:file"
+	adminAPIKeyPath     string = "/admin/apikey"
+	adminAPIKeysPath    string = "/admin/apikeys"
+	ownerContextKey     string = "owner"
+	maxAPIKeyNameLength int    = 64
+)
+
+var apiKeyHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// APIKey is what an API key identifies. The key itself is never stored.
+type APIKey struct {
+	// Counters created with the key are owned by this ID
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// APIKeyStore keeps API keys in DB by their SHA-256 hashes.
+// The keys are long random strings, so a fast hash is enough to keep them secret.
+// Each ID points to the hash of its key, so that the key can be revoked by the ID.
+// The hashes loaded from the file are kept in a set, so that the ones removed from the file can be revoked.
+type APIKeyStore struct {
+	dao         Dao
+	adminToken  string
+	generateKey func() (string, error)
+	generateID  func() string
+}
+
+// Initialize APIKeyStore. API keys can be created with adminToken through the admin endpoint. Empty disables it.
+func NewAPIKeyStore(dao Dao, adminToken string) *APIKeyStore {
+	return &APIKeyStore{
+		dao:         dao,
+		adminToken:  adminToken,
+		generateKey: generateAPIKey,
+		generateID:  func() string { return uuid.New().String() },
+	}
+}
+
+// Load API keys from the file, and return the number of them and the number of the revoked ones.
+// Each line is the name and the SHA-256 hash of the key in hex like "payments 9f86d08...". The name is its ID as well.
+// Empty lines and lines starting with "#" are ignored.
+// The keys loaded from the file before but not in it anymore are revoked. Nothing changes if the file is invalid.
+func (s *APIKeyStore) LoadFile(ctx context.Context, path string) (int, int, error) {
+	hashes, keys, err := readAPIKeyFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	inFile := map[string]bool{}
+	for i, hash := range hashes {
+		if err := s.set(ctx, hash, keys[i]); err != nil {
+			return 0, 0, err
+		}
+		if err := s.dao.AddToSet(ctx, apiKeyFileSetKey, hash); err != nil {
+			return 0, 0, err
+		}
+		inFile[hash] = true
+	}
+
+	var loadedBefore []string
+	for cursor := uint64(0); ; {
+		members, next, err := s.dao.ScanSet(ctx, apiKeyFileSetKey, cursor, 100)
+		if err != nil {
+			return len(hashes), 0, err
+		}
+		loadedBefore = append(loadedBefore, members...)
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	revoked := 0
+	for _, hash := range loadedBefore {
+		if inFile[hash] {
+			continue
+		}
+		if err := s.revoke(ctx, hash); err != nil {
+			return len(hashes), revoked, err
+		}
+		revoked++
+	}
+	return len(hashes), revoked, nil
+}
+
+// Return the hashes and the keys in the file in the same order.
+func readAPIKeyFile(path string) ([]string, []APIKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var hashes []string
+	var keys []APIKey
+	names := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 || !apiKeyHashPattern.MatchString(fields[1]) {
+			return nil, nil, fmt.Errorf("%s:%d must be the name and the SHA-256 hash of the key in hex", path, line)
+		}
+		// The name is the ID, which can have only one key
+		if names[fields[0]] {
+			return nil, nil, fmt.Errorf("%s:%d has the name %s which is already used", path, line, fields[0])
+		}
+		names[fields[0]] = true
+		hashes = append(hashes, fields[1])
+		keys = append(keys, APIKey{ID: fields[0], Name: fields[0]})
+	}
+	return hashes, keys, scanner.Err()
+}
+
+// Create a new API key, and return it with the key itself. The key can't be got again.
+func (s *APIKeyStore) Create(ctx context.Context, name string) (APIKey, string, error) {
+	k := APIKey{ID: s.generateID(), Name: name}
+	key, err := s.generateKey()
+	if err != nil {
+		return k, "", err
+	}
+	return k, key, s.set(ctx, hashAPIKey(key), k)
+}
+
+// Return what the key identifies. The second returned value is false if the key is unknown.
+func (s *APIKeyStore) Authenticate(ctx context.Context, key string) (APIKey, bool, error) {
+	var k APIKey
+	existence, err := s.dao.Exists(ctx, apiKeyPrefix+hashAPIKey(key))
+	if err != nil || !convertIntToBool(existence) {
+		return k, false, err
+	}
+	v, err := s.dao.Get(ctx, apiKeyPrefix+hashAPIKey(key))
+	if err != nil {
+		return k, false, err
+	}
+	if err := json.Unmarshal([]byte(v), &k); err != nil {
+		return k, false, err
+	}
+	return k, true, nil
+}
+
+// Revoke the API key with the ID. It returns false if no such key exists.
+// The keys in the file come back when it's loaded again, so they should be removed from the file as well.
+func (s *APIKeyStore) Revoke(ctx context.Context, id string) (bool, error) {
+	existence, err := s.dao.Exists(ctx, apiKeyIDPrefix+id)
+	if err != nil || !convertIntToBool(existence) {
+		return false, err
+	}
+	hash, err := s.dao.Get(ctx, apiKeyIDPrefix+id)
+	if err != nil {
+		return false, err
+	}
+	return true, s.revoke(ctx, hash)
+}
+
+// Delete the key with the hash, and the ID pointing to it.
+func (s *APIKeyStore) revoke(ctx context.Context, hash string) error {
+	v, err := s.dao.Get(ctx, apiKeyPrefix+hash)
+	if err == nil {
+		var k APIKey
+		if err := json.Unmarshal([]byte(v), &k); err != nil {
+			return err
+		}
+		// The ID may point to its new key already
+		if current, err := s.dao.Get(ctx, apiKeyIDPrefix+k.ID); err == nil && current == hash {
+			if err := s.dao.Del(ctx, apiKeyIDPrefix+k.ID); err != nil {
+				return err
+			}
+		}
+	}
+	if err := s.dao.Del(ctx, apiKeyPrefix+hash); err != nil {
+		return err
+	}
+	return s.dao.RemoveFromSet(ctx, apiKeyFileSetKey, hash)
+}
+
+// Check the token for the admin endpoint in constant time.
+func (s *APIKeyStore) isAdmin(token string) bool {
+	return s.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1
+}
+
+func (s *APIKeyStore) set(ctx context.Context, hash string, k APIKey) error {
+	v, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+	if err := s.dao.Set(ctx, apiKeyPrefix+hash, string(v), 0); err != nil {
+		return err
+	}
+	return s.dao.Set(ctx, apiKeyIDPrefix+k.ID, hash, 0)
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Return 401 if the request doesn't have a valid API key in the "X-API-Key" header.
+// The ID of the key is kept in the context as the owner. It does nothing if API keys are disabled.
+func (c *Controller) apiKeyMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if c.apiKeys == nil {
+			ctx.Next()
+			return
+		}
+		key := ctx.GetHeader(apiKeyHeader)
+		if key == "" {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, errorFormatter(fmt.Sprintf("%s header is required", apiKeyHeader)))
+			return
+		}
+		reqCtx, cancel := c.requestContext(ctx)
+		k, ok, err := c.apiKeys.Authenticate(reqCtx, key)
+		cancel()
+		if err != nil {
+			respondError(ctx, err)
+			ctx.Abort()
+			return
+		}
+		if !ok {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, errorFormatter("the API key is invalid"))
+			return
+		}
+		ctx.Set(ownerContextKey, k.ID)
+		ctx.Next()
+	}
+}
+
+// Return the ID of the API key of the request. Empty if API keys are disabled.
+func requestOwner(ctx *gin.Context) string {
+	return ctx.GetString(ownerContextKey)
+}
+
+// Tell whether the caller can see the counter owned by the owner.
+// Everyone can see every counter if API keys are disabled.
+func (c *Controller) isVisible(ctx *gin.Context, owner string) bool {
+	return c.apiKeys == nil || owner == requestOwner(ctx)
+}
+
+// Return 404 if the counter with ID in the path doesn't exist or belongs to another API key.
+// The counters of others can't be told from nonexistent ones. It does nothing if API keys are disabled.
+func (c *Controller) ownerMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if c.apiKeys == nil {
+			ctx.Next()
+			return
+		}
+		id := ctx.Params.ByName("id")
+		reqCtx, cancel := c.requestContext(ctx)
+		r, err := c.counter.GetCounter(reqCtx, id)
+		cancel()
+		if err != nil {
+			respondError(ctx, err)
+			ctx.Abort()
+			return
+		}
+		if !r.counterExistence || !c.isVisible(ctx, r.owner) {
+			c.metrics.countersNotFound.Inc()
+			ctx.AbortWithStatusJSON(http.StatusNotFound, errorFormatter(fmt.Sprintf("no such counter with %s", id)))
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// Return 404 if the admin endpoints are disabled, or 401 if the request doesn't have the admin token like
+// "Authorization: Bearer [token]".
+func (c *Controller) adminMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if c.apiKeys == nil || c.apiKeys.adminToken == "" {
+			ctx.AbortWithStatusJSON(http.StatusNotFound, errorFormatter(http.StatusText(http.StatusNotFound)))
+			return
+		}
+		token := strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+		if !c.apiKeys.isAdmin(token) {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, errorFormatter("the admin token is invalid"))
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// Create an API key against "POST /admin/apikey"
+// The body is like {"name": "payments"}, and the key is returned only in this response.
+func (c *Controller) createAPIKey(ctx *gin.Context) {
+
+	var body struct {
+		Name string `json:"name"`
+	}
+	// Return 400 if the name is missing or too long
+	if err := ctx.ShouldBindJSON(&body); err != nil || body.Name == "" {
+		ctx.JSON(http.StatusBadRequest, errorFormatter("name is required"))
+		return
+	}
+	if len(body.Name) > maxAPIKeyNameLength {
+		ctx.JSON(http.StatusBadRequest, errorFormatter(fmt.Sprintf("name must be at most %d characters", maxAPIKeyNameLength)))
+		return
+	}
+
+	reqCtx, cancel := c.requestContext(ctx)
+	defer cancel()
+	k, key, err := c.apiKeys.Create(reqCtx, body.Name)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusCreated, struct {
+		ID     string `json:"id"`
+		Name   string `json:"name"`
+		APIKey string `json:"api_key"`
+	}{k.ID, k.Name, key})
+}
+
+// Revoke the API key with the ID against "DELETE /admin/apikeys/:id"
+// The counters of the key are kept, but nobody can see them anymore.
+func (c *Controller) deleteAPIKey(ctx *gin.Context) {
+	id := ctx.Param("id")
+	reqCtx, cancel := c.requestContext(ctx)
+	defer cancel()
+	revoked, err := c.apiKeys.Revoke(reqCtx, id)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	// Return 404 if no such key exists
+	if !revoked {
+		ctx.JSON(http.StatusNotFound, errorFormatter(fmt.Sprintf("no such API key with %s", id)))
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
@@ -0,0 +1,387 @@
+package modules
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"counterapi/pb"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Return the store with the keys "key-a" and "key-b" of the owners "a" and "b"
+func newTestAPIKeyStore(t *testing.T, dao Dao, adminToken string) *APIKeyStore {
+	s := NewAPIKeyStore(dao, adminToken)
+	assert.NoError(t, s.set(context.Background(), hashAPIKey("key-a"), APIKey{ID: "a", Name: "a"}))
+	assert.NoError(t, s.set(context.Background(), hashAPIKey("key-b"), APIKey{ID: "b", Name: "b"}))
+	return s
+}
+
+func requestWithAPIKey(c *Controller, method string, path string, key string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, nil)
+	if key != "" {
+		req.Header.Set(apiKeyHeader, key)
+	}
+	c.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAPIKeyStore(t *testing.T) {
+	s := NewAPIKeyStore(NewMemoryStore(), "")
+	s.generateKey = func() (string, error) {
+		return "secret", nil
+	}
+	s.generateID = func() string {
+		return "id"
+	}
+
+	k, key, err := s.Create(context.Background(), "payments")
+	assert.NoError(t, err)
+	assert.Equal(t, APIKey{ID: "id", Name: "payments"}, k)
+	assert.Equal(t, "secret", key)
+
+	// Only the hash is stored
+	existence, err := s.dao.Exists(context.Background(), apiKeyPrefix+"secret")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), existence)
+
+	k, ok, err := s.Authenticate(context.Background(), "secret")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, APIKey{ID: "id", Name: "payments"}, k)
+
+	_, ok, err = s.Authenticate(context.Background(), "unknown")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestAPIKeyStoreLoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apikey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name      string
+		content   string
+		loaded    int
+		expectErr bool
+	}{
+		{"normal", "# team keys\npayments " + hashAPIKey("key-p") + "\n\nsearch " + hashAPIKey("key-s") + "\n", 2, false},
+		{"plain key", "payments key-p\n", 0, true},
+		{"missing hash", "payments\n", 0, true},
+		{"duplicate name", "search " + hashAPIKey("key-s") + "\nsearch " + hashAPIKey("key-t") + "\n", 0, true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		assert.NoError(t, ioutil.WriteFile(path, []byte(tt.content), 0600))
+		s := NewAPIKeyStore(NewMemoryStore(), "")
+		loaded, _, err := s.LoadFile(context.Background(), path)
+		assert.Equal(t, tt.loaded, loaded, tt.name)
+		assert.Equal(t, tt.expectErr, err != nil, tt.name)
+		if !tt.expectErr {
+			k, ok, err := s.Authenticate(context.Background(), "key-s")
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, APIKey{ID: "search", Name: "search"}, k)
+		}
+	}
+
+	_, _, err = NewAPIKeyStore(NewMemoryStore(), "").LoadFile(context.Background(), filepath.Join(dir, "nothing"))
+	assert.Error(t, err)
+}
+
+// The keys removed from the file are revoked when it's loaded again, but the keys created by the admin are kept
+func TestAPIKeyStoreReloadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apikey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys")
+	s := NewAPIKeyStore(NewMemoryStore(), "")
+	authenticated := func(key string) bool {
+		_, ok, err := s.Authenticate(context.Background(), key)
+		assert.NoError(t, err)
+		return ok
+	}
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("payments "+hashAPIKey("key-p")+"\nsearch "+hashAPIKey("key-s")+"\n"), 0600))
+	loaded, revoked, err := s.LoadFile(context.Background(), path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, loaded)
+	assert.Equal(t, 0, revoked)
+	_, created, err := s.Create(context.Background(), "admin")
+	assert.NoError(t, err)
+
+	// "search" is removed, and "payments" has a new key
+	assert.NoError(t, ioutil.WriteFile(path, []byte("payments "+hashAPIKey("key-p2")+"\n"), 0600))
+	loaded, revoked, err = s.LoadFile(context.Background(), path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, loaded)
+	assert.Equal(t, 2, revoked)
+	assert.False(t, authenticated("key-s"))
+	assert.False(t, authenticated("key-p"))
+	assert.True(t, authenticated("key-p2"))
+	assert.True(t, authenticated(created))
+
+	// Nothing changes if the file is invalid
+	assert.NoError(t, ioutil.WriteFile(path, []byte("payments\n"), 0600))
+	_, _, err = s.LoadFile(context.Background(), path)
+	assert.Error(t, err)
+	assert.True(t, authenticated("key-p2"))
+
+	// The new key can be revoked by its ID
+	ok, err := s.Revoke(context.Background(), "payments")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, authenticated("key-p2"))
+	ok, err = s.Revoke(context.Background(), "payments")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+// Each API key can only see its own counters
+func TestRouterAPIKeyOwnership(t *testing.T) {
+	dao := NewMemoryStore()
+	counter := NewCounterCalculator(dao)
+	c := NewController(counter, ControllerConfig{IdempotencyWindow: time.Hour, APIKeys: newTestAPIKeyStore(t, dao, "")})
+
+	// Return 401 without a valid key
+	w := requestWithAPIKey(c, http.MethodPost, "/counter?to=1000", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "{\"error\":\"X-API-Key header is required\"}", w.Body.String())
+	w = requestWithAPIKey(c, http.MethodGet, "/counter", "key-c")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "{\"error\":\"the API key is invalid\"}", w.Body.String())
+
+	w = requestWithAPIKey(c, http.MethodPost, "/counter?to=1000", "key-a")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created struct {
+		Id string `json:"id"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	id := created.Id
+
+	w = requestWithAPIKey(c, http.MethodGet, "/counter", "key-a")
+	assert.Equal(t, "{\"ids\":[\""+id+"\"]}", w.Body.String())
+	w = requestWithAPIKey(c, http.MethodGet, "/counter", "key-b")
+	assert.Equal(t, "{\"ids\":[]}", w.Body.String())
+
+	// Counters of others look like nonexistent ones
+	tests := []struct {
+		method       string
+		path         string
+		key          string
+		expectedCode int
+	}{
+		{http.MethodGet, "/counter/" + id, "key-a", http.StatusOK},
+		{http.MethodGet, "/counter/" + id, "key-b", http.StatusNotFound},
+		{http.MethodPost, "/counter/" + id + "/pause", "key-b", http.StatusNotFound},
+		{http.MethodPost, "/counter/" + id + "/resume", "key-b", http.StatusNotFound},
+		{http.MethodGet, "/counter/" + id + "/stream", "key-b", http.StatusNotFound},
+		{http.MethodPost, "/counter/" + id + "/stop", "key-b", http.StatusNotFound},
+		{http.MethodPost, "/counter/unknown/stop", "key-a", http.StatusNotFound},
+		{http.MethodPost, "/counter/" + id + "/stop", "key-a", http.StatusNoContent},
+		{http.MethodGet, "/counter/" + id, "key-a", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := requestWithAPIKey(c, tt.method, tt.path, tt.key)
+		assert.Equal(t, tt.expectedCode, w.Code, tt.method+" "+tt.path+" "+tt.key)
+	}
+
+	// The same idempotency key of others doesn't replay
+	assert.Equal(t, http.StatusCreated, postCounterWithIdempotencyKeyAs(c, "key-a", "key-1").Code)
+	w = postCounterWithIdempotencyKeyAs(c, "key-b", "key-1")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "", w.Header().Get(idempotentReplayedHeader))
+}
+
+func postCounterWithIdempotencyKeyAs(c *Controller, apiKey string, key string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/counter?to=1000", nil)
+	req.Header.Set(apiKeyHeader, apiKey)
+	req.Header.Set(idempotencyKeyHeader, key)
+	c.router.ServeHTTP(w, req)
+	return w
+}
+
+// The callback is checked by its own owner, as the counter may have expired
+func TestRouterAPIKeyCallbackOwnership(t *testing.T) {
+	dao := NewMemoryStore()
+	d := &DummyCounter{
+		GetCallbackStatusFunc: func(ctx context.Context, id string) (CallbackRecord, bool, error) {
+			return CallbackRecord{URL: "https://example.com/hook", Status: CallbackStatusPending, Owner: "a"}, true, nil
+		},
+	}
+	c := NewController(d, ControllerConfig{APIKeys: newTestAPIKeyStore(t, dao, "")})
+	assert.Equal(t, http.StatusOK, requestWithAPIKey(c, http.MethodGet, "/counter/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e/callback", "key-a").Code)
+	assert.Equal(t, http.StatusNotFound, requestWithAPIKey(c, http.MethodGet, "/counter/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e/callback", "key-b").Code)
+}
+
+// tests of POST /admin/apikey
+func TestRouterCreateAPIKey(t *testing.T) {
+	tests := []struct {
+		name         string
+		adminToken   string
+		enabled      bool
+		token        string
+		body         string
+		expectedCode int
+	}{
+		{"disabled", "", false, "", "{\"name\":\"payments\"}", http.StatusNotFound},
+		{"without admin token", "", true, "", "{\"name\":\"payments\"}", http.StatusNotFound},
+		{"wrong token", "admin", true, "guess", "{\"name\":\"payments\"}", http.StatusUnauthorized},
+		{"missing name", "admin", true, "admin", "{}", http.StatusBadRequest},
+		{"name too long", "admin", true, "admin", "{\"name\":\"" + strings.Repeat("a", 65) + "\"}", http.StatusBadRequest},
+		{"normal", "admin", true, "admin", "{\"name\":\"payments\"}", http.StatusCreated},
+	}
+	for _, tt := range tests {
+		dao := NewMemoryStore()
+		var s *APIKeyStore
+		if tt.enabled {
+			s = NewAPIKeyStore(dao, tt.adminToken)
+		}
+		c := NewController(NewCounterCalculator(dao), ControllerConfig{APIKeys: s})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, adminAPIKeyPath, strings.NewReader(tt.body))
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		c.router.ServeHTTP(w, req)
+		assert.Equal(t, tt.expectedCode, w.Code, tt.name)
+		assert.NoError(t, validateResponse(http.MethodPost, adminAPIKeyPath, w), tt.name)
+		if w.Code != http.StatusCreated {
+			continue
+		}
+
+		// The new key works right away
+		var created struct {
+			ID     string `json:"id"`
+			Name   string `json:"name"`
+			APIKey string `json:"api_key"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+		assert.Equal(t, "payments", created.Name)
+		assert.Equal(t, http.StatusOK, requestWithAPIKey(c, http.MethodGet, "/counter", created.APIKey).Code)
+	}
+}
+
+func TestRouterDeleteAPIKey(t *testing.T) {
+	tests := []struct {
+		name         string
+		adminToken   string
+		token        string
+		id           string
+		expectedCode int
+	}{
+		{"disabled", "", "", "a", http.StatusNotFound},
+		{"wrong token", "admin", "guess", "a", http.StatusUnauthorized},
+		{"unknown", "admin", "admin", "c", http.StatusNotFound},
+		{"normal", "admin", "admin", "a", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		dao := NewMemoryStore()
+		c := NewController(NewCounterCalculator(dao), ControllerConfig{APIKeys: newTestAPIKeyStore(t, dao, tt.adminToken)})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodDelete, adminAPIKeysPath+"/"+tt.id, nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		c.router.ServeHTTP(w, req)
+		assert.Equal(t, tt.expectedCode, w.Code, tt.name)
+		assert.NoError(t, validateResponse(http.MethodDelete, adminAPIKeysPath+"/{id}", w), tt.name)
+
+		// The revoked key doesn't work anymore, but the others do
+		expectedCode := http.StatusOK
+		if w.Code == http.StatusNoContent {
+			expectedCode = http.StatusUnauthorized
+		}
+		assert.Equal(t, expectedCode, requestWithAPIKey(c, http.MethodGet, "/counter", "key-a").Code, tt.name)
+		assert.Equal(t, http.StatusOK, requestWithAPIKey(c, http.MethodGet, "/counter", "key-b").Code, tt.name)
+	}
+}
+
+// Watchers get counters of others as deleted ones
+func TestWatchAPIKeyOwnership(t *testing.T) {
+	dao := NewMemoryStore()
+	d := &DummyCounter{GetCountersFunc: func(ctx context.Context, ids []string) (map[string]CounterResult, error) {
+		results := map[string]CounterResult{}
+		for _, id := range ids {
+			owner := map[string]string{watchIDA: "a", watchIDB: "b"}[id]
+			results[id] = CounterResult{Current: 1, To: 10000, owner: owner, counterExistence: true}
+		}
+		return results, nil
+	}}
+	c := NewController(d, ControllerConfig{APIKeys: newTestAPIKeyStore(t, dao, "")})
+	c.watchHub.interval = time.Hour
+	s := httptest.NewServer(c.router)
+	defer s.Close()
+	defer c.watchHub.close()
+
+	url := "ws" + strings.TrimPrefix(s.URL, "http") + watchPath
+	_, res, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{apiKeyHeader: []string{"key-a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assert.NoError(t, conn.WriteJSON(watchRequest{Type: watchRequestSubscribe, IDs: []string{watchIDA, watchIDB}}))
+	waitForWatchedCounters(t, c.watchHub, 2)
+
+	c.watchHub.tick()
+	assert.Equal(t, watchMessage{Type: watchMessageUpdate, Counters: map[string]CounterResult{watchIDA: {Current: 1, To: 10000}}, Deleted: []string{watchIDB}}, readWatchMessage(t, conn))
+	waitForWatchedCounters(t, c.watchHub, 1)
+}
+
+func TestGRPCAPIKeyOwnership(t *testing.T) {
+	dao := NewMemoryStore()
+	client, stop := newTestGRPCClient(t, NewGRPCServer(NewCounterCalculator(dao), "", newTestAPIKeyStore(t, dao, ""), nil, NewMetrics(), 0))
+	defer stop()
+	asA := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "key-a")
+	asB := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "key-b")
+
+	_, err := client.CreateCounter(context.Background(), &pb.CreateCounterRequest{To: 1000})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.ListCounters(metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "key-c"), &pb.ListCountersRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	created, err := client.CreateCounter(asA, &pb.CreateCounterRequest{To: 1000})
+	assert.NoError(t, err)
+
+	listed, err := client.ListCounters(asA, &pb.ListCountersRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{created.Id}, listed.Ids)
+	listed, err = client.ListCounters(asB, &pb.ListCountersRequest{})
+	assert.NoError(t, err)
+	assert.Empty(t, listed.Ids)
+
+	_, err = client.GetCounter(asB, &pb.GetCounterRequest{Id: created.Id})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.DeleteCounter(asB, &pb.DeleteCounterRequest{Id: created.Id})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	stream, err := client.WatchCounter(asB, &pb.WatchCounterRequest{Id: created.Id})
+	assert.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.GetCounter(asA, &pb.GetCounterRequest{Id: created.Id})
+	assert.NoError(t, err)
+}
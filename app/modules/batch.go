@@ -0,0 +1,216 @@
+package modules
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	batchPath string = "/batch"
+	// Counter IDs are UUIDs, so this is never an ID.
+	batchID string = "batch"
+)
+
+const (
+	batchStatusStopped  string = "stopped"
+	batchStatusNotFound string = "not_found"
+)
+
+// Gin 1.6 can't have "/counter/batch" next to "/counter/:id", so the batch routes are served by the ID routes with "batch" as the ID.
+// This maps the ID routes to the batch routes.
+var batchRoutes = map[string]string{
+	counterPath + "/:id":                     counterPath + batchPath,
+	counterPath + "/:id" + stopPath:          counterPath + batchPath + stopPath,
+	v1Path + counterPath + "/:id":            v1Path + counterPath + batchPath,
+	v1Path + counterPath + "/:id" + stopPath: v1Path + counterPath + batchPath + stopPath,
+}
+
+// Return the route of the request like "/counter/:id", but the batch routes are "/counter/batch" rather than the ID routes.
+func requestRoute(ctx *gin.Context) string {
+	route := ctx.FullPath()
+	if batch, ok := batchRoutes[route]; ok && ctx.Request.Method == http.MethodPost && ctx.Param("id") == batchID {
+		return batch
+	}
+	return route
+}
+
+// Return 404 unless the ID in the path is "batch". The route only serves the batch route.
+func requireBatchID() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if ctx.Param("id") != batchID {
+			ctx.AbortWithStatusJSON(http.StatusNotFound, errorFormatter(http.StatusText(http.StatusNotFound)))
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// Serve the batch route with the handler if the ID in the path is "batch", or go on to the ID route otherwise.
+func dispatchBatch(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if ctx.Param("id") != batchID {
+			ctx.Next()
+			return
+		}
+		handler(ctx)
+		ctx.Abort()
+	}
+}
+
+// One of the counters in "POST /counter/batch". The fields are the same as the query and body of "POST /counter".
+type batchCounterSpec struct {
+	To        *int64            `json:"to"`
+	Mode      string            `json:"mode"`
+	Precision string            `json:"precision"`
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels"`
+	Callback  *Callback         `json:"callback"`
+}
+
+// Generate counters at once and return their IDs in the same order against "POST /counter/batch"
+// The body is an array like [{"to": 60, "mode": "countdown", "name": "deploy", "labels": {"team": "payments"}}, ...]
+// Either all or none of them are generated.
+func (c *Controller) createCounters(ctx *gin.Context) {
+	reqCtx, cancel := c.requestContext(ctx)
+	defer cancel()
+	// Return 404 if batches are disabled
+	if c.maxBatchSize <= 0 {
+		ctx.JSON(http.StatusNotFound, errorFormatter(http.StatusText(http.StatusNotFound)))
+		return
+	}
+	var body []batchCounterSpec
+	// Return 400 if the body is not an array of counters, or too large
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorFormatter("the request body is invalid"))
+		return
+	}
+	if len(body) == 0 || len(body) > c.maxBatchSize {
+		ctx.JSON(http.StatusBadRequest, errorFormatter(fmt.Sprintf("body must have 1 to %d counters", c.maxBatchSize)))
+		return
+	}
+
+	specs := make([]CounterSpec, len(body))
+	for i, s := range body {
+		// Return 400 if any of them is invalid
+		if s.To == nil {
+			ctx.JSON(http.StatusBadRequest, errorFormatter(fmt.Sprintf("body[%d].to is required", i)))
+			return
+		}
+		specs[i] = CounterSpec{
+			To:        *s.To,
+			Mode:      s.Mode,
+			Precision: s.Precision,
+			Name:      s.Name,
+			Labels:    s.Labels,
+			Callback:  s.Callback,
+			Owner:     requestOwner(ctx),
+		}
+		if err := specs[i].Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, errorFormatter(fmt.Sprintf("body[%d]: %s", i, err)))
+			return
+		}
+	}
+
+	ids, err := c.counter.GenerateCounters(reqCtx, specs)
+	// Return 500 if it failed to generate counters by some internal reasons.
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	c.metrics.countersCreated.Add(float64(len(ids)))
+	ctx.JSON(http.StatusCreated, struct {
+		Ids []string `json:"ids"`
+	}{ids})
+}
+
+// The result of each counter in "POST /counter/batch/stop"
+type batchStopResult struct {
+	Id     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// Stop counters at once against "POST /counter/batch/stop"
+// The body has either IDs like {"ids": ["...", ...]} or a label selector like {"labels": {"team": "payments"}}.
+// It returns whether each counter is stopped or not found. With the selector, up to the maximum batch size counters are
+// stopped at once, and "more" is true if there may be more of them.
+func (c *Controller) stopCounters(ctx *gin.Context) {
+	reqCtx, cancel := c.requestContext(ctx)
+	defer cancel()
+	// Return 404 if batches are disabled
+	if c.maxBatchSize <= 0 {
+		ctx.JSON(http.StatusNotFound, errorFormatter(http.StatusText(http.StatusNotFound)))
+		return
+	}
+	var body struct {
+		Ids    []string          `json:"ids"`
+		Labels map[string]string `json:"labels"`
+	}
+	// Return 400 if the body doesn't have either IDs or labels, or has too many IDs
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		ctx.JSON(http.StatusBadRequest, errorFormatter("the request body is invalid"))
+		return
+	}
+	if (len(body.Ids) == 0) == (len(body.Labels) == 0) {
+		ctx.JSON(http.StatusBadRequest, errorFormatter("either ids or labels is required"))
+		return
+	}
+	if len(body.Ids) > c.maxBatchSize {
+		ctx.JSON(http.StatusBadRequest, errorFormatter(fmt.Sprintf("ids must have at most %d counters", c.maxBatchSize)))
+		return
+	}
+
+	ids := body.Ids
+	more := false
+	if len(body.Labels) > 0 {
+		var err error
+		ids, more, err = c.selectCounters(ctx, reqCtx, body.Labels)
+		if err != nil {
+			respondError(ctx, err)
+			return
+		}
+	}
+
+	// Counters of other API keys are not found
+	existences, err := c.counter.DeleteCounters(reqCtx, ids, requestOwner(ctx))
+	// Return 500 if it failed to delete counters.
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+	results := make([]batchStopResult, len(ids))
+	for i, id := range ids {
+		results[i] = batchStopResult{Id: id, Status: batchStatusNotFound}
+		if existences[i] {
+			results[i].Status = batchStatusStopped
+			c.metrics.countersStopped.Inc()
+		}
+	}
+	ctx.JSON(http.StatusOK, struct {
+		Results []batchStopResult `json:"results"`
+		More    bool              `json:"more,omitempty"`
+	}{results, more})
+}
+
+// Return up to the maximum batch size counter IDs which have all the labels, and whether there may be more of them.
+// With API keys, only the counters of the caller are selected.
+func (c *Controller) selectCounters(ctx *gin.Context, reqCtx context.Context, labels map[string]string) ([]string, bool, error) {
+	ids := []string{}
+	cursor := uint64(0)
+	for {
+		page, next, err := c.counter.ListCounters(reqCtx, requestOwner(ctx), labels, cursor, int64(c.maxBatchSize))
+		if err != nil {
+			return nil, false, err
+		}
+		ids = append(ids, page...)
+		cursor = next
+		if len(ids) > c.maxBatchSize {
+			return ids[:c.maxBatchSize], true, nil
+		}
+		if cursor == 0 {
+			return ids, false, nil
+		}
+	}
+}
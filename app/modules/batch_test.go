@@ -0,0 +1,173 @@
+package modules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func postBatch(c *Controller, path string, key string, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(apiKeyHeader, key)
+	}
+	c.router.ServeHTTP(w, req)
+	return w
+}
+
+func createBatch(t *testing.T, c *Controller, key string, body string) []string {
+	w := postBatch(c, "/counter/batch", key, body)
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	assert.NoError(t, validateResponse(http.MethodPost, "/counter/batch", w))
+	var created struct {
+		Ids []string `json:"ids"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	return created.Ids
+}
+
+func TestRouterCreateCounters(t *testing.T) {
+	counter := NewCounterCalculator(NewMemoryStore())
+	c := NewController(counter, ControllerConfig{IdempotencyWindow: time.Hour, MaxBatchSize: 3})
+
+	ids := createBatch(t, c, "", "[{\"to\": 60, \"mode\": \"countdown\", \"name\": \"deploy\", \"labels\": {\"team\": \"payments\"}}, {\"to\": 1000, \"precision\": \"ms\"}]")
+	assert.Len(t, ids, 2)
+	r, _ := counter.GetCounter(context.Background(), ids[0])
+	assert.Equal(t, "deploy", r.Name)
+	assert.Equal(t, map[string]string{"team": "payments"}, r.Labels)
+	r, _ = counter.GetCounter(context.Background(), ids[1])
+	assert.Equal(t, "ms", r.Precision)
+
+	// Either all or none of them are generated
+	tests := []struct {
+		name         string
+		body         string
+		expectedBody string
+	}{
+		{"not an array", "{\"to\": 60}", "{\"error\":\"body must be an array\"}"},
+		{"empty", "[]", "{\"error\":\"body must have 1 to 3 counters\"}"},
+		{"too many", "[{\"to\": 1}, {\"to\": 1}, {\"to\": 1}, {\"to\": 1}]", "{\"error\":\"body must have 1 to 3 counters\"}"},
+		{"no to", "[{\"to\": 1}, {\"mode\": \"countup\"}]", "{\"error\":\"body[1].to is required\"}"},
+		{"invalid mode", "[{\"to\": 1, \"mode\": \"up\"}]", "{\"error\":\"body[0].mode must be countup or countdown\"}"},
+		{"invalid label", "[{\"to\": 1}, {\"to\": 1, \"labels\": {\"a=b\": \"c\"}}]", "{\"error\":\"body[1]: label key a=b must not contain \\\"=\\\"\"}"},
+	}
+	for _, tt := range tests {
+		w := postBatch(c, "/counter/batch", "", tt.body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, tt.name)
+		assert.Equal(t, tt.expectedBody, w.Body.String(), tt.name)
+	}
+	assert.Equal(t, 2, countCounters(t, counter))
+
+	// Only "batch" is served by POST /counter/:id
+	w := postBatch(c, "/counter/"+ids[0], "", "[{\"to\": 1}]")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRouterCreateCountersError(t *testing.T) {
+	d := &DummyCounter{GenerateCountersFunc: func(ctx context.Context, specs []CounterSpec) ([]string, error) {
+		return nil, errors.New("failed")
+	}}
+	c := NewController(d, ControllerConfig{MaxBatchSize: 100})
+	w := postBatch(c, "/counter/batch", "", "[{\"to\": 1}]")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.NoError(t, validateResponse(http.MethodPost, "/counter/batch", w))
+}
+
+// The batch routes are not served with the maximum batch size 0
+func TestRouterBatchDisabled(t *testing.T) {
+	c := NewController(&DummyCounter{}, ControllerConfig{})
+	assert.Equal(t, http.StatusNotFound, postBatch(c, "/counter/batch", "", "[{\"to\": 1}]").Code)
+	assert.Equal(t, http.StatusNotFound, postBatch(c, "/counter/batch/stop", "", "{\"ids\": [\"a\"]}").Code)
+}
+
+func TestRouterStopCounters(t *testing.T) {
+	counter := NewCounterCalculator(NewMemoryStore())
+	c := NewController(counter, ControllerConfig{MaxBatchSize: 3})
+	ids := createBatch(t, c, "", "[{\"to\": 60}, {\"to\": 60}]")
+
+	w := postBatch(c, "/counter/batch/stop", "", fmt.Sprintf("{\"ids\": [%q, \"unknown\", %q]}", ids[0], ids[1]))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, validateResponse(http.MethodPost, "/counter/batch/stop", w))
+	assert.Equal(t, fmt.Sprintf("{\"results\":[{\"id\":%q,\"status\":\"stopped\"},{\"id\":\"unknown\",\"status\":\"not_found\"},{\"id\":%q,\"status\":\"stopped\"}]}", ids[0], ids[1]), w.Body.String())
+	assert.Equal(t, 0, countCounters(t, counter))
+
+	tests := []struct {
+		name         string
+		body         string
+		expectedBody string
+	}{
+		{"not an object", "[]", "{\"error\":\"body must be an object\"}"},
+		{"neither", "{}", "{\"error\":\"either ids or labels is required\"}"},
+		{"both", "{\"ids\": [\"a\"], \"labels\": {\"team\": \"payments\"}}", "{\"error\":\"either ids or labels is required\"}"},
+		{"too many", "{\"ids\": [\"a\", \"b\", \"c\", \"d\"]}", "{\"error\":\"ids must have at most 3 counters\"}"},
+	}
+	for _, tt := range tests {
+		w := postBatch(c, "/counter/batch/stop", "", tt.body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, tt.name)
+		assert.Equal(t, tt.expectedBody, w.Body.String(), tt.name)
+	}
+}
+
+// Up to the maximum batch size counters are stopped by labels at once
+func TestRouterStopCountersByLabels(t *testing.T) {
+	counter := NewCounterCalculator(NewMemoryStore())
+	c := NewController(counter, ControllerConfig{MaxBatchSize: 3})
+	createBatch(t, c, "", "[{\"to\": 60, \"labels\": {\"team\": \"payments\"}}, {\"to\": 60, \"labels\": {\"team\": \"payments\"}}, {\"to\": 60, \"labels\": {\"team\": \"payments\"}}]")
+	createBatch(t, c, "", "[{\"to\": 60, \"labels\": {\"team\": \"payments\"}}, {\"to\": 60, \"labels\": {\"team\": \"search\"}}]")
+
+	var stopped struct {
+		Results []batchStopResult `json:"results"`
+		More    bool              `json:"more"`
+	}
+	w := postBatch(c, "/counter/batch/stop", "", "{\"labels\": {\"team\": \"payments\"}}")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, validateResponse(http.MethodPost, "/counter/batch/stop", w))
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &stopped))
+	assert.Len(t, stopped.Results, 3)
+	assert.True(t, stopped.More)
+
+	stopped.More = false
+	w = postBatch(c, "/counter/batch/stop", "", "{\"labels\": {\"team\": \"payments\"}}")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &stopped))
+	assert.Len(t, stopped.Results, 1)
+	assert.False(t, stopped.More)
+	assert.Equal(t, 1, countCounters(t, counter))
+}
+
+func TestRouterStopCountersError(t *testing.T) {
+	d := &DummyCounter{DeleteCountersFunc: func(ctx context.Context, ids []string, owner string) ([]bool, error) {
+		return nil, errors.New("failed")
+	}}
+	c := NewController(d, ControllerConfig{MaxBatchSize: 100})
+	w := postBatch(c, "/counter/batch/stop", "", "{\"ids\": [\"a\"]}")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.NoError(t, validateResponse(http.MethodPost, "/counter/batch/stop", w))
+}
+
+// Batches only see the counters of the caller
+func TestRouterBatchAPIKeyOwnership(t *testing.T) {
+	dao := NewMemoryStore()
+	counter := NewCounterCalculator(dao)
+	c := NewController(counter, ControllerConfig{APIKeys: newTestAPIKeyStore(t, dao, ""), MaxBatchSize: 100})
+
+	assert.Equal(t, http.StatusUnauthorized, postBatch(c, "/counter/batch", "", "[{\"to\": 60}]").Code)
+	a := createBatch(t, c, "key-a", "[{\"to\": 60, \"labels\": {\"team\": \"payments\"}}]")
+	b := createBatch(t, c, "key-b", "[{\"to\": 60, \"labels\": {\"team\": \"payments\"}}]")
+
+	w := postBatch(c, "/counter/batch/stop", "key-b", fmt.Sprintf("{\"ids\": [%q]}", a[0]))
+	assert.Equal(t, fmt.Sprintf("{\"results\":[{\"id\":%q,\"status\":\"not_found\"}]}", a[0]), w.Body.String())
+	w = postBatch(c, "/counter/batch/stop", "key-b", "{\"labels\": {\"team\": \"payments\"}}")
+	assert.Equal(t, fmt.Sprintf("{\"results\":[{\"id\":%q,\"status\":\"stopped\"}]}", b[0]), w.Body.String())
+
+	r, _ := counter.GetCounter(context.Background(), a[0])
+	assert.True(t, r.counterExistence)
+}
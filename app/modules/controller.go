@@ -1,39 +1,145 @@
 package modules
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 type Controller struct {
 	counter Counter
 	router *gin.Engine
+	server *http.Server
 	listenPort string
+	// nil serves plain HTTP
+	tlsConfig *tls.Config
 	hostname string
+	// The header with the client IP set by the reverse proxy. Empty means the peer address is the client.
+	clientIPHeader string
+	shutdownTimeout time.Duration
+	// DB calls of a request time out after this. 0 means no timeout.
+	requestTimeout time.Duration
+	idempotencyWindow time.Duration
+	// nil if API keys are disabled
+	apiKeys *APIKeyStore
+	// nil if rate limits are disabled
+	rateLimiter *RateLimiter
+	// Counters per batch request. 0 disables batches.
+	maxBatchSize int
+	metrics *Metrics
+	streamTickInterval time.Duration
+	watchHub *watchHub
+	// 1 while it is shutting down. Accessed atomically.
+	draining int32
 }
 
 const (
 	counterPath string = "/counter"
 	stopPath string = "/stop"
+	pausePath string = "/pause"
+	resumePath string = "/resume"
+	callbackPath string = "/callback"
+	streamPath string = "/stream"
+	watchPath string = "/watch"
 	toQueryKey string = "to"
+	modeQueryKey string = "mode"
+	precisionQueryKey string = "precision"
+	cursorQueryKey string = "cursor"
+	limitQueryKey string = "limit"
+	labelQueryKey string = "label"
+	healthzPath string = "/healthz"
+	readyzPath string = "/readyz"
+	metricsPath string = "/metrics"
 )
 
+// DB has to respond to the readiness check within this time.
+const readinessTimeout = time.Second
+
+const (
+	defaultListLimit int64 = 100
+	maxListLimit int64 = 1000
+)
+
+// ControllerConfig is the settings of Controller. The zero value of each field disables the feature or uses the default.
+type ControllerConfig struct {
+	ListenPort string
+	// With this, it serves HTTPS instead of HTTP.
+	TLSConfig *tls.Config
+	Hostname string
+	// The header which the reverse proxy sets to the client IP, such as "X-Real-IP".
+	// Without this, the peer address is the client IP. Headers sent by clients are never trusted.
+	ClientIPHeader string
+	// How long Run waits for in-flight requests on shutdown
+	ShutdownTimeout time.Duration
+	// How long a request waits for DB before returning 503
+	RequestTimeout time.Duration
+	// How long the responses to requests with "Idempotency-Key" are kept
+	IdempotencyWindow time.Duration
+	// With this, the counter API requires API keys and each key can only see its own counters.
+	APIKeys *APIKeyStore
+	// With this, requests to the counter API are limited per client.
+	RateLimiter *RateLimiter
+	// How many counters can be generated or stopped by one batch request
+	MaxBatchSize int
+	// A new registry is used if nil.
+	Metrics *Metrics
+}
+
 // Initialize Controller instance. You would do this method first.
-func NewController(counter Counter, listenPort string, hostname string) *Controller {
+func NewController(counter Counter, config ControllerConfig) *Controller {
+	metrics := config.Metrics
+	if metrics == nil {
+		metrics = NewMetrics()
+	}
 	c := &Controller{
-		counter:    counter,
-		listenPort: listenPort,
-		hostname:   hostname,
+		counter:         counter,
+		listenPort:      config.ListenPort,
+		tlsConfig:       config.TLSConfig,
+		hostname:        config.Hostname,
+		clientIPHeader:  config.ClientIPHeader,
+		shutdownTimeout: config.ShutdownTimeout,
+		requestTimeout:  config.RequestTimeout,
+		idempotencyWindow: config.IdempotencyWindow,
+		apiKeys:         config.APIKeys,
+		rateLimiter:     config.RateLimiter,
+		maxBatchSize:    config.MaxBatchSize,
+		metrics:         metrics,
+		streamTickInterval: defaultStreamTickInterval,
+		watchHub:        newWatchHub(counter, defaultStreamTickInterval),
 	}
 	c.setupRouter()
 	return c
 }
 
 func (c *Controller) setupRouter() {
-	router := gin.Default()
+	// Use our own logger instead of the Gin default one to emit JSON lines with request IDs
+	router := gin.New()
+	// Gin trusts "X-Forwarded-For" from anyone by default, which lets clients pretend to be others
+	router.ForwardedByClientIP = false
+	router.Use(c.loggingMiddleware(), recoveryMiddleware(), c.metrics.GinMiddleware())
+	if onInvalidResponse != nil {
+		router.Use(openAPIResponseValidationMiddleware())
+	}
+
+	// Return metrics in the Prometheus format against "GET /metrics"
+	router.GET(metricsPath, gin.WrapH(c.metrics.Handler()))
+
+	// Return the OpenAPI document of this API against "GET /openapi.json"
+	router.GET(openAPIPath, func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, "application/json; charset=utf-8", []byte(openAPIDocument))
+	})
 
 	// Return hostname against "GET /"
 	router.GET("/", func(ctx *gin.Context) {
@@ -43,26 +149,142 @@ func (c *Controller) setupRouter() {
 		ctx.JSON(http.StatusOK, r)
 	})
 
-	// Return all registered counter IDs against "GET /counter"
-	router.GET(counterPath, func(ctx *gin.Context) {
-		ids, err := c.counter.ListAllCounterId()
+	// Return 200 as long as the process is alive against "GET /healthz"
+	router.GET(healthzPath, func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	// Return 200 only if this replica can serve counters against "GET /readyz"
+	router.GET(readyzPath, func(ctx *gin.Context) {
+		// Return 503 while draining, so that the load balancer stops routing new requests here.
+		if atomic.LoadInt32(&c.draining) == 1 {
+			ctx.JSON(http.StatusServiceUnavailable, errorFormatter("shutting down"))
+			return
+		}
+		// Return 503 if DB doesn't respond in time.
+		pingCtx, cancel := context.WithTimeout(ctx.Request.Context(), readinessTimeout)
+		defer cancel()
+		if err := c.counter.Ping(pingCtx); err != nil {
+			logRequestError(ctx, err)
+			ctx.JSON(http.StatusServiceUnavailable, errorFormatter("DB is unavailable"))
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"status": "ready"})
+	})
+
+	// Create and revoke API keys with the admin token
+	router.POST(adminAPIKeyPath, c.adminMiddleware(), c.openAPIValidationMiddleware(), c.createAPIKey)
+	router.DELETE(adminAPIKeysPath+"/:id", c.adminMiddleware(), c.openAPIValidationMiddleware(), c.deleteAPIKey)
+
+	// The counter API is under "/v1"
+	v1 := c.setupCounterRoutes(router.Group(v1Path))
+	// "POST /v1/counter/:id/stop" serves only "POST /v1/counter/batch/stop". Counters are deleted with "DELETE /v1/counter/:id".
+	v1.POST("/:id" + stopPath, requireBatchID(), c.stopCounters)
+
+	// The unversioned routes are the deprecated aliases of the "/v1" routes
+	legacy := c.setupCounterRoutes(router.Group("", c.deprecationMiddleware()))
+
+	// Delete the counter with the given ID and return no content against "POST /counter/:id/stop"
+	// It returns 204 even if the counter doesn't exist. "DELETE /v1/counter/:id" replaces it.
+	// Stop counters at once against "POST /counter/batch/stop" as well.
+	legacy.POST("/:id" + stopPath, dispatchBatch(c.stopCounters), c.counterIDMiddleware(), c.ownerMiddleware(), func(ctx *gin.Context) {
+		reqCtx, cancel := c.requestContext(ctx)
+		defer cancel()
+		id := ctx.Params.ByName("id")
+		_, err := c.counter.DeleteCounter(reqCtx, id)
+		// Return 500 if it failed to delete a counter.
+		if err != nil {
+			respondError(ctx, err)
+			return
+		}
+		c.metrics.countersStopped.Inc()
+		ctx.JSON(http.StatusNoContent, nil)
+	})
+
+	// Return 404 Not Found against no route
+	router.NoRoute(func(ctx *gin.Context) {
+		ctx.JSON(http.StatusNotFound, errorFormatter(http.StatusText(http.StatusNotFound)))
+	})
+
+	c.router = router
+}
+
+// Register the counter routes and "/watch" under the group, and return the group of "/counter".
+func (c *Controller) setupCounterRoutes(group *gin.RouterGroup) *gin.RouterGroup {
+	// All counter routes require the API key if API keys are enabled, and are rate limited per client
+	// Requests are validated after that, so that unauthenticated or limited clients can't make us parse their bodies.
+	counters := group.Group(counterPath, c.apiKeyMiddleware(), c.rateLimitMiddleware(), c.openAPIValidationMiddleware())
+
+	// Return registered counter IDs page by page against "GET /counter?cursor=[string]&limit=[int]"
+	// "next_cursor" in the response is the cursor of the next page, and is omitted on the last page.
+	// Counters can be filtered by labels with "label=[key]=[value]". Multiple labels mean AND.
+	// With API keys, only the counters created with the same key are listed.
+	counters.GET("", func(ctx *gin.Context) {
+		reqCtx, cancel := c.requestContext(ctx)
+		defer cancel()
+		labels := map[string]string{}
+		for _, s := range ctx.QueryArray(labelQueryKey) {
+			kv := strings.SplitN(s, "=", 2)
+			// Return 400 if the label selector is not like "key=value".
+			if len(kv) != 2 || kv[0] == "" {
+				ctx.JSON(http.StatusBadRequest, errorFormatter(fmt.Sprintf("the label %s is invalid", s)))
+				return
+			}
+			labels[kv[0]] = kv[1]
+		}
+
+		cursor := uint64(0)
+		if s := ctx.Query(cursorQueryKey); s != "" {
+			parsed, err := strconv.ParseUint(s, 10, 64)
+			// Return 400 if the value of the param "cursor" is invalid.
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, errorFormatter(fmt.Sprintf("the cursor %s is invalid", s)))
+				return
+			}
+			cursor = parsed
+		}
+
+		limit := defaultListLimit
+		if s := ctx.Query(limitQueryKey); s != "" {
+			parsed, err := strconv.ParseInt(s, 10, 64)
+			// Return 400 if the value of the param "limit" is not a positive integer.
+			if err != nil || parsed < 1 {
+				ctx.JSON(http.StatusBadRequest, errorFormatter(fmt.Sprintf("the limit %s is invalid", s)))
+				return
+			}
+			limit = parsed
+		}
+		if limit > maxListLimit {
+			limit = maxListLimit
+		}
 
+		// With API keys, only the counters of the caller are listed
+		ids, nextCursor, err := c.counter.ListCounters(reqCtx, requestOwner(ctx), labels, cursor, limit)
 		// Return 500 if it got some errors when IDs from DB
 		if err != nil {
-			logrus.Error(err)
-			ctx.JSON(http.StatusInternalServerError, errorFormatter(http.StatusText(http.StatusInternalServerError)))
+			respondError(ctx, err)
 			return
 		}
 
 		r := struct {
-			Ids []string `json:"ids"`
-		}{ids}
+			Ids        []string `json:"ids"`
+			NextCursor string   `json:"next_cursor,omitempty"`
+		}{Ids: ids}
+		if nextCursor != 0 {
+			r.NextCursor = strconv.FormatUint(nextCursor, 10)
+		}
 		ctx.JSON(http.StatusOK, r)
 	})
 
 
-	// Generate a new counter and return its counter ID against "POST /counter?to=[int]"
-	router.POST(counterPath, func(ctx *gin.Context) {
+	// Generate a new counter and return its counter ID against "POST /counter?to=[int]&mode=[countup|countdown]&precision=[s|ms]"
+	// With precision=ms, "to" and the counter are in milliseconds.
+	// The optional JSON body can have the name and labels like {"name": "deploy", "labels": {"team": "payments"}},
+	// and the callback fired on completion like {"callback": {"url": "https://example.com/hook", "payload": {...}}}
+	// With the "Idempotency-Key" header, retries get the same response without generating another counter.
+	counters.POST("", c.idempotencyMiddleware(), func(ctx *gin.Context) {
+		reqCtx, cancel := c.requestContext(ctx)
+		defer cancel()
 		to := ctx.Query(toQueryKey)
 
 		// Return 400 if "to" param is empty
@@ -78,34 +300,70 @@ func (c *Controller) setupRouter() {
 			return
 		}
 
-		id, errGenerateCounter := c.counter.GenerateCounter(toInt64)
+		var body struct {
+			Name   string            `json:"name"`
+			Labels map[string]string `json:"labels"`
+			Callback *Callback       `json:"callback"`
+		}
+		if ctx.Request.Body != nil && ctx.Request.ContentLength != 0 {
+			// Return 400 if the body is not the expected JSON. An empty body is allowed.
+			if err := ctx.ShouldBindJSON(&body); err != nil && err != io.EOF {
+				ctx.JSON(http.StatusBadRequest, errorFormatter("the request body is invalid"))
+				return
+			}
+		}
+		spec := CounterSpec{
+			To:        toInt64,
+			Mode:      ctx.Query(modeQueryKey),
+			Precision: ctx.Query(precisionQueryKey),
+			Name:      body.Name,
+			Labels:    body.Labels,
+			Callback:  body.Callback,
+			Owner:     requestOwner(ctx),
+		}
+		// Return 400 if the mode, precision, name, labels or callback are invalid.
+		if err := spec.Validate(); err != nil {
+			ctx.JSON(http.StatusBadRequest, errorFormatter(err.Error()))
+			return
+		}
+
+		id, errGenerateCounter := c.counter.GenerateCounter(reqCtx, spec)
 		// Return 500 if it failed to generate counter by some internal reasons.
 		if errGenerateCounter != nil {
-			logrus.Error(errGenerateCounter)
-			ctx.JSON(http.StatusInternalServerError, errorFormatter(http.StatusText(http.StatusInternalServerError)))
+			respondError(ctx, errGenerateCounter)
 			return
 		}
 
+		c.metrics.countersCreated.Inc()
 		r := struct {
 			Id string `json:"id"`
 		}{id}
 		ctx.JSON(http.StatusCreated, r)
 	})
 
+	// Generate counters at once against "POST /counter/batch"
+	// With the "Idempotency-Key" header, retries get the same response like "POST /counter".
+	counters.POST("/:id", requireBatchID(), c.idempotencyMiddleware(), c.createCounters)
+
+	// Counters of other API keys are 404 as if they don't exist
+	counter := counters.Group("/:id", c.counterIDMiddleware(), c.ownerMiddleware())
+
 	// Return counter corresponding to the specified ID against "GET /counter/:id"
-	router.GET(counterPath + "/:id", func(ctx *gin.Context) {
+	counter.GET("", func(ctx *gin.Context) {
+		reqCtx, cancel := c.requestContext(ctx)
+		defer cancel()
 		id := ctx.Params.ByName("id")
-		r, err := c.counter.GetCounter(id)
+		r, err := c.counter.GetCounter(reqCtx, id)
 
 		// Return 500 if internal error occurs
 		if err != nil {
-			logrus.Error(err)
-			ctx.JSON(http.StatusInternalServerError, errorFormatter(http.StatusText(http.StatusInternalServerError)))
+			respondError(ctx, err)
 			return
 		}
 
 		// Return 404 if such counter doesn't exist.
 		if !r.counterExistence  {
+			c.metrics.countersNotFound.Inc()
 			ctx.JSON(http.StatusNotFound, errorFormatter(fmt.Sprintf("no such counter with %s", id)))
 			return
 		}
@@ -113,37 +371,156 @@ func (c *Controller) setupRouter() {
 		ctx.JSON(http.StatusOK, r)
 	})
 
-	// Delete the counter with the given ID and return no content against "POST /counter/:id/stop"
-	router.POST(counterPath + "/:id" + stopPath, func(ctx *gin.Context) {
+	// Delete the counter with the given ID and return its final state against "DELETE /v1/counter/:id"
+	counter.DELETE("", c.changeCounterStateHandler(func(ctx context.Context, id string) (CounterResult, error) {
+		r, err := c.counter.DeleteCounter(ctx, id)
+		if err == nil && r.counterExistence {
+			c.metrics.countersStopped.Inc()
+		}
+		return r, err
+	}))
+
+	// Pause the counter with the given ID and return it against "POST /counter/:id/pause"
+	counter.POST(pausePath, c.changeCounterStateHandler(c.counter.PauseCounter))
+
+	// Resume the counter with the given ID and return it against "POST /counter/:id/resume"
+	counter.POST(resumePath, c.changeCounterStateHandler(c.counter.ResumeCounter))
+
+	// Return the callback and its delivery status against "GET /counter/:id/callback"
+	// It's available for a day after the callback is delivered or given up, even though the counter has expired.
+	// The owner is checked against the callback, since the counter may have gone.
+	counters.GET("/:id" + callbackPath, c.counterIDMiddleware(), func(ctx *gin.Context) {
+		reqCtx, cancel := c.requestContext(ctx)
+		defer cancel()
 		id := ctx.Params.ByName("id")
-		err := c.counter.DeleteCounter(id)
-		// Return 500 if it failed to delete a counter.
+		r, existence, err := c.counter.GetCallbackStatus(reqCtx, id)
+
+		// Return 500 if internal error occurs
 		if err != nil {
-			logrus.Error(err)
-			ctx.JSON(http.StatusInternalServerError, errorFormatter(http.StatusText(http.StatusInternalServerError)))
+			respondError(ctx, err)
+			return
 		}
-		ctx.JSON(http.StatusNoContent, nil)
-	})
 
-	// Return 404 Not Found against no route
-	router.NoRoute(func(ctx *gin.Context) {
-		ctx.JSON(http.StatusNotFound, errorFormatter(http.StatusText(http.StatusNotFound)))
+		// Return 404 if the counter has no callback.
+		if !existence || !c.isVisible(ctx, r.Owner) {
+			ctx.JSON(http.StatusNotFound, errorFormatter(fmt.Sprintf("no callback with %s", id)))
+			return
+		}
+
+		ctx.JSON(http.StatusOK, struct {
+			URL         string `json:"url"`
+			Status      string `json:"status"`
+			Attempts    int    `json:"attempts"`
+			LastError   string `json:"last_error,omitempty"`
+			DeliveredAt int64  `json:"delivered_at,omitempty"`
+		}{r.URL, r.Status, r.Attempts, r.LastError, r.DeliveredAt})
 	})
 
-	c.router = router
+	// Push the counter as Server-Sent Events against "GET /counter/:id/stream"
+	counter.GET(streamPath, c.streamCounter)
+
+	// Push the counters the client subscribes over WebSocket against "GET /watch"
+	// Only the counters of the API key are pushed if API keys are enabled.
+	group.GET(watchPath, c.apiKeyMiddleware(), c.rateLimitMiddleware(), c.openAPIValidationMiddleware(), c.watchCounters)
+
+	return counters
+}
+
+// Return 404 if the ID in the path can't be a counter ID, so that internal keys such as rate limit buckets and
+// callback records are never read or deleted through the counter routes.
+func (c *Controller) counterIDMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id := ctx.Params.ByName("id")
+		if !isCounterID(id) {
+			c.metrics.countersNotFound.Inc()
+			ctx.AbortWithStatusJSON(http.StatusNotFound, errorFormatter(fmt.Sprintf("no such counter with %s", id)))
+			return
+		}
+		ctx.Next()
+	}
 }
 
-// Run API server
+// Run API server until it receives SIGTERM or SIGINT.
+// It returns nil after all in-flight requests are drained.
 func (c *Controller) Run() error {
-	err := c.router.Run(":" + c.listenPort)
+	listener, err := net.Listen("tcp", ":"+c.listenPort)
 	if err != nil {
 		return err
 	}
+	if c.tlsConfig != nil {
+		listener = tls.NewListener(listener, c.tlsConfig)
+	}
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(quit)
+	return c.serve(listener, quit)
+}
+
+// Serve requests on the listener until a signal comes from quit, and then shut down gracefully.
+func (c *Controller) serve(listener net.Listener, quit <-chan os.Signal) error {
+	c.server = &http.Server{Handler: c.router}
+	errServe := make(chan error, 1)
+	go func() {
+		errServe <- c.server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errServe:
+		return err
+	case sig := <-quit:
+		logrus.Infof("Received %s. Stop accepting connections and drain in-flight requests.", sig)
+	}
+	atomic.StoreInt32(&c.draining, 1)
+
+	// Shutdown doesn't wait for WebSocket connections, so disconnect them here to let clients reconnect to another replica.
+	c.watchHub.close()
+
+	// Shutdown closes the listener first, and then waits for in-flight requests until the timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), c.shutdownTimeout)
+	defer cancel()
+	if err := c.server.Shutdown(ctx); err != nil {
+		return err
+	}
+	logrus.Info("All in-flight requests are drained.")
 	return nil
 }
 
+// Return a handler which applies the given operation to the counter with ID in the path and returns the result.
+func (c *Controller) changeCounterStateHandler(operation func(ctx context.Context, id string) (CounterResult, error)) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		reqCtx, cancel := c.requestContext(ctx)
+		defer cancel()
+		id := ctx.Params.ByName("id")
+		r, err := operation(reqCtx, id)
+
+		// Return 500 if internal error occurs
+		if err != nil {
+			respondError(ctx, err)
+			return
+		}
+
+		// Return 404 if such counter doesn't exist.
+		if !r.counterExistence {
+			ctx.JSON(http.StatusNotFound, errorFormatter(fmt.Sprintf("no such counter with %s", id)))
+			return
+		}
+
+		ctx.JSON(http.StatusOK, r)
+	}
+}
+
 func errorFormatter(s string) interface{} {
 	return struct {
 		Error string `json:"error"`
 	}{s}
-}
\ No newline at end of file
+}
+
+// Return the IP address of the client, taken from the header of the reverse proxy if it's configured.
+func (c *Controller) clientIP(ctx *gin.Context) string {
+	if c.clientIPHeader != "" {
+		if ip := strings.TrimSpace(ctx.GetHeader(c.clientIPHeader)); ip != "" {
+			return ip
+		}
+	}
+	return ctx.ClientIP()
+}
@@ -1,39 +1,87 @@
 package modules
 
 import (
+	"context"
 	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
 
 	"github.com/stretchr/testify/assert"
 )
 
 // DummyCounter implementing Counter interface
 type DummyCounter struct {
-	GenerateCounterFunc  func(to int64) (string, error)
-	GetCounterFunc       func(id string) (CounterResult, error)
-	ListAllCounterIdFunc func() ([]string, error)
-	DeleteCounterFunc    func(id string) error
+	GenerateCounterFunc  func(ctx context.Context, spec CounterSpec) (string, error)
+	GetCounterFunc       func(ctx context.Context, id string) (CounterResult, error)
+	GetCountersFunc func(ctx context.Context, ids []string) (map[string]CounterResult, error)
+	ListCountersFunc func(ctx context.Context, owner string, labels map[string]string, cursor uint64, limit int64) ([]string, uint64, error)
+	GenerateCountersFunc func(ctx context.Context, specs []CounterSpec) ([]string, error)
+	DeleteCountersFunc func(ctx context.Context, ids []string, owner string) ([]bool, error)
+	DeleteCounterFunc    func(ctx context.Context, id string) (CounterResult, error)
+	PauseCounterFunc     func(ctx context.Context, id string) (CounterResult, error)
+	ResumeCounterFunc    func(ctx context.Context, id string) (CounterResult, error)
+	PingFunc             func(ctx context.Context) error
+	GetCallbackStatusFunc func(ctx context.Context, id string) (CallbackRecord, bool, error)
+	ReserveIdempotencyKeyFunc func(ctx context.Context, key string, fingerprint string) (IdempotencyRecord, bool, error)
+	CompleteIdempotencyKeyFunc func(ctx context.Context, key string, record IdempotencyRecord, windowSecond int64) error
+	ReleaseIdempotencyKeyFunc func(ctx context.Context, key string) error
 }
 
-func (d *DummyCounter) GenerateCounter(to int64) (string, error) {
-	return d.GenerateCounterFunc(to)
+func (d *DummyCounter) GenerateCounter(ctx context.Context, spec CounterSpec) (string, error) {
+	return d.GenerateCounterFunc(ctx, spec)
+}
+func (d *DummyCounter) GetCounter(ctx context.Context, id string) (CounterResult, error) {
+	return d.GetCounterFunc(ctx, id)
+}
+func (d *DummyCounter) GetCounters(ctx context.Context, ids []string) (map[string]CounterResult, error) {
+	return d.GetCountersFunc(ctx, ids)
+}
+func (d *DummyCounter) ListCounters(ctx context.Context, owner string, labels map[string]string, cursor uint64, limit int64) ([]string, uint64, error) {
+	return d.ListCountersFunc(ctx, owner, labels, cursor, limit)
+}
+func (d *DummyCounter) DeleteCounter(ctx context.Context, id string) (CounterResult, error) {
+	return d.DeleteCounterFunc(ctx, id)
+}
+func (d *DummyCounter) GenerateCounters(ctx context.Context, specs []CounterSpec) ([]string, error) {
+	return d.GenerateCountersFunc(ctx, specs)
+}
+func (d *DummyCounter) DeleteCounters(ctx context.Context, ids []string, owner string) ([]bool, error) {
+	return d.DeleteCountersFunc(ctx, ids, owner)
+}
+func (d *DummyCounter) PauseCounter(ctx context.Context, id string) (CounterResult, error) {
+	return d.PauseCounterFunc(ctx, id)
+}
+func (d *DummyCounter) ResumeCounter(ctx context.Context, id string) (CounterResult, error) {
+	return d.ResumeCounterFunc(ctx, id)
+}
+func (d *DummyCounter) Ping(ctx context.Context) error {
+	return d.PingFunc(ctx)
 }
-func (d *DummyCounter) GetCounter(id string) (CounterResult, error) {
-	return d.GetCounterFunc(id)
+func (d *DummyCounter) GetCallbackStatus(ctx context.Context, id string) (CallbackRecord, bool, error) {
+	return d.GetCallbackStatusFunc(ctx, id)
 }
-func (d *DummyCounter) ListAllCounterId() ([]string, error) {
-	return d.ListAllCounterIdFunc()
+func (d *DummyCounter) ReserveIdempotencyKey(ctx context.Context, key string, fingerprint string) (IdempotencyRecord, bool, error) {
+	return d.ReserveIdempotencyKeyFunc(ctx, key, fingerprint)
 }
-func (d *DummyCounter) DeleteCounter(id string) error {
-	return d.DeleteCounterFunc(id)
+func (d *DummyCounter) CompleteIdempotencyKey(ctx context.Context, key string, record IdempotencyRecord, windowSecond int64) error {
+	return d.CompleteIdempotencyKeyFunc(ctx, key, record, windowSecond)
+}
+func (d *DummyCounter) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	return d.ReleaseIdempotencyKeyFunc(ctx, key)
 }
 
 // return hostname with JSON formatted against the request "/"
 func TestRouterGetHostname(t *testing.T) {
 	d := &DummyCounter{}
-	c := NewController(d, "8080", "test-kenji-kondo.mac.local")
+	c := NewController(d, ControllerConfig{ListenPort: "8080", Hostname: "test-kenji-kondo.mac.local"})
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest(http.MethodGet, "/", nil)
 	c.router.ServeHTTP(w, req)
@@ -42,30 +90,146 @@ func TestRouterGetHostname(t *testing.T) {
 
 }
 
-// tests of GET /counter
+// tests of GET /healthz
+func TestRouterHealthz(t *testing.T) {
+	// It must not depend on DB
+	d := &DummyCounter{}
+	c := NewController(d, ControllerConfig{})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/healthz", nil)
+	c.router.ServeHTTP(w, req)
+	assert.Equal(t, "{\"status\":\"ok\"}", w.Body.String())
+	assert.Equal(t, 200, w.Code)
+}
+
+// tests of GET /readyz
+func TestRouterReadyz(t *testing.T) {
+	type testCase struct {
+		pingError      error
+		draining       bool
+		expectedBody   string
+		expectedStatus int
+	}
+	var cases = []testCase{
+		{
+			nil,
+			false,
+			"{\"status\":\"ready\"}",
+			200,
+		},
+		{
+			errors.New("context deadline exceeded"),
+			false,
+			"{\"error\":\"DB is unavailable\"}",
+			503,
+		},
+		{
+			nil,
+			true,
+			"{\"error\":\"shutting down\"}",
+			503,
+		},
+	}
+
+	for _, i := range cases {
+		d := &DummyCounter{PingFunc: func(ctx context.Context) error {
+			deadline, ok := ctx.Deadline()
+			assert.True(t, ok)
+			assert.True(t, time.Until(deadline) <= readinessTimeout)
+			return i.pingError
+		}}
+		c := NewController(d, ControllerConfig{})
+		if i.draining {
+			c.draining = 1
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+		c.router.ServeHTTP(w, req)
+		assert.Equal(t, i.expectedBody, w.Body.String())
+		assert.Equal(t, i.expectedStatus, w.Code)
+	}
+}
+
+// tests of GET /counter?cursor=[string]&limit=[int]
 func TestRouterGetAllCounterIDs(t *testing.T) {
 	type testCase struct {
+		queryString        string
 		registeredIds      []string
+		nextCursor         uint64
 		internalError      error
+		expectedCursor     uint64
+		expectedLimit      int64
 		expectedBody       string
 		expectedHttpStatus int
 	}
 	var cases = []testCase{
 		{
+			"",
 			[]string{"1a0ca312-558f-4a13-987f-ba86930ec9ef", "3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e"},
+			0,
 			nil,
+			0,
+			100,
 			"{\"ids\":[\"1a0ca312-558f-4a13-987f-ba86930ec9ef\",\"3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e\"]}",
 			200,
 		},
 		{
+			"",
+			[]string{},
+			0,
+			nil,
+			0,
+			100,
+			"{\"ids\":[]}",
+			200,
+		},
+		{
+			"?cursor=12&limit=1",
+			[]string{"1a0ca312-558f-4a13-987f-ba86930ec9ef"},
+			34,
+			nil,
+			12,
+			1,
+			"{\"ids\":[\"1a0ca312-558f-4a13-987f-ba86930ec9ef\"],\"next_cursor\":\"34\"}",
+			200,
+		},
+		{
+			"?limit=100000", // too large limit is capped
 			[]string{},
+			0,
 			nil,
+			0,
+			1000,
 			"{\"ids\":[]}",
 			200,
 		},
 		{
+			"?cursor=kondokenji",
 			nil,
+			0,
+			nil,
+			0,
+			0,
+			"{\"error\":\"the cursor kondokenji is invalid\"}",
+			400,
+		},
+		{
+			"?limit=0",
+			nil,
+			0,
+			nil,
+			0,
+			0,
+			"{\"error\":\"the limit 0 is invalid\"}",
+			400,
+		},
+		{
+			"",
+			nil,
+			0,
 			errors.New("some error"),
+			0,
+			100,
 			"{\"error\":\"Internal Server Error\"}",
 			500,
 		},
@@ -73,15 +237,18 @@ func TestRouterGetAllCounterIDs(t *testing.T) {
 
 	for _, i := range cases {
 		d := &DummyCounter{
-			ListAllCounterIdFunc: func() (strings []string, err error) {
+			ListCountersFunc: func(ctx context.Context, owner string, labels map[string]string, cursor uint64, limit int64) (strings []string, next uint64, err error) {
+				assert.Equal(t, i.expectedCursor, cursor)
+				assert.Equal(t, i.expectedLimit, limit)
 				strings = i.registeredIds
+				next = i.nextCursor
 				err = i.internalError
 				return
 			},
 		}
-		c := NewController(d, "", "")
+		c := NewController(d, ControllerConfig{})
 		w := httptest.NewRecorder()
-		req, _ := http.NewRequest(http.MethodGet, "/counter", nil)
+		req, _ := http.NewRequest(http.MethodGet, "/counter"+i.queryString, nil)
 		c.router.ServeHTTP(w, req)
 		assert.Equal(t, i.expectedBody, w.Body.String())
 		assert.Equal(t, i.expectedHttpStatus, w.Code)
@@ -143,12 +310,110 @@ func TestRouterGenerateCounter(t *testing.T) {
 	}
 
 	for _, i := range cases {
-		d := &DummyCounter{GenerateCounterFunc: func(to int64) (s string, err error) {
+		d := &DummyCounter{GenerateCounterFunc: func(ctx context.Context, spec CounterSpec) (s string, err error) {
 			s = i.generatedId
 			err = i.internalError
 			return
 		}}
-		c := NewController(d, "", "")
+		c := NewController(d, ControllerConfig{})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/counter"+i.queryString, nil)
+		c.router.ServeHTTP(w, req)
+		assert.Equal(t, i.expectedBody, w.Body.String())
+		assert.Equal(t, i.expectedHttpStatus, w.Code)
+	}
+}
+
+// tests of POST /counter?to=[int] with the name and labels in the body
+func TestRouterGenerateCounterWithNameAndLabels(t *testing.T) {
+	type testCase struct {
+		body               string
+		expectedSpec       CounterSpec
+		expectedBody       string
+		expectedHttpStatus int
+	}
+	var cases = []testCase{
+		{
+			"{\"name\":\"deploy\",\"labels\":{\"team\":\"payments\"}}",
+			CounterSpec{To: 1000, Name: "deploy", Labels: map[string]string{"team": "payments"}},
+			"{\"id\":\"3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e\"}",
+			201,
+		},
+		{
+			"",
+			CounterSpec{To: 1000},
+			"{\"id\":\"3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e\"}",
+			201,
+		},
+		{
+			"{\"name\":",
+			CounterSpec{},
+			"{\"error\":\"the request body is invalid\"}",
+			400,
+		},
+		{
+			"{\"callback\":{\"url\":\"ftp://example.com\"}}",
+			CounterSpec{},
+			"{\"error\":\"callback url must be an absolute http or https URL\"}",
+			400,
+		},
+		{
+			"{\"labels\":{\"a=b\":\"c\"}}",
+			CounterSpec{},
+			"{\"error\":\"label key a=b must not contain \\\"=\\\"\"}",
+			400,
+		},
+	}
+
+	for _, i := range cases {
+		d := &DummyCounter{GenerateCounterFunc: func(ctx context.Context, spec CounterSpec) (string, error) {
+			assert.Equal(t, i.expectedSpec, spec)
+			return "3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e", nil
+		}}
+		c := NewController(d, ControllerConfig{})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/counter?to=1000", strings.NewReader(i.body))
+		c.router.ServeHTTP(w, req)
+		assert.Equal(t, i.expectedBody, w.Body.String())
+		assert.Equal(t, i.expectedHttpStatus, w.Code)
+	}
+}
+
+// tests of POST /counter?to=[int]&mode=[countup|countdown]
+func TestRouterGenerateCounterWithMode(t *testing.T) {
+	type testCase struct {
+		queryString        string
+		expectedMode       string
+		expectedBody       string
+		expectedHttpStatus int
+	}
+	var cases = []testCase{
+		{
+			"?to=1000&mode=countdown",
+			CounterModeCountDown,
+			"{\"id\":\"3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e\"}",
+			201,
+		},
+		{
+			"?to=1000&mode=countup",
+			CounterModeCountUp,
+			"{\"id\":\"3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e\"}",
+			201,
+		},
+		{
+			"?to=1000&mode=sideways",
+			"",
+			"{\"error\":\"mode must be countup or countdown\"}",
+			400,
+		},
+	}
+
+	for _, i := range cases {
+		d := &DummyCounter{GenerateCounterFunc: func(ctx context.Context, spec CounterSpec) (string, error) {
+			assert.Equal(t, i.expectedMode, spec.Mode)
+			return "3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e", nil
+		}}
+		c := NewController(d, ControllerConfig{})
 		w := httptest.NewRecorder()
 		req, _ := http.NewRequest(http.MethodPost, "/counter"+i.queryString, nil)
 		c.router.ServeHTTP(w, req)
@@ -157,6 +422,49 @@ func TestRouterGenerateCounter(t *testing.T) {
 	}
 }
 
+// tests of GET /counter?label=[key]=[value]
+func TestRouterGetCounterIDsByLabels(t *testing.T) {
+	type testCase struct {
+		queryString        string
+		expectedLabels     map[string]string
+		expectedBody       string
+		expectedHttpStatus int
+	}
+	var cases = []testCase{
+		{
+			"?label=team=payments",
+			map[string]string{"team": "payments"},
+			"{\"ids\":[\"1a0ca312-558f-4a13-987f-ba86930ec9ef\"]}",
+			200,
+		},
+		{
+			"?label=team=payments&label=env=prod=1",
+			map[string]string{"team": "payments", "env": "prod=1"},
+			"{\"ids\":[\"1a0ca312-558f-4a13-987f-ba86930ec9ef\"]}",
+			200,
+		},
+		{
+			"?label=team",
+			nil,
+			"{\"error\":\"the label team is invalid\"}",
+			400,
+		},
+	}
+
+	for _, i := range cases {
+		d := &DummyCounter{ListCountersFunc: func(ctx context.Context, owner string, labels map[string]string, cursor uint64, limit int64) ([]string, uint64, error) {
+			assert.Equal(t, i.expectedLabels, labels)
+			return []string{"1a0ca312-558f-4a13-987f-ba86930ec9ef"}, 0, nil
+		}}
+		c := NewController(d, ControllerConfig{})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/counter"+i.queryString, nil)
+		c.router.ServeHTTP(w, req)
+		assert.Equal(t, i.expectedBody, w.Body.String())
+		assert.Equal(t, i.expectedHttpStatus, w.Code)
+	}
+}
+
 // tests of GET /counter/:id
 func TestRouterGetCurrentCounter(t *testing.T) {
 	type testCase struct {
@@ -203,12 +511,12 @@ func TestRouterGetCurrentCounter(t *testing.T) {
 	}
 
 	for _, i := range cases {
-		d := &DummyCounter{GetCounterFunc: func(id string) (result CounterResult, err error) {
+		d := &DummyCounter{GetCounterFunc: func(ctx context.Context, id string) (result CounterResult, err error) {
 			result = i.currentCounter
 			err = i.internalError
 			return
 		}}
-		c := NewController(d, "", "")
+		c := NewController(d, ControllerConfig{})
 		w := httptest.NewRecorder()
 		req, _ := http.NewRequest(http.MethodGet, "/counter"+i.inputID, nil)
 		c.router.ServeHTTP(w, req)
@@ -222,29 +530,244 @@ func TestRouterDeleteCounter(t *testing.T) {
 	type testCase struct {
 		inputID        string
 		internalError  error
+		expectedBody   string
 		expectedStatus int
 	}
 	var cases = []testCase{
 		{
 			"/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e/stop",
 			nil,
+			"",
 			204,
 		},
 		{
 			"/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e/stop",
 			errors.New("some error"),
+			"{\"error\":\"Internal Server Error\"}",
 			500,
 		},
 	}
 
 	for _, i := range cases {
-		d := &DummyCounter{DeleteCounterFunc: func(id string) error {
-			return i.internalError
+		d := &DummyCounter{DeleteCounterFunc: func(ctx context.Context, id string) (CounterResult, error) {
+			return CounterResult{}, i.internalError
 		}}
-		c := NewController(d, "", "")
+		c := NewController(d, ControllerConfig{})
 		w := httptest.NewRecorder()
 		req, _ := http.NewRequest(http.MethodPost, "/counter"+i.inputID, nil)
 		c.router.ServeHTTP(w, req)
+		assert.Equal(t, i.expectedBody, w.Body.String())
+		assert.Equal(t, i.expectedStatus, w.Code)
+		assert.Equal(t, "true", w.Header().Get(deprecationHeader))
+		assert.Equal(t, "</v1/counter/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e>; rel=\"successor-version\"", w.Header().Get(linkHeader))
+	}
+}
+
+// tests of DELETE /v1/counter/:id
+func TestRouterV1DeleteCounter(t *testing.T) {
+	type testCase struct {
+		result         CounterResult
+		internalError  error
+		expectedBody   string
+		expectedStatus int
+	}
+	var cases = []testCase{
+		{
+			CounterResult{Current: 10, To: 1000, counterExistence: true},
+			nil,
+			"{\"current\":10,\"to\":1000}",
+			200,
+		},
+		{
+			CounterResult{},
+			nil,
+			"{\"error\":\"no such counter with 3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e\"}",
+			404,
+		},
+		{
+			CounterResult{},
+			errors.New("some error"),
+			"{\"error\":\"Internal Server Error\"}",
+			500,
+		},
+	}
+
+	for _, i := range cases {
+		d := &DummyCounter{DeleteCounterFunc: func(ctx context.Context, id string) (CounterResult, error) {
+			return i.result, i.internalError
+		}}
+		c := NewController(d, ControllerConfig{})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodDelete, "/v1/counter/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e", nil)
+		c.router.ServeHTTP(w, req)
+		assert.Equal(t, i.expectedBody, w.Body.String())
+		assert.Equal(t, i.expectedStatus, w.Code)
+		assert.Equal(t, "", w.Header().Get(deprecationHeader))
+	}
+}
+
+// DELETE /v1/counter/:id never deletes keys which it reports as 404
+func TestRouterDeleteNonCounter(t *testing.T) {
+	m := newMemoryStore(time.Now)
+	c := NewController(NewCounterCalculator(m), ControllerConfig{})
+	keys := map[string]string{
+		"ratelimit:read:ip=1.2.3.4":                     "0 1591115560000",
+		"callback:9dd29757-ed4e-488f-b62c-b8cececbac29": "{\"url\":\"https://example.com\"}",
+		// A UUID key of another application
+		"9dd29757-ed4e-488f-b62c-b8cececbac29": "{\"user\":\"alice\"}",
+	}
+	for key, value := range keys {
+		_ = m.Set(context.Background(), key, value, 0)
+	}
+
+	for key, value := range keys {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodDelete, "/v1/counter/"+key, nil)
+		c.router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code, key)
+		assert.Equal(t, "{\"error\":\"no such counter with "+key+"\"}", w.Body.String(), key)
+		got, err := m.Get(context.Background(), key)
+		assert.NoError(t, err, key)
+		assert.Equal(t, value, got, key)
+	}
+}
+
+// The unversioned routes are the same as the "/v1" routes except the headers
+func TestRouterDeprecatedAliases(t *testing.T) {
+	d := &DummyCounter{GetCounterFunc: func(ctx context.Context, id string) (CounterResult, error) {
+		return CounterResult{Current: 10, To: 1000, counterExistence: true}, nil
+	}}
+	c := NewController(d, ControllerConfig{})
+	tests := []struct {
+		path         string
+		expectedLink string
+	}{
+		{"/v1/counter/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e", ""},
+		{"/counter/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e", "</v1/counter/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e>; rel=\"successor-version\""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, tt.path, nil)
+		c.router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, tt.path)
+		assert.Equal(t, "{\"current\":10,\"to\":1000}", w.Body.String(), tt.path)
+		assert.Equal(t, tt.expectedLink, w.Header().Get(linkHeader), tt.path)
+	}
+
+	// Only the batch route is served by "POST /v1/counter/:id/stop"
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/v1/counter/abc/stop", nil)
+	c.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// tests of POST /counter/:id/pause and POST /counter/:id/resume
+func TestRouterPauseAndResumeCounter(t *testing.T) {
+	type testCase struct {
+		path           string
+		result         CounterResult
+		internalError  error
+		expectedBody   string
+		expectedStatus int
+	}
+	var cases = []testCase{
+		{
+			"/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e/pause",
+			CounterResult{
+				Current:          10,
+				To:               1000,
+				Paused:           true,
+				counterExistence: true,
+			},
+			nil,
+			"{\"current\":10,\"to\":1000,\"paused\":true}",
+			200,
+		},
+		{
+			"/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e/resume",
+			CounterResult{
+				Current:          10,
+				To:               1000,
+				counterExistence: true,
+			},
+			nil,
+			"{\"current\":10,\"to\":1000}",
+			200,
+		},
+		{
+			"/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e/pause",
+			CounterResult{},
+			nil,
+			"{\"error\":\"no such counter with 3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e\"}",
+			404,
+		},
+		{
+			"/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e/resume",
+			CounterResult{},
+			errors.New("some error"),
+			"{\"error\":\"Internal Server Error\"}",
+			500,
+		},
+	}
+
+	for _, i := range cases {
+		f := func(ctx context.Context, id string) (result CounterResult, err error) {
+			result = i.result
+			err = i.internalError
+			return
+		}
+		d := &DummyCounter{PauseCounterFunc: f, ResumeCounterFunc: f}
+		c := NewController(d, ControllerConfig{})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/counter"+i.path, nil)
+		c.router.ServeHTTP(w, req)
+		assert.Equal(t, i.expectedBody, w.Body.String())
+		assert.Equal(t, i.expectedStatus, w.Code)
+	}
+}
+
+// tests of GET /counter/:id/callback
+func TestRouterGetCallbackStatus(t *testing.T) {
+	type testCase struct {
+		record         CallbackRecord
+		existence      bool
+		internalError  error
+		expectedBody   string
+		expectedStatus int
+	}
+	var cases = []testCase{
+		{
+			CallbackRecord{URL: "https://example.com/hook", Status: CallbackStatusDelivered, Attempts: 1, DeliveredAt: 1591115570000},
+			true,
+			nil,
+			"{\"url\":\"https://example.com/hook\",\"status\":\"delivered\",\"attempts\":1,\"delivered_at\":1591115570000}",
+			200,
+		},
+		{
+			CallbackRecord{},
+			false,
+			nil,
+			"{\"error\":\"no callback with 3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e\"}",
+			404,
+		},
+		{
+			CallbackRecord{},
+			false,
+			errors.New("some error"),
+			"{\"error\":\"Internal Server Error\"}",
+			500,
+		},
+	}
+
+	for _, i := range cases {
+		d := &DummyCounter{GetCallbackStatusFunc: func(ctx context.Context, id string) (CallbackRecord, bool, error) {
+			return i.record, i.existence, i.internalError
+		}}
+		c := NewController(d, ControllerConfig{})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/counter/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e/callback", nil)
+		c.router.ServeHTTP(w, req)
+		assert.Equal(t, i.expectedBody, w.Body.String())
 		assert.Equal(t, i.expectedStatus, w.Code)
 	}
 }
@@ -274,7 +797,7 @@ func TestRouterNotFound(t *testing.T) {
 
 	for _, i := range cases {
 		d := &DummyCounter{}
-		c := NewController(d, "", "")
+		c := NewController(d, ControllerConfig{})
 		w := httptest.NewRecorder()
 		req, _ := http.NewRequest(i.method, i.path, nil)
 		c.router.ServeHTTP(w, req)
@@ -282,3 +805,40 @@ func TestRouterNotFound(t *testing.T) {
 		assert.Equal(t, i.expectedStatus, w.Code)
 	}
 }
+
+// in-flight requests have to be completed after the signal
+func TestControllerGracefulShutdown(t *testing.T) {
+	c := NewController(&DummyCounter{}, ControllerConfig{ShutdownTimeout: 5*time.Second})
+	handling := make(chan struct{})
+	c.router.GET("/slow", func(ctx *gin.Context) {
+		close(handling)
+		time.Sleep(500 * time.Millisecond)
+		ctx.String(http.StatusOK, "done")
+	})
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	quit := make(chan os.Signal, 1)
+	errServe := make(chan error, 1)
+	go func() {
+		errServe <- c.serve(listener, quit)
+	}()
+
+	status := make(chan int, 1)
+	go func() {
+		res, err := http.Get("http://" + listener.Addr().String() + "/slow")
+		if err != nil {
+			status <- 0
+			return
+		}
+		_ = res.Body.Close()
+		status <- res.StatusCode
+	}()
+
+	<-handling
+	quit <- syscall.SIGTERM
+	assert.Equal(t, http.StatusOK, <-status)
+	assert.Nil(t, <-errServe)
+
+	// New connections are refused after shutdown
+	_, err := http.Get("http://" + listener.Addr().String() + "/")
+	assert.NotNil(t, err)
+}
@@ -1,33 +1,176 @@
 package modules
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"strings"
 	"time"
 )
 
 type CounterResult struct {
-	Current          int64 `json:"current"`
-	To               int64 `json:"to"`
+	Current          int64             `json:"current"`
+	To               int64             `json:"to"`
+	Paused           bool              `json:"paused,omitempty"`
+	Mode             string            `json:"mode,omitempty"`
+	Precision        string            `json:"precision,omitempty"`
+	Name             string            `json:"name,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	// ID of the API key which has created the counter
+	owner            string
 	counterExistence bool
 }
 
+// CounterSpec describes a counter to be generated.
+type CounterSpec struct {
+	To     int64
+	Mode   string
+	// PrecisionMillisecond lets To and the result be in milliseconds.
+	Precision string
+	Name   string
+	Labels map[string]string
+	// Optional callback fired when the counter reaches its target
+	Callback *Callback
+	// ID of the API key which creates the counter. Empty if API keys are disabled.
+	Owner string
+}
+
+const (
+	maxCounterNameLength  int = 256
+	maxLabelNum           int = 32
+	maxLabelKeyLength     int = 64
+	maxLabelValueLength   int = 256
+	labelIndexKeyPrefix string = "label:"
+	ownerIndexKeyPrefix string = "owner:"
+	// Sorted set of "<id> <index key>" scored by when the counter expires, so that expired counters are pruned from the indexes.
+	indexExpiryKey string = "index:expiry"
+)
+
+const (
+	// CounterModeCountUp counts 1, 2, ..., to. It's the default.
+	CounterModeCountUp string = "countup"
+	// CounterModeCountDown counts the remaining seconds to, to-1, ..., 1 until the counter expires.
+	CounterModeCountDown string = "countdown"
+)
+
+const (
+	PrecisionSecond      string = "s"
+	PrecisionMillisecond string = "ms"
+)
+
+// Counter IDs are UUIDs in the canonical form, which never contain ":" unlike internal keys.
+// Other IDs are never looked up, so that clients can't read or delete internal keys through the counter API.
+func isCounterID(id string) bool {
+	_, err := uuid.Parse(id)
+	return err == nil && len(id) == 36 && !isInternalKey(id)
+}
+
+// Return only the IDs which can be counters.
+func counterIDs(ids []string) []string {
+	valid := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if isCounterID(id) {
+			valid = append(valid, id)
+		}
+	}
+	return valid
+}
+
+// Rolling back a failed generation doesn't depend on the request, which may have already timed out.
+const rollbackTimeout = 5 * time.Second
+
 type Counter interface {
-	GenerateCounter(to int64) (string, error)
-	GetCounter(id string) (CounterResult, error)
-	ListAllCounterId() ([]string, error)
-	DeleteCounter(id string) error
+	GenerateCounter(ctx context.Context, spec CounterSpec) (string, error)
+	GetCounter(ctx context.Context, id string) (CounterResult, error)
+	// Get the counters in one round trip. Nonexistent ones are in the result as GetCounter returns them.
+	GetCounters(ctx context.Context, ids []string) (map[string]CounterResult, error)
+	// List counter IDs which have all the given labels page by page. labels can be empty.
+	// With owner, only the counters of the owner are listed.
+	ListCounters(ctx context.Context, owner string, labels map[string]string, cursor uint64, limit int64) ([]string, uint64, error)
+	// Delete the counter and return its final state.
+	DeleteCounter(ctx context.Context, id string) (CounterResult, error)
+	// Generate the counters in one round trip, and return their IDs in the same order. The specs must be valid.
+	GenerateCounters(ctx context.Context, specs []CounterSpec) ([]string, error)
+	// Delete the counters in one round trip, and return whether each of them existed.
+	// With owner, counters of others are not deleted and reported as nonexistent.
+	DeleteCounters(ctx context.Context, ids []string, owner string) ([]bool, error)
+	PauseCounter(ctx context.Context, id string) (CounterResult, error)
+	ResumeCounter(ctx context.Context, id string) (CounterResult, error)
+	// Get the callback and its delivery status. The second returned value is false if the counter has no callback.
+	GetCallbackStatus(ctx context.Context, id string) (CallbackRecord, bool, error)
+	// Reserve the idempotency key. If it's already reserved, it returns false with the record stored with it.
+	ReserveIdempotencyKey(ctx context.Context, key string, fingerprint string) (IdempotencyRecord, bool, error)
+	CompleteIdempotencyKey(ctx context.Context, key string, record IdempotencyRecord, windowSecond int64) error
+	ReleaseIdempotencyKey(ctx context.Context, key string) error
+	Ping(ctx context.Context) error
 }
 
 type CountCalculator struct {
 	dao Dao
 	generateUUID func() string
 	generateTimestamp func() int64
+	generateTimestampMillisecond func() int64
 }
 
 type DaoValueFormat struct {
 	StartTimestamp int64 `json:"start_timestamp"`
 	EndTimestamp int64 `json:"end_timestamp"`
+	// Unix timestamp when the counter was paused. 0 means it's running.
+	PausedTimestamp int64 `json:"paused_timestamp,omitempty"`
+	// Total seconds the counter has been paused, excluding the current pause.
+	PausedDuration int64 `json:"paused_duration,omitempty"`
+	Name string `json:"name,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// Empty means CounterModeCountUp, to be compatible with counters stored before modes were introduced.
+	Mode string `json:"mode,omitempty"`
+	// PrecisionMillisecond means all timestamps and durations above are in milliseconds. Empty means seconds.
+	Precision string `json:"precision,omitempty"`
+	// True if the callback is registered. Its schedule has to follow pause and resume.
+	Callback bool `json:"callback,omitempty"`
+	// ID of the API key which has created the counter
+	Owner string `json:"owner,omitempty"`
+}
+
+// Validate the name and labels. It returns the error which can be shown to users as it is.
+func (s CounterSpec) Validate() error {
+	if s.Mode != "" && s.Mode != CounterModeCountUp && s.Mode != CounterModeCountDown {
+		return fmt.Errorf("mode must be %s or %s", CounterModeCountUp, CounterModeCountDown)
+	}
+	if s.Precision != "" && s.Precision != PrecisionSecond && s.Precision != PrecisionMillisecond {
+		return fmt.Errorf("precision must be %s or %s", PrecisionSecond, PrecisionMillisecond)
+	}
+	if len(s.Name) > maxCounterNameLength {
+		return fmt.Errorf("name must be at most %d characters", maxCounterNameLength)
+	}
+	if len(s.Labels) > maxLabelNum {
+		return fmt.Errorf("at most %d labels are allowed", maxLabelNum)
+	}
+	if s.Callback != nil {
+		// A counter with "to" 0 never completes
+		if s.To <= 0 {
+			return errors.New("callback requires positive to")
+		}
+		if err := s.Callback.Validate(); err != nil {
+			return err
+		}
+	}
+	for k, v := range s.Labels {
+		if k == "" {
+			return errors.New("label key must not be empty")
+		}
+		// "=" separates the key and value in the label selector
+		if strings.Contains(k, "=") {
+			return fmt.Errorf("label key %s must not contain \"=\"", k)
+		}
+		if len(k) > maxLabelKeyLength || len(v) > maxLabelValueLength {
+			return fmt.Errorf("label %s is too long", k)
+		}
+	}
+	return nil
 }
 
 // Initialize CounterCalculator.
@@ -36,19 +179,37 @@ func NewCounterCalculator(dao Dao) *CountCalculator {
 	c.dao = dao
 	c.generateUUID = func() string { return uuid.New().String() }
 	c.generateTimestamp = func() int64 { return time.Now().Unix() }
+	c.generateTimestampMillisecond = func() int64 { return time.Now().UnixNano() / int64(time.Millisecond) }
 	return c
 }
 
 // Generate a new counter
-func (c *CountCalculator) GenerateCounter(to int64) (string, error) {
+// The counter is added to the index of each label, so that it can be listed by labels.
+func (c *CountCalculator) GenerateCounter(ctx context.Context, spec CounterSpec) (string, error) {
 	id := c.generateUUID()
 	//id := uuid.New().String()
-	startTimestamp := c.generateTimestamp()
-	value, _ := daoValueFormatter(startTimestamp, to)
-	err := c.dao.Set(id, value, to)
+	startTimestamp := c.now(spec.Precision)
+	value, _ := daoValueFormatter(startTimestamp, spec)
+	err := c.setWithExpiration(ctx, id, value, spec.Precision, spec.To)
 	if err != nil {
 		return "", err
 	}
+	due := dueMillisecond(newDaoValue(startTimestamp, spec))
+	for _, key := range indexKeys(spec.Labels, spec.Owner) {
+		if err := c.dao.AddToSet(ctx, key, id); err != nil {
+			return "", err
+		}
+		if err := c.dao.AddToSortedSet(ctx, indexExpiryKey, indexExpiryMember(id, key), due); err != nil {
+			return "", err
+		}
+	}
+	if spec.Callback != nil {
+		if err := c.registerCallback(ctx, id, newDaoValue(startTimestamp, spec), *spec.Callback); err != nil {
+			// Don't leave the counter without its callback
+			c.rollback(id)
+			return "", err
+		}
+	}
 	return id, nil
 }
 
@@ -58,67 +219,443 @@ func (c *CountCalculator) GenerateCounter(to int64) (string, error) {
 // The architecture can let whole system immutable.
 // Note: I didn't implement the behavior when a counter comes to the expire date,
 // alternatively, Redis cares about it.
-func (c *CountCalculator) GetCounter(id string) (CounterResult, error) {
+func (c *CountCalculator) GetCounter(ctx context.Context, id string) (CounterResult, error) {
+	v, existence, err := c.getDaoValue(ctx, id)
+	if err != nil || !existence {
+		return CounterResult{}, err
+	}
+	return c.calculateCounter(v, c.now(v.Precision)), nil
+}
 
-	counterResult := CounterResult{}
+// Same as GetCounter, but for many counters with one read.
+func (c *CountCalculator) GetCounters(ctx context.Context, ids []string) (map[string]CounterResult, error) {
+	values, err := c.dao.GetBatch(ctx, counterIDs(ids))
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]CounterResult, len(ids))
+	for _, id := range ids {
+		value, ok := values[id]
+		if !ok || !isCounterValue(value) {
+			results[id] = CounterResult{}
+			continue
+		}
+		var v DaoValueFormat
+		_ = json.Unmarshal([]byte(value), &v)
+		results[id] = c.calculateCounter(v, c.now(v.Precision))
+	}
+	return results, nil
+}
 
-	// Check the counter with the given ID exists in DB
-	existence, errExists := c.dao.Exists(id)
+// Pause the counter with the given ID.
+// The counter stops increasing and never expires in DB until it is resumed.
+// Pausing a paused counter does nothing.
+func (c *CountCalculator) PauseCounter(ctx context.Context, id string) (CounterResult, error) {
+	v, existence, err := c.getDaoValue(ctx, id)
+	if err != nil || !existence {
+		return CounterResult{}, err
+	}
+	now := c.now(v.Precision)
+	counterResult := c.calculateCounter(v, now)
+	if !counterResult.counterExistence || v.PausedTimestamp != 0 {
+		return counterResult, nil
+	}
 
-	// If internal error occurs in DB, return error
-	if errExists != nil {
-		return counterResult, errExists
+	v.PausedTimestamp = now
+	// Expiration 0 lets the counter stay in DB while it is paused.
+	if err := c.setDaoValue(ctx, id, v, 0); err != nil {
+		return CounterResult{}, err
+	}
+	// The paused counter never completes, so its callback must not be fired.
+	if v.Callback {
+		if err := c.unscheduleCallback(ctx, id); err != nil {
+			return CounterResult{}, err
+		}
 	}
+	return c.calculateCounter(v, now), nil
+}
 
-	// Put the existence to the result
-	counterResult.counterExistence = convertIntToBool(existence)
+// Resume the paused counter with the given ID.
+// The paused time is added to the accumulated paused duration, and the expiration is set to the remaining time.
+// Resuming a running counter does nothing.
+func (c *CountCalculator) ResumeCounter(ctx context.Context, id string) (CounterResult, error) {
+	v, existence, err := c.getDaoValue(ctx, id)
+	if err != nil || !existence {
+		return CounterResult{}, err
+	}
+	now := c.now(v.Precision)
+	if v.PausedTimestamp == 0 {
+		return c.calculateCounter(v, now), nil
+	}
 
-	// Get the counter from DB if it exists.
-	if counterResult.counterExistence {
-		r, errGet := c.dao.Get(id)
-		if errGet != nil {
-			return counterResult, errGet
+	v.PausedDuration += now - v.PausedTimestamp
+	v.PausedTimestamp = 0
+	remaining := v.EndTimestamp + v.PausedDuration - now
+	// Expiration 0 means "never expire", so at least 1 second (or millisecond) is required.
+	if remaining < 1 {
+		remaining = 1
+	}
+	if err := c.setDaoValue(ctx, id, v, remaining); err != nil {
+		return CounterResult{}, err
+	}
+	if v.Callback {
+		if err := c.scheduleCallback(ctx, id, v); err != nil {
+			return CounterResult{}, err
 		}
-		var rFormatted DaoValueFormat
-		_ = json.Unmarshal([]byte(r), &rFormatted)
+	}
+	return c.calculateCounter(v, now), nil
+}
 
-		// Calculate counter
-		counterResult.Current = c.generateTimestamp() - rFormatted.StartTimestamp + 1
-		counterResult.To = rFormatted.EndTimestamp - rFormatted.StartTimestamp
+// List counter IDs with the index of the owner, or of the labels, or all of them if neither is given.
+// The cursor is only valid for the same owner and labels.
+func (c *CountCalculator) ListCounters(ctx context.Context, owner string, labels map[string]string, cursor uint64, limit int64) ([]string, uint64, error) {
+	switch {
+	case owner != "":
+		return c.listCounterIdByOwner(ctx, owner, labels, cursor, limit)
+	case len(labels) == 0:
+		return c.listAllCounterId(ctx, cursor, limit)
+	default:
+		return c.listCounterIdByLabels(ctx, labels, cursor, limit)
+	}
+}
 
-		// If a case which is something wrong as the following happens, return "the counter doesn't exist".
-		if counterResult.Current > counterResult.To {
-			counterResult.counterExistence = false
-			return counterResult, nil
+// List registered counter IDs page by page.
+// Pass the returned cursor to get the next page. The returned cursor 0 means there are no more pages.
+func (c *CountCalculator) listAllCounterId(ctx context.Context, cursor uint64, limit int64) ([]string, uint64, error) {
+	results, nextCursor, err := c.dao.ScanKeys(ctx, cursor, limit)
+	if err != nil {
+		return []string{}, 0, err
+	}
+	// Keep the response "[]" rather than "null" when there are no counters
+	if results == nil {
+		results = []string{}
+	}
+	return results, nextCursor, nil
+}
+
+// List counter IDs which have all the given labels page by page.
+// It iterates the index of one of the labels, and checks the other labels of each counter.
+// Counters which have already expired are removed from the index here, because Redis doesn't do it.
+func (c *CountCalculator) listCounterIdByLabels(ctx context.Context, labels map[string]string, cursor uint64, limit int64) ([]string, uint64, error) {
+	// Always use the same index for the same selector, because the cursor is only valid for it.
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return c.scanIndex(ctx, labelIndexKey(keys[0], labels[keys[0]]), labels, cursor, limit)
+}
+
+func (c *CountCalculator) listCounterIdByOwner(ctx context.Context, owner string, labels map[string]string, cursor uint64, limit int64) ([]string, uint64, error) {
+	return c.scanIndex(ctx, ownerIndexKey(owner), labels, cursor, limit)
+}
+
+// Return counter IDs in the index which have all the given labels.
+// IDs of expired counters are removed from the index on the way.
+func (c *CountCalculator) scanIndex(ctx context.Context, indexKey string, labels map[string]string, cursor uint64, limit int64) ([]string, uint64, error) {
+	ids, nextCursor, err := c.dao.ScanSet(ctx, indexKey, cursor, limit)
+	if err != nil {
+		return []string{}, 0, err
+	}
+
+	results := []string{}
+	for _, id := range ids {
+		v, existence, err := c.getDaoValue(ctx, id)
+		if err != nil {
+			return []string{}, 0, err
+		}
+		if !existence {
+			if err := c.dao.RemoveFromSet(ctx, indexKey, id); err != nil {
+				return []string{}, 0, err
+			}
+			continue
+		}
+		if hasLabels(v.Labels, labels) {
+			results = append(results, id)
 		}
 	}
+	return results, nextCursor, nil
+}
 
-	return counterResult, nil
+// Delete the counter with the given ID, and return the counter just before it's deleted.
+// The result doesn't exist if there was no such counter.
+func (c *CountCalculator) DeleteCounter(ctx context.Context, id string) (CounterResult, error) {
+	v, existence, err := c.getDaoValue(ctx, id)
+	// Nothing is deleted unless the key holds a counter
+	if err != nil || !existence {
+		return CounterResult{}, err
+	}
+	if err := c.dao.Del(ctx, id); err != nil {
+		return CounterResult{}, err
+	}
+	for _, key := range indexKeys(v.Labels, v.Owner) {
+		if err := c.dao.RemoveFromSet(ctx, key, id); err != nil {
+			return CounterResult{}, err
+		}
+		if err := c.dao.RemoveFromSortedSet(ctx, indexExpiryKey, indexExpiryMember(id, key)); err != nil {
+			return CounterResult{}, err
+		}
+	}
+	// The stopped counter never completes
+	if v.Callback {
+		if err := c.cancelCallback(ctx, id); err != nil {
+			return CounterResult{}, err
+		}
+	}
+	return c.calculateCounter(v, c.now(v.Precision)), nil
+}
+
+// Generate the counters with all writes pipelined.
+// If it fails on the way, the counters written so far are deleted.
+func (c *CountCalculator) GenerateCounters(ctx context.Context, specs []CounterSpec) ([]string, error) {
+	ids := make([]string, len(specs))
+	b := c.dao.Batch(ctx)
+	for i, spec := range specs {
+		id := c.generateUUID()
+		v := newDaoValue(c.now(spec.Precision), spec)
+		value, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		if spec.Precision == PrecisionMillisecond {
+			b.PSet(id, string(value), spec.To)
+		} else {
+			b.Set(id, string(value), spec.To)
+		}
+		for _, key := range indexKeys(spec.Labels, spec.Owner) {
+			b.AddToSet(key, id)
+			b.AddToSortedSet(indexExpiryKey, indexExpiryMember(id, key), dueMillisecond(v))
+		}
+		if spec.Callback != nil {
+			if err := queueCallback(b, id, v, *spec.Callback); err != nil {
+				return nil, err
+			}
+		}
+		ids[i] = id
+	}
+	if err := b.Exec(); err != nil {
+		c.rollback(ids...)
+		return nil, err
+	}
+	return ids, nil
 }
 
-// List all registered counter IDs
-func (c *CountCalculator) ListAllCounterId() ([]string, error) {
-	results, err := c.dao.GetAllKeys()
+// Delete the counters which failed to be generated.
+// It has its own timeout, because the writes may have reached DB even if the request has timed out.
+func (c *CountCalculator) rollback(ids ...string) {
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+	if _, err := c.DeleteCounters(ctx, ids, ""); err != nil {
+		logrus.WithError(err).Errorf("failed to roll back the counters %v", ids)
+	}
+}
+
+// Delete the counters with one read and one pipelined write.
+func (c *CountCalculator) DeleteCounters(ctx context.Context, ids []string, owner string) ([]bool, error) {
+	values, err := c.dao.GetBatch(ctx, counterIDs(ids))
 	if err != nil {
-		return []string{}, err
+		return nil, err
 	}
-	return results, nil
+	existences := make([]bool, len(ids))
+	b := c.dao.Batch(ctx)
+	for i, id := range ids {
+		value, ok := values[id]
+		if !ok || !isCounterValue(value) {
+			continue
+		}
+		var v DaoValueFormat
+		_ = json.Unmarshal([]byte(value), &v)
+		if owner != "" && v.Owner != owner {
+			continue
+		}
+		existences[i] = true
+		b.Del(id)
+		for _, key := range indexKeys(v.Labels, v.Owner) {
+			b.RemoveFromSet(key, id)
+			b.RemoveFromSortedSet(indexExpiryKey, indexExpiryMember(id, key))
+		}
+		// The stopped counters never complete
+		if v.Callback {
+			b.RemoveFromSortedSet(callbackScheduleKey, id)
+			b.Del(callbackKey(id))
+		}
+	}
+	if err := b.Exec(); err != nil {
+		return nil, err
+	}
+	return existences, nil
+}
+
+// Check the connectivity to DB
+func (c *CountCalculator) Ping(ctx context.Context) error {
+	return c.dao.Ping(ctx)
+}
+
+// Get the value of the counter with the given ID from DB.
+// The second returned value is false if no such counter exists.
+func (c *CountCalculator) getDaoValue(ctx context.Context, id string) (DaoValueFormat, bool, error) {
+	var v DaoValueFormat
+	if !isCounterID(id) {
+		return v, false, nil
+	}
+
+	// Check the counter with the given ID exists in DB
+	existence, errExists := c.dao.Exists(ctx, id)
+
+	// If internal error occurs in DB, return error
+	if errExists != nil {
+		return v, false, errExists
+	}
+	if !convertIntToBool(existence) {
+		return v, false, nil
+	}
+
+	r, errGet := c.dao.Get(ctx, id)
+	if errGet != nil {
+		return v, false, errGet
+	}
+	if !isCounterValue(r) {
+		return v, false, nil
+	}
+	_ = json.Unmarshal([]byte(r), &v)
+	return v, true, nil
+}
+
+// Overwrite the value of the counter with the given ID in DB.
+// The expiration is in the precision of the counter.
+func (c *CountCalculator) setDaoValue(ctx context.Context, id string, v DaoValueFormat, expiration int64) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.setWithExpiration(ctx, id, string(value), v.Precision, expiration)
 }
 
-// Delete the counter with the given ID
-func (c *CountCalculator) DeleteCounter(id string) error {
-	err := c.dao.Del(id)
-	return err
+// Store the value with the expiration in the given precision.
+func (c *CountCalculator) setWithExpiration(ctx context.Context, id string, value string, precision string, expiration int64) error {
+	if precision == PrecisionMillisecond {
+		return c.dao.PSet(ctx, id, value, expiration)
+	}
+	return c.dao.Set(ctx, id, value, expiration)
+}
+
+// Return the current timestamp in the given precision.
+func (c *CountCalculator) now(precision string) int64 {
+	if precision == PrecisionMillisecond {
+		return c.generateTimestampMillisecond()
+	}
+	return c.generateTimestamp()
+}
+
+// Calculate the counter from the value in DB at the given time.
+// Paused time is excluded, so the counter doesn't increase while it is paused.
+func (c *CountCalculator) calculateCounter(v DaoValueFormat, now int64) CounterResult {
+	counterResult := CounterResult{
+		Mode:             v.Mode,
+		Precision:        v.Precision,
+		Name:             v.Name,
+		Labels:           v.Labels,
+		owner:            v.Owner,
+		counterExistence: true,
+	}
+	if v.PausedTimestamp != 0 {
+		now = v.PausedTimestamp
+		counterResult.Paused = true
+	}
+
+	// Calculate counter
+	counterResult.Current = now - v.StartTimestamp - v.PausedDuration + 1
+	counterResult.To = v.EndTimestamp - v.StartTimestamp
+
+	// If a case which is something wrong as the following happens, return "the counter doesn't exist".
+	if counterResult.Current > counterResult.To {
+		counterResult.counterExistence = false
+	}
+
+	// Count down the remaining seconds. It's "to" at first, and 1 in the last second.
+	if v.Mode == CounterModeCountDown {
+		counterResult.Current = counterResult.To - counterResult.Current + 1
+	}
+	return counterResult
 }
 
 // Formatter for the value in DB
-func daoValueFormatter(startTimestamp int64, to int64) (string, error) {
+func daoValueFormatter(startTimestamp int64, spec CounterSpec) (string, error) {
+	resultJson, err := json.Marshal(newDaoValue(startTimestamp, spec))
+	return string(resultJson), err
+}
+
+// Build the value in DB of the new counter
+func newDaoValue(startTimestamp int64, spec CounterSpec) DaoValueFormat {
 	result := DaoValueFormat{
 		StartTimestamp: startTimestamp,
-		EndTimestamp:   startTimestamp + to,
+		EndTimestamp:   startTimestamp + spec.To,
+		Name:           spec.Name,
+		Labels:         spec.Labels,
+		Callback:       spec.Callback != nil,
+		Owner:          spec.Owner,
 	}
-	resultJson, err := json.Marshal(result)
-	return string(resultJson), err
+	if spec.Mode == CounterModeCountDown {
+		result.Mode = CounterModeCountDown
+	}
+	if spec.Precision == PrecisionMillisecond {
+		result.Precision = PrecisionMillisecond
+	}
+	return result
+}
+
+// Key of the set of counter IDs which have the label
+func labelIndexKey(key string, value string) string {
+	return labelIndexKeyPrefix + key + "=" + value
+}
+
+func ownerIndexKey(owner string) string {
+	return ownerIndexKeyPrefix + owner
+}
+
+// Return the keys of the label and owner indexes which have the counter.
+func indexKeys(labels map[string]string, owner string) []string {
+	keys := make([]string, 0, len(labels)+1)
+	for k, v := range labels {
+		keys = append(keys, labelIndexKey(k, v))
+	}
+	if owner != "" {
+		keys = append(keys, ownerIndexKey(owner))
+	}
+	return keys
+}
+
+// Counter IDs are UUIDs, so they never have spaces.
+func indexExpiryMember(id string, indexKey string) string {
+	return id + " " + indexKey
+}
+
+// Return the counter ID and the index key of the member. The third returned value is false if it's malformed.
+func parseIndexExpiryMember(member string) (string, string, bool) {
+	parts := strings.SplitN(member, " ", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// Return when the counter reaches its target in milliseconds, if it's running.
+func dueMillisecond(v DaoValueFormat) int64 {
+	due := v.EndTimestamp + v.PausedDuration
+	if v.Precision != PrecisionMillisecond {
+		due *= 1000
+	}
+	return due
+}
+
+// Check labels contains all of the selector
+func hasLabels(labels map[string]string, selector map[string]string) bool {
+	for k, v := range selector {
+		if l, ok := labels[k]; !ok || l != v {
+			return false
+		}
+	}
+	return true
 }
 
 // Convert 0 or else -> false or true
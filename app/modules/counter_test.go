@@ -1,9 +1,11 @@
 package modules
 
 import (
+	"context"
 	"errors"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 
@@ -14,28 +16,80 @@ type storedData struct {
 }
 
 type DummyDao struct {
-	SetFunc func(key string, value string, expirationSecond int64) error
-	GetFunc func(key string) (string, error)
-	GetAllKeysFunc func() ([]string, error)
-	DelFunc func(key string) error
-	ExistsFunc func(key string) (int64, error)
+	SetFunc func(ctx context.Context, key string, value string, expirationSecond int64) error
+	PSetFunc func(ctx context.Context, key string, value string, expirationMillisecond int64) error
+	SetNXFunc func(ctx context.Context, key string, value string, expirationSecond int64) (bool, error)
+	GetFunc func(ctx context.Context, key string) (string, error)
+	ScanKeysFunc func(ctx context.Context, cursor uint64, count int64) ([]string, uint64, error)
+	DelFunc func(ctx context.Context, key string) error
+	ExistsFunc func(ctx context.Context, key string) (int64, error)
+	PingFunc func(ctx context.Context) error
+	CloseFunc func() error
+	AddToSetFunc func(ctx context.Context, key string, members ...string) error
+	RemoveFromSetFunc func(ctx context.Context, key string, members ...string) error
+	ScanSetFunc func(ctx context.Context, key string, cursor uint64, count int64) ([]string, uint64, error)
+	AddToSortedSetFunc func(ctx context.Context, key string, member string, score int64) error
+	RemoveFromSortedSetFunc func(ctx context.Context, key string, members ...string) error
+	ClaimFromSortedSetFunc func(ctx context.Context, key string, maxScore int64, newScore int64, count int64) ([]string, error)
+	TakeTokenFunc func(ctx context.Context, key string, capacity int64, periodMillisecond int64, count int64) (bool, float64, error)
+	BatchFunc func(ctx context.Context) DaoBatch
+	GetBatchFunc func(ctx context.Context, keys []string) (map[string]string, error)
 	storedData []storedData
 }
 
-func (d *DummyDao) Set(key string, value string, expirationSecond int64) error {
-	return d.SetFunc(key, value, expirationSecond)
+func (d *DummyDao) Set(ctx context.Context, key string, value string, expirationSecond int64) error {
+	return d.SetFunc(ctx, key, value, expirationSecond)
 }
-func (d *DummyDao) Get(key string) (string, error) {
-	return d.GetFunc(key)
+func (d *DummyDao) PSet(ctx context.Context, key string, value string, expirationMillisecond int64) error {
+	return d.PSetFunc(ctx, key, value, expirationMillisecond)
 }
-func (d *DummyDao) GetAllKeys() ([]string, error) {
-	return d.GetAllKeysFunc()
+func (d *DummyDao) SetNX(ctx context.Context, key string, value string, expirationSecond int64) (bool, error) {
+	return d.SetNXFunc(ctx, key, value, expirationSecond)
 }
-func (d *DummyDao) Del(key string) error {
-	return d.DelFunc(key)
+func (d *DummyDao) Get(ctx context.Context, key string) (string, error) {
+	return d.GetFunc(ctx, key)
 }
-func (d *DummyDao) Exists(key string) (int64, error) {
-	return d.ExistsFunc(key)
+func (d *DummyDao) ScanKeys(ctx context.Context, cursor uint64, count int64) ([]string, uint64, error) {
+	return d.ScanKeysFunc(ctx, cursor, count)
+}
+func (d *DummyDao) Del(ctx context.Context, key string) error {
+	return d.DelFunc(ctx, key)
+}
+func (d *DummyDao) Exists(ctx context.Context, key string) (int64, error) {
+	return d.ExistsFunc(ctx, key)
+}
+func (d *DummyDao) Ping(ctx context.Context) error {
+	return d.PingFunc(ctx)
+}
+func (d *DummyDao) Close() error {
+	return d.CloseFunc()
+}
+func (d *DummyDao) AddToSet(ctx context.Context, key string, members ...string) error {
+	return d.AddToSetFunc(ctx, key, members...)
+}
+func (d *DummyDao) RemoveFromSet(ctx context.Context, key string, members ...string) error {
+	return d.RemoveFromSetFunc(ctx, key, members...)
+}
+func (d *DummyDao) ScanSet(ctx context.Context, key string, cursor uint64, count int64) ([]string, uint64, error) {
+	return d.ScanSetFunc(ctx, key, cursor, count)
+}
+func (d *DummyDao) AddToSortedSet(ctx context.Context, key string, member string, score int64) error {
+	return d.AddToSortedSetFunc(ctx, key, member, score)
+}
+func (d *DummyDao) RemoveFromSortedSet(ctx context.Context, key string, members ...string) error {
+	return d.RemoveFromSortedSetFunc(ctx, key, members...)
+}
+func (d *DummyDao) ClaimFromSortedSet(ctx context.Context, key string, maxScore int64, newScore int64, count int64) ([]string, error) {
+	return d.ClaimFromSortedSetFunc(ctx, key, maxScore, newScore, count)
+}
+func (d *DummyDao) Batch(ctx context.Context) DaoBatch {
+	return d.BatchFunc(ctx)
+}
+func (d *DummyDao) GetBatch(ctx context.Context, keys []string) (map[string]string, error) {
+	return d.GetBatchFunc(ctx, keys)
+}
+func (d *DummyDao) TakeToken(ctx context.Context, key string, capacity int64, periodMillisecond int64, count int64) (bool, float64, error) {
+	return d.TakeTokenFunc(ctx, key, capacity, periodMillisecond, count)
 }
 
 func TestCountCalculator_GenerateCounter(t *testing.T) {
@@ -68,7 +122,7 @@ func TestCountCalculator_GenerateCounter(t *testing.T) {
 	d := &DummyDao{}
 
 	for _, i := range cases {
-		d.SetFunc = func(key string, value string, expirationSecond int64) error {
+		d.SetFunc = func(ctx context.Context, key string, value string, expirationSecond int64) error {
 			d.storedData = append(d.storedData, storedData{
 				key:              key,
 				value:            value,
@@ -79,7 +133,7 @@ func TestCountCalculator_GenerateCounter(t *testing.T) {
 		c := NewCounterCalculator(d)
 		c.generateUUID = func() string {return i.id}
 		c.generateTimestamp = func() int64 {return i.startTime}
-		id, err := c.GenerateCounter(i.duration)
+		id, err := c.GenerateCounter(context.Background(), CounterSpec{To: i.duration})
 
 		assert.Equal(t, i.expectedError, err)
 		assert.Equal(t, i.id, id)
@@ -170,12 +224,12 @@ func TestCountCalculator_GetCounter(t *testing.T) {
 
 	for _, i := range cases {
 		d := &DummyDao{
-			GetFunc: func(key string) (s string, err error) {
+			GetFunc: func(ctx context.Context, key string) (s string, err error) {
 				s = i.valueInDBCorrespondingToID
 				err = i.daoInternalError
 				return
 			},
-			ExistsFunc: func(key string) (result int64, err error) {
+			ExistsFunc: func(ctx context.Context, key string) (result int64, err error) {
 				result = i.counterExistenceInDB
 				err = i.daoInternalError
 				return
@@ -183,9 +237,317 @@ func TestCountCalculator_GetCounter(t *testing.T) {
 		}
 		c := NewCounterCalculator(d)
 		c.generateTimestamp = func() int64 {return i.currentTime}
-		r, err := c.GetCounter(i.id)
+		r, err := c.GetCounter(context.Background(), i.id)
 
 		assert.Equal(t, i.expectedResult, r)
 		assert.Equal(t, i.expectedError, err)
 	}
-}
\ No newline at end of file
+}
+
+func TestCountCalculator_PauseAndResumeCounter(t *testing.T) {
+	stored := "{\"start_timestamp\":1591115560,\"end_timestamp\":1591115570}" // end_timestamp = start_timestamp + 10
+	var expirations []int64
+	d := &DummyDao{
+		GetFunc: func(ctx context.Context, key string) (string, error) {
+			return stored, nil
+		},
+		ExistsFunc: func(ctx context.Context, key string) (int64, error) {
+			return 1, nil
+		},
+		SetFunc: func(ctx context.Context, key string, value string, expirationSecond int64) error {
+			stored = value
+			expirations = append(expirations, expirationSecond)
+			return nil
+		},
+	}
+	c := NewCounterCalculator(d)
+
+	// Pause at start_timestamp + 2
+	c.generateTimestamp = func() int64 { return 1591115562 }
+	r, err := c.PauseCounter(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	assert.Nil(t, err)
+	assert.Equal(t, CounterResult{Current: 3, To: 10, Paused: true, counterExistence: true}, r)
+	assert.Equal(t, []int64{0}, expirations) // The counter must not expire while it is paused.
+
+	// Pausing again does nothing
+	_, _ = c.PauseCounter(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	assert.Equal(t, []int64{0}, expirations)
+
+	// The counter doesn't increase while it is paused, even after its original end_timestamp.
+	c.generateTimestamp = func() int64 { return 1591115600 }
+	r, _ = c.GetCounter(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	assert.Equal(t, CounterResult{Current: 3, To: 10, Paused: true, counterExistence: true}, r)
+
+	// Resume. The counter has been paused for 38 seconds, so it expires 8 seconds later.
+	r, err = c.ResumeCounter(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	assert.Nil(t, err)
+	assert.Equal(t, CounterResult{Current: 3, To: 10, counterExistence: true}, r)
+	assert.Equal(t, []int64{0, 8}, expirations)
+	assert.Equal(t, "{\"start_timestamp\":1591115560,\"end_timestamp\":1591115570,\"paused_duration\":38}", stored)
+
+	c.generateTimestamp = func() int64 { return 1591115607 }
+	r, _ = c.GetCounter(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	assert.Equal(t, CounterResult{Current: 10, To: 10, counterExistence: true}, r)
+}
+
+func TestCountCalculator_DeleteCounter(t *testing.T) {
+	stored := map[string]string{"9dd29757-ed4e-488f-b62c-b8cececbac29": "{\"start_timestamp\":1591115560,\"end_timestamp\":1591115570}"}
+	d := &DummyDao{
+		GetFunc: func(ctx context.Context, key string) (string, error) {
+			return stored[key], nil
+		},
+		ExistsFunc: func(ctx context.Context, key string) (int64, error) {
+			if _, ok := stored[key]; ok {
+				return 1, nil
+			}
+			return 0, nil
+		},
+		DelFunc: func(ctx context.Context, key string) error {
+			delete(stored, key)
+			return nil
+		},
+	}
+	c := NewCounterCalculator(d)
+	c.generateTimestamp = func() int64 { return 1591115562 }
+
+	// It returns the counter just before it's deleted
+	r, err := c.DeleteCounter(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	assert.Nil(t, err)
+	assert.Equal(t, CounterResult{Current: 3, To: 10, counterExistence: true}, r)
+	assert.Empty(t, stored)
+
+	r, err = c.DeleteCounter(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	assert.Nil(t, err)
+	assert.False(t, r.counterExistence)
+}
+
+func TestCountCalculator_Labels(t *testing.T) {
+	m := newMemoryStore(time.Now)
+	c := NewCounterCalculator(m)
+	ids := []string{"1a0ca312-558f-4a13-987f-ba86930ec9ef", "3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e", "9dd29757-ed4e-488f-b62c-b8cececbac29"}
+	n := 0
+	c.generateUUID = func() string {
+		n++
+		return ids[n-1]
+	}
+	_, _ = c.GenerateCounter(context.Background(), CounterSpec{To: 1000, Name: "deploy", Labels: map[string]string{"team": "payments", "env": "prod"}})
+	_, _ = c.GenerateCounter(context.Background(), CounterSpec{To: 1000, Labels: map[string]string{"team": "payments", "env": "dev"}})
+	_, _ = c.GenerateCounter(context.Background(), CounterSpec{To: 1000, Labels: map[string]string{"team": "search"}})
+
+	r, _ := c.GetCounter(context.Background(), ids[0])
+	assert.Equal(t, "deploy", r.Name)
+	assert.Equal(t, map[string]string{"team": "payments", "env": "prod"}, r.Labels)
+
+	found, next, _ := c.ListCounters(context.Background(), "", map[string]string{"team": "payments"}, 0, 100)
+	assert.Equal(t, ids[:2], found)
+	assert.Equal(t, uint64(0), next)
+	found, _, _ = c.ListCounters(context.Background(), "", map[string]string{"team": "payments", "env": "prod"}, 0, 100)
+	assert.Equal(t, ids[:1], found)
+
+	// Counter IDs are removed from the index when they are deleted.
+	_, _ = c.DeleteCounter(context.Background(), ids[0])
+	members, _, _ := m.ScanSet(context.Background(), "label:team=payments", 0, 100)
+	assert.Equal(t, ids[1:2], members)
+
+	// Counter IDs which have expired are removed from the index when they are listed.
+	_ = m.Del(context.Background(), ids[1])
+	found, _, _ = c.ListCounters(context.Background(), "", map[string]string{"team": "payments"}, 0, 100)
+	assert.Equal(t, []string{}, found)
+	members, _, _ = m.ScanSet(context.Background(), "label:team=payments", 0, 100)
+	assert.Equal(t, []string{}, members)
+
+	// Index keys are not listed as counters
+	all, _, _ := c.ListCounters(context.Background(), "", nil, 0, 100)
+	assert.Equal(t, ids[2:], all)
+}
+
+// With owner, only the counters of the owner are listed, even without labels
+func TestCountCalculator_ListCountersByOwner(t *testing.T) {
+	c := NewCounterCalculator(newMemoryStore(time.Now))
+	ids := []string{"1a0ca312-558f-4a13-987f-ba86930ec9ef", "3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e", "9dd29757-ed4e-488f-b62c-b8cececbac29"}
+	n := 0
+	c.generateUUID = func() string {
+		n++
+		return ids[n-1]
+	}
+	_, _ = c.GenerateCounter(context.Background(), CounterSpec{To: 1000, Owner: "a", Labels: map[string]string{"team": "payments"}})
+	_, _ = c.GenerateCounter(context.Background(), CounterSpec{To: 1000, Owner: "a"})
+	_, _ = c.GenerateCounter(context.Background(), CounterSpec{To: 1000, Owner: "b", Labels: map[string]string{"team": "payments"}})
+
+	tests := []struct {
+		owner    string
+		labels   map[string]string
+		expected []string
+	}{
+		{"a", nil, ids[:2]},
+		{"a", map[string]string{"team": "payments"}, ids[:1]},
+		{"b", nil, ids[2:]},
+		{"", map[string]string{"team": "payments"}, []string{ids[0], ids[2]}},
+		{"", nil, ids},
+	}
+	for _, tt := range tests {
+		found, _, err := c.ListCounters(context.Background(), tt.owner, tt.labels, 0, 100)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expected, found, tt.owner)
+	}
+}
+
+// One read for all counters, and the results are the same as GetCounter
+func TestCountCalculator_GetCounters(t *testing.T) {
+	c := NewCounterCalculator(newMemoryStore(time.Now))
+	c.generateUUID = func() string { return "9dd29757-ed4e-488f-b62c-b8cececbac29" }
+	c.generateTimestamp = func() int64 { return 1591115560 }
+	_, _ = c.GenerateCounter(context.Background(), CounterSpec{To: 1000, Owner: "a"})
+	c.generateTimestamp = func() int64 { return 1591115569 }
+
+	results, err := c.GetCounters(context.Background(), []string{"9dd29757-ed4e-488f-b62c-b8cececbac29", "1a0ca312-558f-4a13-987f-ba86930ec9ef"})
+	assert.NoError(t, err)
+	expected, _ := c.GetCounter(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	assert.Equal(t, map[string]CounterResult{
+		"9dd29757-ed4e-488f-b62c-b8cececbac29": expected,
+		"1a0ca312-558f-4a13-987f-ba86930ec9ef": {},
+	}, results)
+	assert.Equal(t, int64(10), expected.Current)
+}
+
+// Keys which are not counters are never deleted as counters
+func TestCountCalculator_DeleteNonCounter(t *testing.T) {
+	m := newMemoryStore(time.Now)
+	c := NewCounterCalculator(m)
+	_ = m.Set(context.Background(), "ratelimit:create:ip=1.2.3.4", "0 1591115560000", 0)
+	// A UUID key of another application
+	_ = m.Set(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29", "{\"user\":\"alice\"}", 0)
+
+	for _, id := range []string{"ratelimit:create:ip=1.2.3.4", "9dd29757-ed4e-488f-b62c-b8cececbac29"} {
+		r, err := c.DeleteCounter(context.Background(), id)
+		assert.NoError(t, err)
+		assert.False(t, r.counterExistence, id)
+		existences, err := c.DeleteCounters(context.Background(), []string{id}, "")
+		assert.NoError(t, err)
+		assert.Equal(t, []bool{false}, existences, id)
+		_, err = m.Get(context.Background(), id)
+		assert.NoError(t, err, id)
+	}
+}
+
+// timedOutDao applies the writes, but fails like DB which responds after the deadline of the request.
+type timedOutDao struct {
+	*MemoryStore
+}
+
+func (d timedOutDao) GetBatch(ctx context.Context, keys []string) (map[string]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return d.MemoryStore.GetBatch(ctx, keys)
+}
+
+func (d timedOutDao) Batch(ctx context.Context) DaoBatch {
+	return timedOutBatch{DaoBatch: d.MemoryStore.Batch(ctx), ctx: ctx}
+}
+
+type timedOutBatch struct {
+	DaoBatch
+	ctx context.Context
+}
+
+func (b timedOutBatch) Exec() error {
+	err := b.DaoBatch.Exec()
+	if b.ctx.Err() != nil {
+		return b.ctx.Err()
+	}
+	return err
+}
+
+// The counters are rolled back even if the request has timed out
+func TestCountCalculator_GenerateCountersRollback(t *testing.T) {
+	m := newMemoryStore(time.Now)
+	c := NewCounterCalculator(timedOutDao{m})
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	ids, err := c.GenerateCounters(ctx, []CounterSpec{
+		{To: 1000, Labels: map[string]string{"team": "payments"}, Owner: "key"},
+		{To: 1000, Callback: &Callback{URL: "https://example.com/hook"}},
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Nil(t, ids)
+	assert.Empty(t, m.entries)
+	assert.Empty(t, m.sets)
+	assert.Empty(t, m.sortedSets)
+}
+
+func TestCountCalculator_CountDown(t *testing.T) {
+	m := newMemoryStore(time.Now)
+	c := NewCounterCalculator(m)
+	c.generateUUID = func() string { return "9dd29757-ed4e-488f-b62c-b8cececbac29" }
+	c.generateTimestamp = func() int64 { return 1591115560 }
+	_, _ = c.GenerateCounter(context.Background(), CounterSpec{To: 10, Mode: CounterModeCountDown})
+
+	type testCase struct {
+		currentTime    int64
+		expectedResult CounterResult
+	}
+	var cases = []testCase{
+		{
+			int64(1591115560), // It equals to start_timestamp
+			CounterResult{Current: 10, To: 10, Mode: CounterModeCountDown, counterExistence: true},
+		},
+		{
+			int64(1591115569), // The last second
+			CounterResult{Current: 1, To: 10, Mode: CounterModeCountDown, counterExistence: true},
+		},
+		{
+			int64(1591115570), // It equals to end_timestamp. Redis should have deleted the counter.
+			CounterResult{Current: 0, To: 10, Mode: CounterModeCountDown, counterExistence: false},
+		},
+	}
+
+	for _, i := range cases {
+		c.generateTimestamp = func() int64 { return i.currentTime }
+		r, err := c.GetCounter(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29")
+		assert.Nil(t, err)
+		assert.Equal(t, i.expectedResult, r)
+	}
+
+	// Pausing freezes the remaining seconds as well
+	c.generateTimestamp = func() int64 { return 1591115563 }
+	r, _ := c.PauseCounter(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	assert.Equal(t, CounterResult{Current: 7, To: 10, Paused: true, Mode: CounterModeCountDown, counterExistence: true}, r)
+}
+
+func TestCountCalculator_MillisecondPrecision(t *testing.T) {
+	stored := ""
+	var expirations []int64
+	d := &DummyDao{
+		PSetFunc: func(ctx context.Context, key string, value string, expirationMillisecond int64) error {
+			stored = value
+			expirations = append(expirations, expirationMillisecond)
+			return nil
+		},
+		GetFunc: func(ctx context.Context, key string) (string, error) {
+			return stored, nil
+		},
+		ExistsFunc: func(ctx context.Context, key string) (int64, error) {
+			return 1, nil
+		},
+	}
+	c := NewCounterCalculator(d)
+	c.generateUUID = func() string { return "9dd29757-ed4e-488f-b62c-b8cececbac29" }
+	c.generateTimestampMillisecond = func() int64 { return 1591115560123 }
+	_, err := c.GenerateCounter(context.Background(), CounterSpec{To: 1500, Precision: PrecisionMillisecond})
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"start_timestamp\":1591115560123,\"end_timestamp\":1591115561623,\"precision\":\"ms\"}", stored)
+	assert.Equal(t, []int64{1500}, expirations) // expires in 1.5 seconds
+
+	c.generateTimestampMillisecond = func() int64 { return 1591115561000 }
+	r, _ := c.GetCounter(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	assert.Equal(t, CounterResult{Current: 878, To: 1500, Precision: PrecisionMillisecond, counterExistence: true}, r)
+
+	// Pause and resume 200 milliseconds later
+	_, _ = c.PauseCounter(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	c.generateTimestampMillisecond = func() int64 { return 1591115561200 }
+	r, _ = c.ResumeCounter(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	assert.Equal(t, CounterResult{Current: 878, To: 1500, Precision: PrecisionMillisecond, counterExistence: true}, r)
+	assert.Equal(t, []int64{1500, 0, 623}, expirations)
+}
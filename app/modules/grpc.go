@@ -0,0 +1,406 @@
+package modules
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"counterapi/pb"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCServer serves the counter API over gRPC, backed by the same Counter as Controller.
+type GRPCServer struct {
+	counter           Counter
+	listenPort        string
+	apiKeys           *APIKeyStore
+	rateLimiter       *RateLimiter
+	metrics           *Metrics
+	server            *grpc.Server
+	watchTickInterval time.Duration
+	requestTimeout    time.Duration
+	// Closed on shutdown to end WatchCounter streams, which GracefulStop would wait for forever
+	stopping     chan struct{}
+	stoppingOnce sync.Once
+}
+
+// Initialize GRPCServer. With apiKeys, RPCs require API keys in the "x-api-key" metadata like Controller.
+// With rateLimiter, RPCs take tokens from the same buckets as the HTTP requests of the client.
+// Every DB call times out after requestTimeout, or the deadline of the client if it's sooner. 0 means no timeout.
+func NewGRPCServer(counter Counter, listenPort string, apiKeys *APIKeyStore, rateLimiter *RateLimiter, metrics *Metrics, requestTimeout time.Duration) *GRPCServer {
+	g := &GRPCServer{
+		counter:           counter,
+		listenPort:        listenPort,
+		apiKeys:           apiKeys,
+		rateLimiter:       rateLimiter,
+		metrics:           metrics,
+		watchTickInterval: defaultStreamTickInterval,
+		requestTimeout:    requestTimeout,
+		stopping:          make(chan struct{}),
+	}
+	g.server = grpc.NewServer(
+		grpc.ChainUnaryInterceptor(grpcUnaryLoggingInterceptor, g.unaryAPIKeyInterceptor, g.unaryRateLimitInterceptor),
+		grpc.ChainStreamInterceptor(grpcStreamLoggingInterceptor, g.streamAPIKeyInterceptor, g.streamRateLimitInterceptor),
+	)
+	pb.RegisterCounterServiceServer(g.server, g)
+	return g
+}
+
+// Listen on the port and serve in the background.
+func (g *GRPCServer) Start() error {
+	listener, err := net.Listen("tcp", ":"+g.listenPort)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := g.server.Serve(listener); err != nil {
+			logrus.WithError(err).Error("gRPC server stopped")
+		}
+	}()
+	return nil
+}
+
+// Stop accepting RPCs and wait for in-flight ones until the timeout.
+func (g *GRPCServer) Stop(timeout time.Duration) {
+	g.stoppingOnce.Do(func() {
+		close(g.stopping)
+	})
+	stopped := make(chan struct{})
+	go func() {
+		g.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		g.server.Stop()
+	}
+}
+
+func (g *GRPCServer) CreateCounter(ctx context.Context, req *pb.CreateCounterRequest) (*pb.CreateCounterResponse, error) {
+	spec := CounterSpec{
+		To:        req.To,
+		Mode:      req.Mode,
+		Precision: req.Precision,
+		Name:      req.Name,
+		Labels:    req.Labels,
+		Owner:     grpcOwner(ctx),
+	}
+	if req.Callback != nil {
+		// The payload has to be JSON as it's embedded in the callback body
+		if len(req.Callback.Payload) > 0 && !json.Valid(req.Callback.Payload) {
+			return nil, status.Error(codes.InvalidArgument, "callback payload must be JSON")
+		}
+		spec.Callback = &Callback{URL: req.Callback.Url, Payload: req.Callback.Payload}
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	callCtx, cancel := withTimeout(ctx, g.requestTimeout)
+	defer cancel()
+	id, err := g.counter.GenerateCounter(callCtx, spec)
+	if err != nil {
+		return nil, grpcInternalError(ctx, err)
+	}
+	g.metrics.countersCreated.Inc()
+	return &pb.CreateCounterResponse{Id: id}, nil
+}
+
+func (g *GRPCServer) GetCounter(ctx context.Context, req *pb.GetCounterRequest) (*pb.Counter, error) {
+	r, err := g.getExistingCounter(ctx, req.Id)
+	if err != nil {
+		return nil, err
+	}
+	return toPbCounter(req.Id, r), nil
+}
+
+func (g *GRPCServer) ListCounters(ctx context.Context, req *pb.ListCountersRequest) (*pb.ListCountersResponse, error) {
+	cursor := uint64(0)
+	if req.Cursor != "" {
+		parsed, err := strconv.ParseUint(req.Cursor, 10, 64)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "the cursor %s is invalid", req.Cursor)
+		}
+		cursor = parsed
+	}
+	limit := req.Limit
+	switch {
+	case limit < 0:
+		return nil, status.Errorf(codes.InvalidArgument, "the limit %d is invalid", limit)
+	case limit == 0:
+		limit = defaultListLimit
+	case limit > maxListLimit:
+		limit = maxListLimit
+	}
+
+	callCtx, cancel := withTimeout(ctx, g.requestTimeout)
+	defer cancel()
+	ids, nextCursor, err := g.counter.ListCounters(callCtx, grpcOwner(ctx), req.Labels, cursor, limit)
+	if err != nil {
+		return nil, grpcInternalError(ctx, err)
+	}
+
+	res := &pb.ListCountersResponse{Ids: ids}
+	if nextCursor != 0 {
+		res.NextCursor = strconv.FormatUint(nextCursor, 10)
+	}
+	return res, nil
+}
+
+func (g *GRPCServer) DeleteCounter(ctx context.Context, req *pb.DeleteCounterRequest) (*pb.DeleteCounterResponse, error) {
+	if _, err := g.getExistingCounter(ctx, req.Id); err != nil {
+		return nil, err
+	}
+	callCtx, cancel := withTimeout(ctx, g.requestTimeout)
+	defer cancel()
+	if _, err := g.counter.DeleteCounter(callCtx, req.Id); err != nil {
+		return nil, grpcInternalError(ctx, err)
+	}
+	g.metrics.countersStopped.Inc()
+	return &pb.DeleteCounterResponse{}, nil
+}
+
+// Send the counter every tick, and finally COMPLETED or STOPPED when the counter disappears.
+func (g *GRPCServer) WatchCounter(req *pb.WatchCounterRequest, stream pb.CounterService_WatchCounterServer) error {
+	ctx := stream.Context()
+	r, err := g.getExistingCounter(ctx, req.Id)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(g.watchTickInterval)
+	defer ticker.Stop()
+	for {
+		if err := stream.Send(&pb.WatchCounterResponse{Event: pb.WatchCounterResponse_TICK, Counter: toPbCounter(req.Id, r)}); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-g.stopping:
+			// Let the client reconnect to another replica rather than holding up the shutdown
+			return status.Error(codes.Unavailable, "server is shutting down")
+		case <-ticker.C:
+		}
+
+		last := r
+		// Every tick has its own timeout, as the stream lasts longer than the request timeout
+		callCtx, cancel := withTimeout(ctx, g.requestTimeout)
+		r, err = g.counter.GetCounter(callCtx, req.Id)
+		cancel()
+		if err != nil {
+			return grpcInternalError(ctx, err)
+		}
+		if !r.counterExistence {
+			event := pb.WatchCounterResponse_STOPPED
+			if hasCompleted(last, g.watchTickInterval) {
+				event = pb.WatchCounterResponse_COMPLETED
+			}
+			return stream.Send(&pb.WatchCounterResponse{Event: event})
+		}
+	}
+}
+
+// Return the counter, or NOT_FOUND if it doesn't exist or belongs to another API key.
+// IDs which can't be counters never reach DB.
+func (g *GRPCServer) getExistingCounter(ctx context.Context, id string) (CounterResult, error) {
+	if !isCounterID(id) {
+		g.metrics.countersNotFound.Inc()
+		return CounterResult{}, status.Errorf(codes.NotFound, "no such counter with %s", id)
+	}
+	callCtx, cancel := withTimeout(ctx, g.requestTimeout)
+	defer cancel()
+	r, err := g.counter.GetCounter(callCtx, id)
+	if err != nil {
+		return r, grpcInternalError(ctx, err)
+	}
+	if !r.counterExistence || (g.apiKeys != nil && r.owner != grpcOwner(ctx)) {
+		g.metrics.countersNotFound.Inc()
+		return r, status.Errorf(codes.NotFound, "no such counter with %s", id)
+	}
+	return r, nil
+}
+
+func toPbCounter(id string, r CounterResult) *pb.Counter {
+	return &pb.Counter{
+		Id:        id,
+		Current:   r.Current,
+		To:        r.To,
+		Paused:    r.Paused,
+		Mode:      r.Mode,
+		Precision: r.Precision,
+		Name:      r.Name,
+		Labels:    r.Labels,
+	}
+}
+
+// Log the error with the RPC, and hide its detail from the client.
+// It's UNAVAILABLE if DB didn't respond in time, so that clients can retry it.
+func grpcInternalError(ctx context.Context, err error) error {
+	logrus.WithError(err).WithField("method", grpcMethod(ctx)).Error("gRPC request failed")
+	if isTimeout(err) {
+		return status.Error(codes.Unavailable, "DB didn't respond in time")
+	}
+	return status.Error(codes.Internal, "internal error")
+}
+
+func grpcMethod(ctx context.Context) string {
+	if method, ok := grpc.Method(ctx); ok {
+		return method
+	}
+	return ""
+}
+
+type grpcOwnerKey struct{}
+
+// Return the ID of the API key of the RPC. Empty if API keys are disabled.
+func grpcOwner(ctx context.Context) string {
+	owner, _ := ctx.Value(grpcOwnerKey{}).(string)
+	return owner
+}
+
+// Return the context with the owner, or UNAUTHENTICATED if the "x-api-key" metadata is missing or invalid.
+func (g *GRPCServer) authenticate(ctx context.Context) (context.Context, error) {
+	if g.apiKeys == nil {
+		return ctx, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	keys := md.Get(apiKeyHeader)
+	if len(keys) == 0 || keys[0] == "" {
+		return ctx, status.Error(codes.Unauthenticated, "x-api-key metadata is required")
+	}
+	callCtx, cancel := withTimeout(ctx, g.requestTimeout)
+	defer cancel()
+	k, ok, err := g.apiKeys.Authenticate(callCtx, keys[0])
+	if err != nil {
+		return ctx, grpcInternalError(ctx, err)
+	}
+	if !ok {
+		return ctx, status.Error(codes.Unauthenticated, "the API key is invalid")
+	}
+	return context.WithValue(ctx, grpcOwnerKey{}, k.ID), nil
+}
+
+func (g *GRPCServer) unaryAPIKeyInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := g.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (g *GRPCServer) streamAPIKeyInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := g.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedServerStream{ServerStream: ss, ctx: ctx})
+}
+
+// authenticatedServerStream carries the context with the owner to the handler.
+type authenticatedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// CreateCounter is limited separately from the other RPCs, like "POST /counter"
+const grpcCreateCounterMethod string = "/counterapi.CounterService/CreateCounter"
+
+// Return RESOURCE_EXHAUSTED with the "retry-after" metadata if the client has run out of its limit.
+// RPCs are let through if DB fails, like the HTTP requests.
+func (g *GRPCServer) takeRateLimit(ctx context.Context, fullMethod string) (metadata.MD, error) {
+	if g.rateLimiter == nil {
+		return nil, nil
+	}
+	scope := rateLimitScopeRead
+	if fullMethod == grpcCreateCounterMethod {
+		scope = rateLimitScopeCreate
+	}
+	callCtx, cancel := withTimeout(ctx, g.requestTimeout)
+	defer cancel()
+	r, limited, err := g.rateLimiter.Take(callCtx, scope, grpcRateLimitClient(ctx), 1)
+	if err != nil {
+		logrus.WithError(err).WithField("method", fullMethod).Error("gRPC request failed")
+		return nil, nil
+	}
+	if !limited || r.Allowed {
+		return nil, nil
+	}
+	g.metrics.rateLimited.WithLabelValues(scope).Inc()
+	retryAfter := ceilSeconds(r.RetryAfter)
+	md := metadata.Pairs(strings.ToLower(retryAfterHeader), strconv.FormatInt(retryAfter, 10))
+	return md, status.Errorf(codes.ResourceExhausted, "too many requests, retry after %d seconds", retryAfter)
+}
+
+// Clients are identified by their API keys, or by their IP addresses if API keys are disabled, like Controller.
+func grpcRateLimitClient(ctx context.Context) string {
+	if owner := grpcOwner(ctx); owner != "" {
+		return "key=" + owner
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "ip="
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return "ip=" + p.Addr.String()
+	}
+	return "ip=" + host
+}
+
+func (g *GRPCServer) unaryRateLimitInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, err := g.takeRateLimit(ctx, info.FullMethod)
+	if err != nil {
+		_ = grpc.SetHeader(ctx, md)
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (g *GRPCServer) streamRateLimitInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	md, err := g.takeRateLimit(ss.Context(), info.FullMethod)
+	if err != nil {
+		_ = ss.SetHeader(md)
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// Log every RPC like the HTTP requests.
+func grpcUnaryLoggingInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	res, err := handler(ctx, req)
+	logGRPCRequest(info.FullMethod, start, err)
+	return res, err
+}
+
+func grpcStreamLoggingInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	logGRPCRequest(info.FullMethod, start, err)
+	return err
+}
+
+func logGRPCRequest(method string, start time.Time, err error) {
+	logrus.WithFields(logrus.Fields{
+		"method":     method,
+		"code":       status.Code(err).String(),
+		"latency_ms": float64(time.Since(start).Microseconds()) / 1000,
+	}).Info("grpc request")
+}
@@ -0,0 +1,249 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"counterapi/pb"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Serve the GRPCServer in memory and return the client
+func newTestGRPCClient(t *testing.T, g *GRPCServer) (pb.CounterServiceClient, func()) {
+	listener := bufconn.Listen(1024 * 1024)
+	go func() {
+		_ = g.server.Serve(listener)
+	}()
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+		return listener.Dial()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pb.NewCounterServiceClient(conn), func() {
+		g.Stop(time.Second)
+		_ = conn.Close()
+	}
+}
+
+func TestGRPCCreateCounter(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      *pb.CreateCounterRequest
+		err      error
+		wantSpec CounterSpec
+		wantID   string
+		wantCode codes.Code
+	}{
+		{
+			"normal",
+			&pb.CreateCounterRequest{To: 10, Mode: CounterModeCountDown, Name: "deploy", Labels: map[string]string{"team": "payments"}},
+			nil,
+			CounterSpec{To: 10, Mode: CounterModeCountDown, Name: "deploy", Labels: map[string]string{"team": "payments"}},
+			"1a0ca312-558f-4a13-987f-ba86930ec9ef",
+			codes.OK,
+		},
+		{
+			"with callback",
+			&pb.CreateCounterRequest{To: 10, Callback: &pb.Callback{Url: "https://example.com/hook", Payload: []byte("{\"job\":1}")}},
+			nil,
+			CounterSpec{To: 10, Callback: &Callback{URL: "https://example.com/hook", Payload: []byte("{\"job\":1}")}},
+			"1a0ca312-558f-4a13-987f-ba86930ec9ef",
+			codes.OK,
+		},
+		{
+			"invalid mode",
+			&pb.CreateCounterRequest{To: 10, Mode: "sideways"},
+			nil,
+			CounterSpec{},
+			"",
+			codes.InvalidArgument,
+		},
+		{
+			"callback payload is not JSON",
+			&pb.CreateCounterRequest{To: 10, Callback: &pb.Callback{Url: "https://example.com/hook", Payload: []byte("job")}},
+			nil,
+			CounterSpec{},
+			"",
+			codes.InvalidArgument,
+		},
+		{
+			"internal error",
+			&pb.CreateCounterRequest{To: 10},
+			errors.New("error"),
+			CounterSpec{To: 10},
+			"",
+			codes.Internal,
+		},
+	}
+	for _, tt := range tests {
+		var gotSpec CounterSpec
+		d := &DummyCounter{GenerateCounterFunc: func(ctx context.Context, spec CounterSpec) (string, error) {
+			gotSpec = spec
+			return tt.wantID, tt.err
+		}}
+		client, stop := newTestGRPCClient(t, NewGRPCServer(d, "", nil, nil, NewMetrics(), 0))
+		res, err := client.CreateCounter(context.Background(), tt.req)
+		assert.Equal(t, tt.wantCode, status.Code(err), tt.name)
+		assert.Equal(t, tt.wantSpec, gotSpec, tt.name)
+		if err == nil {
+			assert.Equal(t, tt.wantID, res.Id, tt.name)
+		}
+		stop()
+	}
+}
+
+func TestGRPCGetAndDeleteCounter(t *testing.T) {
+	deleted := []string{}
+	d := &DummyCounter{
+		GetCounterFunc: func(ctx context.Context, id string) (CounterResult, error) {
+			switch id {
+			case "1a0ca312-558f-4a13-987f-ba86930ec9ef":
+				return CounterResult{Current: 3, To: 10, Name: "deploy", counterExistence: true}, nil
+			case "3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e":
+				return CounterResult{}, errors.New("error")
+			}
+			return CounterResult{}, nil
+		},
+		DeleteCounterFunc: func(ctx context.Context, id string) (CounterResult, error) {
+			deleted = append(deleted, id)
+			return CounterResult{Current: 3, To: 10, counterExistence: true}, nil
+		},
+	}
+	client, stop := newTestGRPCClient(t, NewGRPCServer(d, "", nil, nil, NewMetrics(), 0))
+	defer stop()
+
+	res, err := client.GetCounter(context.Background(), &pb.GetCounterRequest{Id: "1a0ca312-558f-4a13-987f-ba86930ec9ef"})
+	assert.NoError(t, err)
+	assert.Equal(t, "1a0ca312-558f-4a13-987f-ba86930ec9ef", res.Id)
+	assert.Equal(t, int64(3), res.Current)
+	assert.Equal(t, int64(10), res.To)
+	assert.Equal(t, "deploy", res.Name)
+
+	_, err = client.GetCounter(context.Background(), &pb.GetCounterRequest{Id: "9dd29757-ed4e-488f-b62c-b8cececbac29"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.GetCounter(context.Background(), &pb.GetCounterRequest{Id: "3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e"})
+	assert.Equal(t, codes.Internal, status.Code(err))
+
+	_, err = client.DeleteCounter(context.Background(), &pb.DeleteCounterRequest{Id: "1a0ca312-558f-4a13-987f-ba86930ec9ef"})
+	assert.NoError(t, err)
+	_, err = client.DeleteCounter(context.Background(), &pb.DeleteCounterRequest{Id: "9dd29757-ed4e-488f-b62c-b8cececbac29"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	// Internal keys never reach Counter
+	_, err = client.DeleteCounter(context.Background(), &pb.DeleteCounterRequest{Id: "ratelimit:create:ip=1.2.3.4"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Equal(t, []string{"1a0ca312-558f-4a13-987f-ba86930ec9ef"}, deleted)
+}
+
+func TestGRPCListCounters(t *testing.T) {
+	tests := []struct {
+		name           string
+		req            *pb.ListCountersRequest
+		wantCursor     uint64
+		wantLimit      int64
+		wantLabels     map[string]string
+		wantNextCursor string
+		wantCode       codes.Code
+	}{
+		{"first page", &pb.ListCountersRequest{}, 0, 100, nil, "7", codes.OK},
+		{"next page", &pb.ListCountersRequest{Cursor: "7", Limit: 2000}, 7, 1000, nil, "7", codes.OK},
+		{"by labels", &pb.ListCountersRequest{Limit: 5, Labels: map[string]string{"team": "payments"}}, 0, 5, map[string]string{"team": "payments"}, "7", codes.OK},
+		{"invalid cursor", &pb.ListCountersRequest{Cursor: "x"}, 0, 0, nil, "", codes.InvalidArgument},
+		{"invalid limit", &pb.ListCountersRequest{Limit: -1}, 0, 0, nil, "", codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		var gotCursor uint64
+		var gotLimit int64
+		var gotLabels map[string]string
+		d := &DummyCounter{
+			ListCountersFunc: func(ctx context.Context, owner string, labels map[string]string, cursor uint64, limit int64) ([]string, uint64, error) {
+				gotLabels, gotCursor, gotLimit = labels, cursor, limit
+				return []string{"1a0ca312-558f-4a13-987f-ba86930ec9ef"}, 7, nil
+			},
+		}
+		client, stop := newTestGRPCClient(t, NewGRPCServer(d, "", nil, nil, NewMetrics(), 0))
+		res, err := client.ListCounters(context.Background(), tt.req)
+		assert.Equal(t, tt.wantCode, status.Code(err), tt.name)
+		assert.Equal(t, tt.wantCursor, gotCursor, tt.name)
+		assert.Equal(t, tt.wantLimit, gotLimit, tt.name)
+		assert.Equal(t, tt.wantLabels, gotLabels, tt.name)
+		if err == nil {
+			assert.Equal(t, []string{"1a0ca312-558f-4a13-987f-ba86930ec9ef"}, res.Ids, tt.name)
+			assert.Equal(t, tt.wantNextCursor, res.NextCursor, tt.name)
+		}
+		stop()
+	}
+}
+
+func TestGRPCWatchCounter(t *testing.T) {
+	results := []CounterResult{
+		{Current: 9, To: 10, counterExistence: true},
+		{Current: 10, To: 10, counterExistence: true},
+		{},
+	}
+	calls := 0
+	d := &DummyCounter{GetCounterFunc: func(ctx context.Context, id string) (CounterResult, error) {
+		r := results[calls]
+		calls++
+		return r, nil
+	}}
+	g := NewGRPCServer(d, "", nil, nil, NewMetrics(), 0)
+	g.watchTickInterval = time.Millisecond
+	client, stop := newTestGRPCClient(t, g)
+	defer stop()
+
+	stream, err := client.WatchCounter(context.Background(), &pb.WatchCounterRequest{Id: "1a0ca312-558f-4a13-987f-ba86930ec9ef"})
+	assert.NoError(t, err)
+	var events []pb.WatchCounterResponse_Event
+	var currents []int64
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			return
+		}
+		events = append(events, res.Event)
+		currents = append(currents, res.Counter.GetCurrent())
+	}
+	assert.Equal(t, []pb.WatchCounterResponse_Event{pb.WatchCounterResponse_TICK, pb.WatchCounterResponse_TICK, pb.WatchCounterResponse_COMPLETED}, events)
+	assert.Equal(t, []int64{9, 10, 0}, currents)
+}
+
+// Watching streams end on shutdown
+func TestGRPCWatchCounterStop(t *testing.T) {
+	d := &DummyCounter{GetCounterFunc: func(ctx context.Context, id string) (CounterResult, error) {
+		return CounterResult{Current: 1, To: 100, counterExistence: true}, nil
+	}}
+	g := NewGRPCServer(d, "", nil, nil, NewMetrics(), 0)
+	g.watchTickInterval = time.Hour
+	client, stop := newTestGRPCClient(t, g)
+
+	stream, err := client.WatchCounter(context.Background(), &pb.WatchCounterRequest{Id: "1a0ca312-558f-4a13-987f-ba86930ec9ef"})
+	assert.NoError(t, err)
+	_, err = stream.Recv()
+	assert.NoError(t, err)
+
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the server didn't stop")
+	}
+}
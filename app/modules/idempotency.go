@@ -0,0 +1,182 @@
+package modules
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	idempotencyKeyHeader     string = "Idempotency-Key"
+	idempotentReplayedHeader string = "Idempotent-Replayed"
+	idempotencyKeyPrefix     string = "idempotency:"
+	maxIdempotencyKeyLength  int    = 255
+	// The key is held this long while the first request is in progress.
+	// It's released earlier when the request ends, and this only matters if the replica dies meanwhile.
+	idempotencyLeaseSecond int64 = 60
+)
+
+// IdempotencyRecord is the response to the first request with an idempotency key.
+type IdempotencyRecord struct {
+	// Hash of the request, to tell replays from other requests with the same key
+	Fingerprint string `json:"fingerprint"`
+	// 0 while the first request is in progress
+	Status      int    `json:"status,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        string `json:"body,omitempty"`
+}
+
+// Reserve the idempotency key for the request with the fingerprint.
+// If the key has already been reserved, it returns false with the record stored with it.
+func (c *CountCalculator) ReserveIdempotencyKey(ctx context.Context, key string, fingerprint string) (IdempotencyRecord, bool, error) {
+	r := IdempotencyRecord{Fingerprint: fingerprint}
+	v, err := json.Marshal(r)
+	if err != nil {
+		return r, false, err
+	}
+	// Only one of the concurrent requests with the same key can reserve it, even across replicas.
+	reserved, err := c.dao.SetNX(ctx, idempotencyKey(key), string(v), idempotencyLeaseSecond)
+	if err != nil || reserved {
+		return r, reserved, err
+	}
+	stored, err := c.dao.Get(ctx, idempotencyKey(key))
+	if err != nil {
+		return r, false, err
+	}
+	var existing IdempotencyRecord
+	if err := json.Unmarshal([]byte(stored), &existing); err != nil {
+		return r, false, err
+	}
+	return existing, false, nil
+}
+
+// Store the response to the request which reserved the key, and keep it for the window.
+func (c *CountCalculator) CompleteIdempotencyKey(ctx context.Context, key string, r IdempotencyRecord, windowSecond int64) error {
+	v, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return c.dao.Set(ctx, idempotencyKey(key), string(v), windowSecond)
+}
+
+// Release the key so that the request can be retried.
+func (c *CountCalculator) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	return c.dao.Del(ctx, idempotencyKey(key))
+}
+
+func idempotencyKey(key string) string {
+	return idempotencyKeyPrefix + key
+}
+
+// Return the response to the first request again against the request with the same "Idempotency-Key" header.
+// Return 409 if the key is used for another request, or the first request is still in progress.
+// Responses with 5xx are not stored, so that clients can retry them.
+func (c *Controller) idempotencyMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		key := ctx.GetHeader(idempotencyKeyHeader)
+		if key == "" || c.idempotencyWindow <= 0 {
+			ctx.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, errorFormatter(fmt.Sprintf("%s must be at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength)))
+			return
+		}
+
+		var body []byte
+		if ctx.Request.Body != nil {
+			var err error
+			body, err = ioutil.ReadAll(ctx.Request.Body)
+			if err != nil {
+				ctx.AbortWithStatusJSON(http.StatusBadRequest, errorFormatter("the request body is invalid"))
+				return
+			}
+			ctx.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		fingerprint := requestFingerprint(ctx.Request, body)
+		// Keys of different API keys never collide
+		if owner := requestOwner(ctx); owner != "" {
+			key = owner + ":" + key
+		}
+
+		reqCtx, cancel := c.requestContext(ctx)
+		r, reserved, err := c.counter.ReserveIdempotencyKey(reqCtx, key, fingerprint)
+		cancel()
+		if err != nil {
+			respondError(ctx, err)
+			ctx.Abort()
+			return
+		}
+		if !reserved {
+			switch {
+			case r.Fingerprint != fingerprint:
+				ctx.AbortWithStatusJSON(http.StatusConflict, errorFormatter(fmt.Sprintf("the %s is already used for another request", idempotencyKeyHeader)))
+			case r.Status == 0:
+				ctx.AbortWithStatusJSON(http.StatusConflict, errorFormatter(fmt.Sprintf("the request with the %s is in progress", idempotencyKeyHeader)))
+			default:
+				ctx.Header(idempotentReplayedHeader, "true")
+				ctx.Data(r.Status, r.ContentType, []byte(r.Body))
+				ctx.Abort()
+			}
+			return
+		}
+
+		w := &recordingResponseWriter{ResponseWriter: ctx.Writer}
+		ctx.Writer = w
+		ctx.Next()
+
+		// The record is stored even if the client has gone, so that its retry gets the response.
+		reqCtx, cancel = withTimeout(context.Background(), c.requestTimeout)
+		defer cancel()
+		if w.Status() >= http.StatusInternalServerError {
+			if err := c.counter.ReleaseIdempotencyKey(reqCtx, key); err != nil {
+				logRequestError(ctx, err)
+			}
+			return
+		}
+		r = IdempotencyRecord{
+			Fingerprint: fingerprint,
+			Status:      w.Status(),
+			ContentType: w.Header().Get("Content-Type"),
+			Body:        w.body.String(),
+		}
+		// Round up, as 0 would mean keeping it forever
+		windowSecond := int64((c.idempotencyWindow + time.Second - 1) / time.Second)
+		if err := c.counter.CompleteIdempotencyKey(reqCtx, key, r, windowSecond); err != nil {
+			logRequestError(ctx, err)
+		}
+	}
+}
+
+// Hash the method, path, query parameters and body of the request.
+// The query parameters are sorted, so their order doesn't matter.
+func requestFingerprint(req *http.Request, body []byte) string {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%s %s?%s\n", req.Method, req.URL.Path, req.URL.Query().Encode())
+	_, _ = h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordingResponseWriter keeps a copy of the response body.
+type recordingResponseWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingResponseWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,165 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// POST /counter with the header against the controller backed by the in-memory store
+func postCounterWithIdempotencyKey(c *Controller, key string, query string, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/counter"+query, strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(idempotencyKeyHeader, key)
+	}
+	c.router.ServeHTTP(w, req)
+	return w
+}
+
+func countCounters(t *testing.T, counter Counter) int {
+	ids, _, err := counter.ListCounters(context.Background(), "", nil, 0, 1000)
+	assert.NoError(t, err)
+	return len(ids)
+}
+
+func TestRouterIdempotencyKey(t *testing.T) {
+	counter := NewCounterCalculator(newMemoryStore(time.Now))
+	c := NewController(counter, ControllerConfig{IdempotencyWindow: time.Hour})
+
+	first := postCounterWithIdempotencyKey(c, "key-1", "?to=1000&mode=countdown", "{\"name\":\"deploy\"}")
+	assert.Equal(t, http.StatusCreated, first.Code)
+	assert.Equal(t, "", first.Header().Get(idempotentReplayedHeader))
+
+	// The query parameters in another order are the same request
+	replay := postCounterWithIdempotencyKey(c, "key-1", "?mode=countdown&to=1000", "{\"name\":\"deploy\"}")
+	assert.Equal(t, http.StatusCreated, replay.Code)
+	assert.Equal(t, first.Body.String(), replay.Body.String())
+	assert.Equal(t, "true", replay.Header().Get(idempotentReplayedHeader))
+	assert.Equal(t, 1, countCounters(t, counter))
+
+	// Different parameters or body with the same key
+	conflict := postCounterWithIdempotencyKey(c, "key-1", "?to=2000&mode=countdown", "{\"name\":\"deploy\"}")
+	assert.Equal(t, http.StatusConflict, conflict.Code)
+	assert.Equal(t, "{\"error\":\"the Idempotency-Key is already used for another request\"}", conflict.Body.String())
+	conflict = postCounterWithIdempotencyKey(c, "key-1", "?to=1000&mode=countdown", "{\"name\":\"release\"}")
+	assert.Equal(t, http.StatusConflict, conflict.Code)
+
+	// Another key or no key generates another counter
+	assert.Equal(t, http.StatusCreated, postCounterWithIdempotencyKey(c, "key-2", "?to=1000&mode=countdown", "{\"name\":\"deploy\"}").Code)
+	assert.Equal(t, http.StatusCreated, postCounterWithIdempotencyKey(c, "", "?to=1000&mode=countdown", "{\"name\":\"deploy\"}").Code)
+	assert.Equal(t, 3, countCounters(t, counter))
+
+	// Responses with 4xx are replayed as well
+	invalid := postCounterWithIdempotencyKey(c, "key-3", "?to=1000", "{\"callback\":{\"url\":\"ftp://example.com\"}}")
+	assert.Equal(t, http.StatusBadRequest, invalid.Code)
+	replay = postCounterWithIdempotencyKey(c, "key-3", "?to=1000", "{\"callback\":{\"url\":\"ftp://example.com\"}}")
+	assert.Equal(t, invalid.Body.String(), replay.Body.String())
+	assert.Equal(t, "true", replay.Header().Get(idempotentReplayedHeader))
+
+	tooLong := postCounterWithIdempotencyKey(c, strings.Repeat("k", 256), "?to=1000", "")
+	assert.Equal(t, http.StatusBadRequest, tooLong.Code)
+	assert.Equal(t, "{\"error\":\"Idempotency-Key must be at most 255 characters\"}", tooLong.Body.String())
+}
+
+// Concurrent duplicates generate only one counter
+func TestRouterIdempotencyKeyConcurrent(t *testing.T) {
+	counter := NewCounterCalculator(newMemoryStore(time.Now))
+	c := NewController(counter, ControllerConfig{IdempotencyWindow: time.Hour})
+
+	var wg sync.WaitGroup
+	codes := make([]int, 20)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = postCounterWithIdempotencyKey(c, "key", "?to=1000", "").Code
+		}(i)
+	}
+	wg.Wait()
+	for _, code := range codes {
+		// Replayed, or rejected while the first one is in progress
+		assert.Contains(t, []int{http.StatusCreated, http.StatusConflict}, code)
+	}
+	assert.Equal(t, 1, countCounters(t, counter))
+}
+
+// The key is released after internal errors, so that the client can retry
+func TestRouterIdempotencyKeyInternalError(t *testing.T) {
+	var released []string
+	d := &DummyCounter{
+		GenerateCounterFunc: func(ctx context.Context, spec CounterSpec) (string, error) {
+			return "", errors.New("error")
+		},
+		ReserveIdempotencyKeyFunc: func(ctx context.Context, key string, fingerprint string) (IdempotencyRecord, bool, error) {
+			return IdempotencyRecord{Fingerprint: fingerprint}, true, nil
+		},
+		ReleaseIdempotencyKeyFunc: func(ctx context.Context, key string) error {
+			released = append(released, key)
+			return nil
+		},
+	}
+	c := NewController(d, ControllerConfig{IdempotencyWindow: time.Hour})
+	w := postCounterWithIdempotencyKey(c, "key", "?to=1000", "")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, []string{"key"}, released)
+
+	d.ReserveIdempotencyKeyFunc = func(ctx context.Context, key string, fingerprint string) (IdempotencyRecord, bool, error) {
+		return IdempotencyRecord{}, false, errors.New("error")
+	}
+	w = postCounterWithIdempotencyKey(c, "key", "?to=1000", "")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "{\"error\":\"Internal Server Error\"}", w.Body.String())
+}
+
+// The header is ignored without the window
+func TestRouterIdempotencyKeyDisabled(t *testing.T) {
+	counter := NewCounterCalculator(newMemoryStore(time.Now))
+	c := NewController(counter, ControllerConfig{})
+	assert.Equal(t, http.StatusCreated, postCounterWithIdempotencyKey(c, "key", "?to=1000", "").Code)
+	assert.Equal(t, http.StatusCreated, postCounterWithIdempotencyKey(c, "key", "?to=1000", "").Code)
+	assert.Equal(t, 2, countCounters(t, counter))
+}
+
+func TestReserveIdempotencyKey(t *testing.T) {
+	now := time.Unix(1000, 0)
+	m := newMemoryStore(func() time.Time { return now })
+	c := NewCounterCalculator(m)
+
+	r, reserved, err := c.ReserveIdempotencyKey(context.Background(), "key", "abc")
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+	assert.Equal(t, IdempotencyRecord{Fingerprint: "abc"}, r)
+
+	// In progress
+	r, reserved, err = c.ReserveIdempotencyKey(context.Background(), "key", "abc")
+	assert.NoError(t, err)
+	assert.False(t, reserved)
+	assert.Equal(t, IdempotencyRecord{Fingerprint: "abc"}, r)
+
+	stored := IdempotencyRecord{Fingerprint: "abc", Status: 201, ContentType: "application/json", Body: "{\"id\":\"x\"}"}
+	assert.NoError(t, c.CompleteIdempotencyKey(context.Background(), "key", stored, 3600))
+	r, reserved, err = c.ReserveIdempotencyKey(context.Background(), "key", "def")
+	assert.NoError(t, err)
+	assert.False(t, reserved)
+	assert.Equal(t, stored, r)
+
+	// The key can be used again after the window
+	now = now.Add(time.Hour)
+	_, reserved, err = c.ReserveIdempotencyKey(context.Background(), "key", "def")
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+
+	// Released keys can be reserved again right away
+	assert.NoError(t, c.ReleaseIdempotencyKey(context.Background(), "key"))
+	_, reserved, err = c.ReserveIdempotencyKey(context.Background(), "key", "ghi")
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+}
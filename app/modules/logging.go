@@ -0,0 +1,138 @@
+package modules
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	requestIDHeader  string = "X-Request-ID"
+	loggerContextKey string = "logger"
+	// Longer request IDs from clients are replaced, not to let them bloat logs.
+	maxRequestIDLength int = 128
+)
+
+// Configure the standard logger to emit JSON lines at the given level such as "info" or "debug".
+func ConfigureLogger(level string) error {
+	l, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logrus.SetFormatter(&logrus.JSONFormatter{})
+	logrus.SetLevel(l)
+	return nil
+}
+
+// DaoError is an error from DB with the operation and the key which caused it.
+// The fields are attached to the error log of the request.
+type DaoError struct {
+	Operation string
+	Key       string
+	Err       error
+}
+
+func (e *DaoError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Operation, e.Key, e.Err)
+}
+
+func (e *DaoError) Unwrap() error {
+	return e.Err
+}
+
+// Return a middleware which logs every request as a JSON line.
+// It honors X-Request-ID from the client, or generates it, and returns it in the response header.
+// Handlers can get the logger with the same fields by requestLogger.
+func (c *Controller) loggingMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+
+		requestID := ctx.GetHeader(requestIDHeader)
+		if requestID == "" || len(requestID) > maxRequestIDLength {
+			requestID = uuid.New().String()
+		}
+		ctx.Header(requestIDHeader, requestID)
+		ctx.Set(loggerContextKey, logrus.WithFields(logrus.Fields{
+			"request_id": requestID,
+			"hostname":   c.hostname,
+		}))
+
+		ctx.Next()
+
+		entry := requestLogger(ctx).WithFields(logrus.Fields{
+			"method":     ctx.Request.Method,
+			"route":      requestRoute(ctx),
+			"path":       ctx.Request.URL.Path,
+			"status":     ctx.Writer.Status(),
+			"latency_ms": float64(time.Since(start).Microseconds()) / 1000,
+			"client_ip":  c.clientIP(ctx),
+		})
+		if id := ctx.Param("id"); id != "" {
+			entry = entry.WithField("counter_id", id)
+		}
+		entry.Info("request")
+	}
+}
+
+// Return the logger with the fields of the request.
+func requestLogger(ctx *gin.Context) *logrus.Entry {
+	if v, ok := ctx.Get(loggerContextKey); ok {
+		if entry, ok := v.(*logrus.Entry); ok {
+			return entry
+		}
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// Return a middleware which turns panics in handlers into 500, like gin.Recovery.
+// The panic is logged with the stack trace and the fields of the request, rather than printed in plain text.
+func recoveryMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			// net/http aborts the response silently with this
+			if r == http.ErrAbortHandler {
+				panic(r)
+			}
+			entry := requestLogger(ctx).WithFields(logrus.Fields{
+				"panic": fmt.Sprint(r),
+				"stack": string(debug.Stack()),
+			})
+			if id := ctx.Param("id"); id != "" {
+				entry = entry.WithField("counter_id", id)
+			}
+			entry.Error("panic recovered")
+			if ctx.Writer.Written() {
+				ctx.Abort()
+				return
+			}
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, errorFormatter(http.StatusText(http.StatusInternalServerError)))
+		}()
+		ctx.Next()
+	}
+}
+
+// Log the error with the fields of the request and, if it came from DB, the operation and key.
+func logRequestError(ctx *gin.Context, err error) {
+	entry := requestLogger(ctx).WithError(err)
+	if id := ctx.Param("id"); id != "" {
+		entry = entry.WithField("counter_id", id)
+	}
+	var daoErr *DaoError
+	if errors.As(err, &daoErr) {
+		entry = entry.WithFields(logrus.Fields{
+			"dao_operation": daoErr.Operation,
+			"dao_key":       daoErr.Key,
+		})
+	}
+	entry.Error("request failed")
+}
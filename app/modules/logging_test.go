@@ -0,0 +1,115 @@
+package modules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// Capture JSON lines written by the standard logger during f
+func captureLogs(f func()) []map[string]interface{} {
+	var buf bytes.Buffer
+	out := logrus.StandardLogger().Out
+	logrus.SetOutput(&buf)
+	logrus.SetFormatter(&logrus.JSONFormatter{})
+	f()
+	logrus.SetOutput(out)
+
+	var lines []map[string]interface{}
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var m map[string]interface{}
+		_ = json.Unmarshal([]byte(l), &m)
+		lines = append(lines, m)
+	}
+	return lines
+}
+
+func TestLoggingMiddleware_RequestID(t *testing.T) {
+	type testCase struct {
+		requestID           string
+		expectedToBeHonored bool
+	}
+	var cases = []testCase{
+		{"abc-123", true},
+		{"", false},
+		{strings.Repeat("a", 129), false},
+	}
+
+	for _, i := range cases {
+		d := &DummyCounter{GetCounterFunc: func(ctx context.Context, id string) (CounterResult, error) {
+			return CounterResult{Current: 10, To: 1000, counterExistence: true}, nil
+		}}
+		c := NewController(d, ControllerConfig{Hostname: "test-kenji-kondo.mac.local"})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/counter/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e", nil)
+		req.Header.Set(requestIDHeader, i.requestID)
+		lines := captureLogs(func() { c.router.ServeHTTP(w, req) })
+
+		returned := w.Header().Get(requestIDHeader)
+		if i.expectedToBeHonored {
+			assert.Equal(t, i.requestID, returned)
+		} else {
+			assert.NotEqual(t, i.requestID, returned)
+			assert.NotEmpty(t, returned)
+		}
+		assert.Len(t, lines, 1)
+		assert.Equal(t, returned, lines[0]["request_id"])
+		assert.Equal(t, "test-kenji-kondo.mac.local", lines[0]["hostname"])
+		assert.Equal(t, "GET", lines[0]["method"])
+		assert.Equal(t, "/counter/:id", lines[0]["route"])
+		assert.Equal(t, float64(200), lines[0]["status"])
+		assert.Equal(t, "3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e", lines[0]["counter_id"])
+	}
+}
+
+// error logs have the same request ID and the DB operation
+func TestLoggingMiddleware_ErrorLog(t *testing.T) {
+	d := &DummyCounter{GetCounterFunc: func(ctx context.Context, id string) (CounterResult, error) {
+		return CounterResult{}, &DaoError{Operation: "get", Key: id, Err: errors.New("some error")}
+	}}
+	c := NewController(d, ControllerConfig{})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/counter/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e", nil)
+	req.Header.Set(requestIDHeader, "abc-123")
+	lines := captureLogs(func() { c.router.ServeHTTP(w, req) })
+
+	assert.Len(t, lines, 2)
+	assert.Equal(t, "error", lines[0]["level"])
+	assert.Equal(t, "abc-123", lines[0]["request_id"])
+	assert.Equal(t, "3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e", lines[0]["counter_id"])
+	assert.Equal(t, "get", lines[0]["dao_operation"])
+	assert.Equal(t, "get 3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e: some error", lines[0]["error"])
+	assert.Equal(t, "abc-123", lines[1]["request_id"])
+	assert.Equal(t, float64(500), lines[1]["status"])
+}
+
+// Panics are logged as JSON lines with the request ID, and return 500
+func TestRecoveryMiddleware(t *testing.T) {
+	d := &DummyCounter{GetCounterFunc: func(ctx context.Context, id string) (CounterResult, error) {
+		panic("something went wrong")
+	}}
+	c := NewController(d, ControllerConfig{})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/counter/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e", nil)
+	req.Header.Set(requestIDHeader, "abc-123")
+	lines := captureLogs(func() { c.router.ServeHTTP(w, req) })
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "{\"error\":\"Internal Server Error\"}", w.Body.String())
+	assert.Len(t, lines, 2)
+	assert.Equal(t, "error", lines[0]["level"])
+	assert.Equal(t, "panic recovered", lines[0]["msg"])
+	assert.Equal(t, "something went wrong", lines[0]["panic"])
+	assert.Equal(t, "abc-123", lines[0]["request_id"])
+	assert.Equal(t, "3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e", lines[0]["counter_id"])
+	assert.Contains(t, lines[0]["stack"], "runtime/debug.Stack")
+	assert.Equal(t, float64(500), lines[1]["status"])
+}
@@ -0,0 +1,381 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrMemoryKeyNotFound is returned by MemoryStore.Get when the key doesn't exist, like redis.Nil does for Redis.
+var ErrMemoryKeyNotFound = errors.New("memory store: key not found")
+
+type memoryEntry struct {
+	value    string
+	expireAt time.Time // zero value means the entry never expires
+}
+
+// MemoryStore is an in-memory implementation of Dao.
+// It is intended for development and CI, where the whole API should run without Redis.
+// Contexts are ignored since every operation completes immediately.
+type MemoryStore struct {
+	mu            sync.RWMutex
+	entries       map[string]memoryEntry
+	sets          map[string]map[string]struct{}
+	sortedSets    map[string]map[string]int64
+	now           func() time.Time
+	sweepInterval time.Duration
+	stop          chan struct{}
+	stopOnce      sync.Once
+}
+
+const defaultMemorySweepInterval = time.Second
+
+// Initialize MemoryStore and start the background expiry of keys.
+// Call Close to stop the background expiry.
+func NewMemoryStore() *MemoryStore {
+	m := newMemoryStore(time.Now)
+	go m.runSweeper()
+	return m
+}
+
+func newMemoryStore(now func() time.Time) *MemoryStore {
+	return &MemoryStore{
+		entries:       map[string]memoryEntry{},
+		sets:          map[string]map[string]struct{}{},
+		sortedSets:    map[string]map[string]int64{},
+		now:           now,
+		sweepInterval: defaultMemorySweepInterval,
+		stop:          make(chan struct{}),
+	}
+}
+
+// Set stores the value. The key expires after expirationSecond, and never expires if it is 0, as Redis SET does.
+func (m *MemoryStore) Set(ctx context.Context, key string, value string, expirationSecond int64) error {
+	return m.set(key, value, time.Duration(expirationSecond)*time.Second)
+}
+
+func (m *MemoryStore) PSet(ctx context.Context, key string, value string, expirationMillisecond int64) error {
+	return m.set(key, value, time.Duration(expirationMillisecond)*time.Millisecond)
+}
+
+func (m *MemoryStore) set(key string, value string, expiration time.Duration) error {
+	e := memoryEntry{value: value}
+	if expiration > 0 {
+		e.expireAt = m.now().Add(expiration)
+	}
+	m.mu.Lock()
+	m.entries[key] = e
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryStore) SetNX(ctx context.Context, key string, value string, expirationSecond int64) (bool, error) {
+	e := memoryEntry{value: value}
+	if expirationSecond > 0 {
+		e.expireAt = m.now().Add(time.Duration(expirationSecond) * time.Second)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.lookup(key); ok {
+		return false, nil
+	}
+	m.entries[key] = e
+	return true, nil
+}
+
+func (m *MemoryStore) Get(ctx context.Context, key string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	e, ok := m.lookup(key)
+	if !ok {
+		return "", ErrMemoryKeyNotFound
+	}
+	return e.value, nil
+}
+
+// ScanKeys returns keys in lexical order, and the cursor is the offset of the next key.
+func (m *MemoryStore) ScanKeys(ctx context.Context, cursor uint64, count int64) ([]string, uint64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := []string{}
+	for k := range m.entries {
+		if _, ok := m.lookup(k); ok && !isInternalKey(k) {
+			keys = append(keys, k)
+		}
+	}
+	return paginateSorted(keys, cursor, count)
+}
+
+func (m *MemoryStore) AddToSet(ctx context.Context, key string, members ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	set, ok := m.sets[key]
+	if !ok {
+		set = map[string]struct{}{}
+		m.sets[key] = set
+	}
+	for _, member := range members {
+		set[member] = struct{}{}
+	}
+	return nil
+}
+
+func (m *MemoryStore) RemoveFromSet(ctx context.Context, key string, members ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	set, ok := m.sets[key]
+	if !ok {
+		return nil
+	}
+	for _, member := range members {
+		delete(set, member)
+	}
+	// Redis deletes the empty set as well
+	if len(set) == 0 {
+		delete(m.sets, key)
+	}
+	return nil
+}
+
+// ScanSet returns members in lexical order, and the cursor is the offset of the next member.
+func (m *MemoryStore) ScanSet(ctx context.Context, key string, cursor uint64, count int64) ([]string, uint64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	members := []string{}
+	for member := range m.sets[key] {
+		members = append(members, member)
+	}
+	return paginateSorted(members, cursor, count)
+}
+
+// The bucket is kept as "tokens timestamp" like a normal key, so that it expires in the same way.
+func (m *MemoryStore) TakeToken(ctx context.Context, key string, capacity int64, periodMillisecond int64, count int64) (bool, float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	nowMillisecond := now.UnixNano() / int64(time.Millisecond)
+	tokens, ts := float64(capacity), nowMillisecond
+	if e, ok := m.lookup(key); ok {
+		if _, err := fmt.Sscanf(e.value, "%g %d", &tokens, &ts); err != nil {
+			return false, 0, err
+		}
+	}
+	if nowMillisecond > ts {
+		tokens = math.Min(float64(capacity), tokens+float64(nowMillisecond-ts)*float64(capacity)/float64(periodMillisecond))
+		ts = nowMillisecond
+	}
+	taken := tokens >= float64(count)
+	if taken {
+		tokens -= float64(count)
+	}
+	m.entries[key] = memoryEntry{
+		value:    fmt.Sprintf("%g %d", tokens, ts),
+		expireAt: now.Add(time.Duration(periodMillisecond) * time.Millisecond),
+	}
+	return taken, tokens, nil
+}
+
+func (m *MemoryStore) Del(ctx context.Context, key string) error {
+	m.mu.Lock()
+	delete(m.entries, key)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryStore) Exists(ctx context.Context, key string) (int64, error) {
+	// Return 1 or 0 to be compatible with RedisClient.Exists
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if _, ok := m.lookup(key); ok {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// The writes run one by one on Exec, as they do in a Redis pipeline.
+func (m *MemoryStore) Batch(ctx context.Context) DaoBatch {
+	return &memoryBatch{m: m, ctx: ctx}
+}
+
+func (m *MemoryStore) GetBatch(ctx context.Context, keys []string) (map[string]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	results := map[string]string{}
+	for _, k := range keys {
+		if e, ok := m.lookup(k); ok {
+			results[k] = e.value
+		}
+	}
+	return results, nil
+}
+
+type memoryBatch struct {
+	m   *MemoryStore
+	ctx context.Context
+	ops []func() error
+}
+
+func (b *memoryBatch) Set(key string, value string, expirationSecond int64) {
+	b.ops = append(b.ops, func() error { return b.m.Set(b.ctx, key, value, expirationSecond) })
+}
+
+func (b *memoryBatch) PSet(key string, value string, expirationMillisecond int64) {
+	b.ops = append(b.ops, func() error { return b.m.PSet(b.ctx, key, value, expirationMillisecond) })
+}
+
+func (b *memoryBatch) AddToSet(key string, members ...string) {
+	b.ops = append(b.ops, func() error { return b.m.AddToSet(b.ctx, key, members...) })
+}
+
+func (b *memoryBatch) RemoveFromSet(key string, members ...string) {
+	b.ops = append(b.ops, func() error { return b.m.RemoveFromSet(b.ctx, key, members...) })
+}
+
+func (b *memoryBatch) AddToSortedSet(key string, member string, score int64) {
+	b.ops = append(b.ops, func() error { return b.m.AddToSortedSet(b.ctx, key, member, score) })
+}
+
+func (b *memoryBatch) RemoveFromSortedSet(key string, members ...string) {
+	b.ops = append(b.ops, func() error { return b.m.RemoveFromSortedSet(b.ctx, key, members...) })
+}
+
+func (b *memoryBatch) Del(keys ...string) {
+	for _, k := range keys {
+		k := k
+		b.ops = append(b.ops, func() error { return b.m.Del(b.ctx, k) })
+	}
+}
+
+// All writes run even if some of them fail, like Redis pipelines.
+func (b *memoryBatch) Exec() error {
+	var first error
+	for _, op := range b.ops {
+		if err := op(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Ping always succeeds because there is nothing to connect to.
+func (m *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close stops the background expiry.
+func (m *MemoryStore) Close() error {
+	m.stopOnce.Do(func() { close(m.stop) })
+	return nil
+}
+
+// lookup returns the entry unless it has already expired.
+// Expired entries can remain until the next sweep, so every read has to check it.
+// The caller must hold the lock.
+func (m *MemoryStore) lookup(key string) (memoryEntry, bool) {
+	e, ok := m.entries[key]
+	if !ok || m.expired(e, m.now()) {
+		return memoryEntry{}, false
+	}
+	return e, true
+}
+
+func (m *MemoryStore) AddToSortedSet(ctx context.Context, key string, member string, score int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	set, ok := m.sortedSets[key]
+	if !ok {
+		set = map[string]int64{}
+		m.sortedSets[key] = set
+	}
+	set[member] = score
+	return nil
+}
+
+func (m *MemoryStore) RemoveFromSortedSet(ctx context.Context, key string, members ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	set, ok := m.sortedSets[key]
+	if !ok {
+		return nil
+	}
+	for _, member := range members {
+		delete(set, member)
+	}
+	if len(set) == 0 {
+		delete(m.sortedSets, key)
+	}
+	return nil
+}
+
+// ClaimFromSortedSet takes members in the order of their scores as Redis ZRANGEBYSCORE does.
+func (m *MemoryStore) ClaimFromSortedSet(ctx context.Context, key string, maxScore int64, newScore int64, count int64) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	set := m.sortedSets[key]
+	members := []string{}
+	for member, score := range set {
+		if score <= maxScore {
+			members = append(members, member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if set[members[i]] != set[members[j]] {
+			return set[members[i]] < set[members[j]]
+		}
+		return members[i] < members[j]
+	})
+	if count > 0 && int64(len(members)) > count {
+		members = members[:count]
+	}
+	for _, member := range members {
+		set[member] = newScore
+	}
+	return members, nil
+}
+
+// Sort s and return at most count elements from the offset cursor, and the offset of the next page.
+// The returned cursor 0 means there are no more pages.
+func paginateSorted(s []string, cursor uint64, count int64) ([]string, uint64, error) {
+	sort.Strings(s)
+	if cursor >= uint64(len(s)) {
+		return []string{}, 0, nil
+	}
+	end := cursor + uint64(count)
+	if count <= 0 || end >= uint64(len(s)) {
+		return s[cursor:], 0, nil
+	}
+	return s[cursor:end], end, nil
+}
+
+func (m *MemoryStore) expired(e memoryEntry, now time.Time) bool {
+	return !e.expireAt.IsZero() && !now.Before(e.expireAt)
+}
+
+func (m *MemoryStore) runSweeper() {
+	ticker := time.NewTicker(m.sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.sweep()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// sweep deletes all expired entries.
+func (m *MemoryStore) sweep() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	for k, e := range m.entries {
+		if m.expired(e, now) {
+			delete(m.entries, k)
+		}
+	}
+}
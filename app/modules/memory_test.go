@@ -0,0 +1,144 @@
+package modules
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStore_Expiry(t *testing.T) {
+	now := time.Unix(1591115560, 0)
+	m := newMemoryStore(func() time.Time { return now })
+
+	_ = m.Set(context.Background(), "expiring", "a", 10)
+	_ = m.Set(context.Background(), "persistent", "b", 0) // 0 means it never expires
+
+	keys, _, _ := m.ScanKeys(context.Background(), 0, 100)
+	assert.Equal(t, []string{"expiring", "persistent"}, keys)
+
+	// 1 second before the expiry
+	now = now.Add(9 * time.Second)
+	v, err := m.Get(context.Background(), "expiring")
+	assert.Equal(t, "a", v)
+	assert.Nil(t, err)
+
+	// Just at the expiry. The key must disappear even before the sweeper runs.
+	now = now.Add(time.Second)
+	existence, _ := m.Exists(context.Background(), "expiring")
+	assert.Equal(t, int64(0), existence)
+	_, err = m.Get(context.Background(), "expiring")
+	assert.Equal(t, ErrMemoryKeyNotFound, err)
+	keys, _, _ = m.ScanKeys(context.Background(), 0, 100)
+	assert.Equal(t, []string{"persistent"}, keys)
+
+	m.sweep()
+	assert.Len(t, m.entries, 1)
+}
+
+func TestMemoryStore_ScanKeys(t *testing.T) {
+	m := newMemoryStore(time.Now)
+	for _, k := range []string{"c", "a", "e", "b", "d"} {
+		_ = m.Set(context.Background(), k, "", 0)
+	}
+
+	keys, cursor, _ := m.ScanKeys(context.Background(), 0, 2)
+	assert.Equal(t, []string{"a", "b"}, keys)
+	assert.Equal(t, uint64(2), cursor)
+
+	keys, cursor, _ = m.ScanKeys(context.Background(), cursor, 2)
+	assert.Equal(t, []string{"c", "d"}, keys)
+	assert.Equal(t, uint64(4), cursor)
+
+	// 0 means the iteration is complete
+	keys, cursor, _ = m.ScanKeys(context.Background(), cursor, 2)
+	assert.Equal(t, []string{"e"}, keys)
+	assert.Equal(t, uint64(0), cursor)
+}
+
+func TestMemoryStore_Del(t *testing.T) {
+	m := NewMemoryStore()
+	defer m.Close()
+
+	_ = m.Set(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29", "a", 1000)
+	existence, _ := m.Exists(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	assert.Equal(t, int64(1), existence)
+
+	assert.Nil(t, m.Del(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29"))
+	existence, _ = m.Exists(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	assert.Equal(t, int64(0), existence)
+
+	// Deleting a key which doesn't exist is not an error, as Redis DEL does.
+	assert.Nil(t, m.Del(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29"))
+}
+
+func TestMemoryStore_TakeToken(t *testing.T) {
+	now := time.Unix(1000, 0)
+	m := newMemoryStore(func() time.Time { return now })
+
+	// The bucket starts full
+	for i := 2; i >= 0; i-- {
+		taken, tokens, err := m.TakeToken(context.Background(), "bucket", 3, 3000, 1)
+		assert.Nil(t, err)
+		assert.True(t, taken)
+		assert.Equal(t, float64(i), tokens)
+	}
+	taken, tokens, _ := m.TakeToken(context.Background(), "bucket", 3, 3000, 1)
+	assert.False(t, taken)
+	assert.Equal(t, float64(0), tokens)
+
+	// A token per second comes back
+	now = now.Add(1500 * time.Millisecond)
+	taken, tokens, _ = m.TakeToken(context.Background(), "bucket", 3, 3000, 1)
+	assert.True(t, taken)
+	assert.Equal(t, 0.5, tokens)
+
+	// Never more than the capacity
+	now = now.Add(time.Hour)
+	taken, tokens, _ = m.TakeToken(context.Background(), "bucket", 3, 3000, 1)
+	assert.True(t, taken)
+	assert.Equal(t, float64(2), tokens)
+
+	// Nothing is taken unless the bucket has all of them
+	taken, tokens, _ = m.TakeToken(context.Background(), "bucket", 3, 3000, 3)
+	assert.False(t, taken)
+	assert.Equal(t, float64(2), tokens)
+	taken, tokens, _ = m.TakeToken(context.Background(), "bucket", 3, 3000, 2)
+	assert.True(t, taken)
+	assert.Equal(t, float64(0), tokens)
+}
+
+// Batches run nothing until Exec
+func TestMemoryStore_Batch(t *testing.T) {
+	m := NewMemoryStore()
+	defer m.Close()
+	_ = m.Set(context.Background(), "a", "1", 0)
+
+	b := m.Batch(context.Background())
+	b.Set("b", "2", 0)
+	b.Del("a")
+	existence, _ := m.Exists(context.Background(), "b")
+	assert.Equal(t, int64(0), existence)
+
+	assert.Nil(t, b.Exec())
+	values, err := m.GetBatch(context.Background(), []string{"a", "b"})
+	assert.Nil(t, err)
+	// Missing keys are not in the map
+	assert.Equal(t, map[string]string{"b": "2"}, values)
+}
+
+func TestMemoryStore_ClaimFromSortedSet(t *testing.T) {
+	m := newMemoryStore(time.Now)
+	_ = m.AddToSortedSet(context.Background(), "schedule", "b", 20)
+	_ = m.AddToSortedSet(context.Background(), "schedule", "a", 10)
+	_ = m.AddToSortedSet(context.Background(), "schedule", "c", 30)
+
+	claimed, _ := m.ClaimFromSortedSet(context.Background(), "schedule", 20, 100, 10)
+	assert.Equal(t, []string{"a", "b"}, claimed)
+	// Claimed members are not taken again until the lease expires
+	claimed, _ = m.ClaimFromSortedSet(context.Background(), "schedule", 30, 100, 10)
+	assert.Equal(t, []string{"c"}, claimed)
+	claimed, _ = m.ClaimFromSortedSet(context.Background(), "schedule", 100, 200, 2)
+	assert.Equal(t, []string{"a", "b"}, claimed)
+}
@@ -0,0 +1,242 @@
+package modules
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace string = "counterapi"
+
+// Metrics holds all Prometheus metrics of the application.
+// Each instance has its own registry, so that instances don't conflict with each other in tests.
+type Metrics struct {
+	registry             *prometheus.Registry
+	httpRequests         *prometheus.CounterVec
+	httpRequestDuration  *prometheus.HistogramVec
+	daoOperationDuration *prometheus.HistogramVec
+	daoOperationErrors   *prometheus.CounterVec
+	countersCreated      prometheus.Counter
+	countersStopped      prometheus.Counter
+	countersNotFound     prometheus.Counter
+	rateLimited          *prometheus.CounterVec
+}
+
+// Initialize Metrics and register all metrics including Go runtime and process ones.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests by method, route and status code.",
+		}, []string{"method", "route", "status"}),
+		httpRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests by method and route.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		daoOperationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "dao_operation_duration_seconds",
+			Help:      "Latency of DB operations by operation.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"operation"}),
+		daoOperationErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "dao_operation_errors_total",
+			Help:      "Number of failed DB operations by operation.",
+		}, []string{"operation"}),
+		countersCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "counters_created_total",
+			Help:      "Number of created counters.",
+		}),
+		countersStopped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "counters_stopped_total",
+			Help:      "Number of stopped counters.",
+		}),
+		countersNotFound: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "counters_not_found_total",
+			Help:      "Number of requests for counters which don't exist.",
+		}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rate_limited_requests_total",
+			Help:      "Number of requests rejected by the rate limits by scope.",
+		}, []string{"scope"}),
+	}
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.httpRequests,
+		m.httpRequestDuration,
+		m.daoOperationDuration,
+		m.daoOperationErrors,
+		m.countersCreated,
+		m.countersStopped,
+		m.countersNotFound,
+		m.rateLimited,
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// GinMiddleware records the count and latency of every request.
+// The route is the registered path like "/counter/:id" rather than the actual one, to keep the label cardinality low.
+func (m *Metrics) GinMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+
+		route := requestRoute(ctx)
+		if route == "" {
+			route = "unmatched"
+		}
+		method := ctx.Request.Method
+		m.httpRequests.WithLabelValues(method, route, strconv.Itoa(ctx.Writer.Status())).Inc()
+		m.httpRequestDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// InstrumentedDao is a Dao which records the latency and errors of every operation of the wrapped Dao.
+type InstrumentedDao struct {
+	dao     Dao
+	metrics *Metrics
+}
+
+// Wrap the Dao to record its metrics.
+func NewInstrumentedDao(dao Dao, metrics *Metrics) *InstrumentedDao {
+	return &InstrumentedDao{dao: dao, metrics: metrics}
+}
+
+func (i *InstrumentedDao) Set(ctx context.Context, key string, value string, expirationSecond int64) error {
+	defer i.observe("set", time.Now())
+	return i.countError("set", i.dao.Set(ctx, key, value, expirationSecond))
+}
+
+func (i *InstrumentedDao) PSet(ctx context.Context, key string, value string, expirationMillisecond int64) error {
+	defer i.observe("set", time.Now())
+	return i.countError("set", i.dao.PSet(ctx, key, value, expirationMillisecond))
+}
+
+func (i *InstrumentedDao) SetNX(ctx context.Context, key string, value string, expirationSecond int64) (bool, error) {
+	defer i.observe("setnx", time.Now())
+	ok, err := i.dao.SetNX(ctx, key, value, expirationSecond)
+	return ok, i.countError("setnx", err)
+}
+
+func (i *InstrumentedDao) TakeToken(ctx context.Context, key string, capacity int64, periodMillisecond int64, count int64) (bool, float64, error) {
+	defer i.observe("taketoken", time.Now())
+	taken, tokens, err := i.dao.TakeToken(ctx, key, capacity, periodMillisecond, count)
+	return taken, tokens, i.countError("taketoken", err)
+}
+
+func (i *InstrumentedDao) Batch(ctx context.Context) DaoBatch {
+	return &instrumentedBatch{DaoBatch: i.dao.Batch(ctx), i: i}
+}
+
+func (i *InstrumentedDao) GetBatch(ctx context.Context, keys []string) (map[string]string, error) {
+	defer i.observe("getbatch", time.Now())
+	values, err := i.dao.GetBatch(ctx, keys)
+	return values, i.countError("getbatch", err)
+}
+
+// instrumentedBatch records the whole batch as one operation when it runs.
+type instrumentedBatch struct {
+	DaoBatch
+	i *InstrumentedDao
+}
+
+func (b *instrumentedBatch) Exec() error {
+	defer b.i.observe("batch", time.Now())
+	return b.i.countError("batch", b.DaoBatch.Exec())
+}
+
+func (i *InstrumentedDao) Get(ctx context.Context, key string) (string, error) {
+	defer i.observe("get", time.Now())
+	v, err := i.dao.Get(ctx, key)
+	return v, i.countError("get", err)
+}
+
+func (i *InstrumentedDao) ScanKeys(ctx context.Context, cursor uint64, count int64) ([]string, uint64, error) {
+	defer i.observe("scan", time.Now())
+	keys, nextCursor, err := i.dao.ScanKeys(ctx, cursor, count)
+	return keys, nextCursor, i.countError("scan", err)
+}
+
+func (i *InstrumentedDao) AddToSet(ctx context.Context, key string, members ...string) error {
+	defer i.observe("sadd", time.Now())
+	return i.countError("sadd", i.dao.AddToSet(ctx, key, members...))
+}
+
+func (i *InstrumentedDao) RemoveFromSet(ctx context.Context, key string, members ...string) error {
+	defer i.observe("srem", time.Now())
+	return i.countError("srem", i.dao.RemoveFromSet(ctx, key, members...))
+}
+
+func (i *InstrumentedDao) ScanSet(ctx context.Context, key string, cursor uint64, count int64) ([]string, uint64, error) {
+	defer i.observe("sscan", time.Now())
+	members, nextCursor, err := i.dao.ScanSet(ctx, key, cursor, count)
+	return members, nextCursor, i.countError("sscan", err)
+}
+
+func (i *InstrumentedDao) AddToSortedSet(ctx context.Context, key string, member string, score int64) error {
+	defer i.observe("zadd", time.Now())
+	return i.countError("zadd", i.dao.AddToSortedSet(ctx, key, member, score))
+}
+
+func (i *InstrumentedDao) RemoveFromSortedSet(ctx context.Context, key string, members ...string) error {
+	defer i.observe("zrem", time.Now())
+	return i.countError("zrem", i.dao.RemoveFromSortedSet(ctx, key, members...))
+}
+
+func (i *InstrumentedDao) ClaimFromSortedSet(ctx context.Context, key string, maxScore int64, newScore int64, count int64) ([]string, error) {
+	defer i.observe("claim", time.Now())
+	members, err := i.dao.ClaimFromSortedSet(ctx, key, maxScore, newScore, count)
+	return members, i.countError("claim", err)
+}
+
+func (i *InstrumentedDao) Del(ctx context.Context, key string) error {
+	defer i.observe("del", time.Now())
+	return i.countError("del", i.dao.Del(ctx, key))
+}
+
+func (i *InstrumentedDao) Exists(ctx context.Context, key string) (int64, error) {
+	defer i.observe("exists", time.Now())
+	existence, err := i.dao.Exists(ctx, key)
+	return existence, i.countError("exists", err)
+}
+
+func (i *InstrumentedDao) Ping(ctx context.Context) error {
+	defer i.observe("ping", time.Now())
+	return i.countError("ping", i.dao.Ping(ctx))
+}
+
+func (i *InstrumentedDao) Close() error {
+	return i.dao.Close()
+}
+
+func (i *InstrumentedDao) observe(operation string, start time.Time) {
+	i.metrics.daoOperationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// Count the error if any, and return it as it is.
+func (i *InstrumentedDao) countError(operation string, err error) error {
+	if err != nil {
+		i.metrics.daoOperationErrors.WithLabelValues(operation).Inc()
+	}
+	return err
+}
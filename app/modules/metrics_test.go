@@ -0,0 +1,74 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics_HTTPAndBusiness(t *testing.T) {
+	m := NewMetrics()
+	d := &DummyCounter{
+		GenerateCounterFunc: func(ctx context.Context, spec CounterSpec) (string, error) {
+			return "3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e", nil
+		},
+		GetCounterFunc: func(ctx context.Context, id string) (CounterResult, error) {
+			return CounterResult{}, nil
+		},
+	}
+	c := NewController(d, ControllerConfig{Metrics: m})
+	for _, i := range []struct {
+		method string
+		path   string
+	}{
+		{http.MethodPost, "/counter?to=1000"},
+		{http.MethodPost, "/counter?to=1000"},
+		{http.MethodGet, "/counter/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e"},
+		{http.MethodGet, "/kenji"},
+	} {
+		req, _ := http.NewRequest(i.method, i.path, nil)
+		c.router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.httpRequests.WithLabelValues("POST", "/counter", "201")))
+	// The route label has the registered path, not the actual one.
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.httpRequests.WithLabelValues("GET", "/counter/:id", "404")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.httpRequests.WithLabelValues("GET", "unmatched", "404")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.countersCreated))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.countersNotFound))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/metrics", nil)
+	c.router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), "counterapi_counters_created_total 2"))
+}
+
+func TestInstrumentedDao(t *testing.T) {
+	m := NewMetrics()
+	d := &DummyDao{
+		GetFunc: func(ctx context.Context, key string) (string, error) {
+			return "", errors.New("some error")
+		},
+		ExistsFunc: func(ctx context.Context, key string) (int64, error) {
+			return 1, nil
+		},
+	}
+	i := NewInstrumentedDao(d, m)
+
+	_, err := i.Get(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	assert.Equal(t, errors.New("some error"), err)
+	existence, err := i.Exists(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	assert.Equal(t, int64(1), existence)
+	assert.Nil(t, err)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.daoOperationErrors.WithLabelValues("get")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(m.daoOperationErrors.WithLabelValues("exists")))
+	assert.Equal(t, 2, testutil.CollectAndCount(m.daoOperationDuration))
+}
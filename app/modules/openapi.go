@@ -0,0 +1,867 @@
+package modules
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const openAPIPath string = "/openapi.json"
+
+// openAPIDocument is the API contract. Every route of Controller has to be here, and the tests check it.
+// Requests are validated against it before they reach the handlers.
+const openAPIDocument = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "Counter API",
+    "version": "1.0.0",
+    "description": "The routes without /v1 are deprecated aliases of the /v1 routes. Their responses have Deprecation and Link headers."
+  },
+  "security": [{"APIKey": []}],
+  "paths": {
+    "/": {
+      "get": {
+        "security": [],
+        "summary": "Return the hostname of the replica",
+        "responses": {
+          "200": {"description": "Hostname", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Hostname"}}}}
+        }
+      }
+    },
+    "/healthz": {
+      "get": {
+        "security": [],
+        "summary": "Liveness probe. It doesn't depend on DB.",
+        "responses": {
+          "200": {"description": "Alive", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Status"}}}}
+        }
+      }
+    },
+    "/readyz": {
+      "get": {
+        "security": [],
+        "summary": "Readiness probe. It fails while DB is unavailable or the server is shutting down.",
+        "responses": {
+          "200": {"description": "Ready", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Status"}}}},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/metrics": {
+      "get": {
+        "security": [],
+        "summary": "Metrics in the Prometheus text format",
+        "responses": {
+          "200": {"description": "Metrics", "content": {"text/plain": {"schema": {"type": "string"}}}}
+        }
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "security": [],
+        "summary": "This document",
+        "responses": {
+          "200": {"description": "OpenAPI document", "content": {"application/json": {"schema": {"type": "object"}}}}
+        }
+      }
+    },
+    "/admin/apikey": {
+      "post": {
+        "summary": "Create an API key",
+        "description": "The key is returned only in this response. Disabled unless the admin token is configured.",
+        "security": [{"AdminToken": []}],
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/APIKeyName"}}}
+        },
+        "responses": {
+          "201": {"description": "Created", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/APIKey"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    },
+    "/admin/apikeys/{id}": {
+      "delete": {
+        "summary": "Revoke an API key",
+        "description": "The counters of the key are kept. Keys in the API keys file come back when it's loaded again unless they are removed from it. Disabled unless the admin token is configured.",
+        "security": [{"AdminToken": []}],
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "responses": {
+          "204": {"description": "Revoked"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    },
+    "/v1/counter": {
+      "get": {
+        "summary": "List counter IDs page by page",
+        "parameters": [
+          {"name": "cursor", "in": "query", "description": "next_cursor of the previous page", "schema": {"type": "string", "pattern": "^[0-9]+$"}},
+          {"name": "limit", "in": "query", "description": "Up to 1000", "schema": {"type": "integer", "minimum": 1, "default": 100}},
+          {"name": "label", "in": "query", "description": "Label selector like key=value. Multiple labels mean AND.", "schema": {"type": "array", "items": {"type": "string", "pattern": "^[^=]+="}}}
+        ],
+        "responses": {
+          "200": {"description": "Counter IDs", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CounterIDs"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      },
+      "post": {
+        "summary": "Generate a new counter",
+        "parameters": [
+          {"name": "to", "in": "query", "required": true, "description": "Target of the counter. In milliseconds with precision=ms.", "schema": {"type": "integer"}},
+          {"name": "mode", "in": "query", "schema": {"type": "string", "enum": ["countup", "countdown"], "default": "countup"}},
+          {"name": "precision", "in": "query", "schema": {"type": "string", "enum": ["s", "ms"], "default": "s"}},
+          {"name": "Idempotency-Key", "in": "header", "description": "Retries with the same key get the first response again without generating another counter", "schema": {"type": "string", "maxLength": 255}}
+        ],
+        "requestBody": {
+          "required": false,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CounterAttributes"}}}
+        },
+        "responses": {
+          "201": {"description": "Generated", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CounterID"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    },
+    "/v1/counter/batch": {
+      "post": {
+        "summary": "Generate counters at once",
+        "description": "Either all or none of them are generated. The number of counters is limited by the server.",
+        "parameters": [
+          {"name": "Idempotency-Key", "in": "header", "description": "Retries with the same key get the first response again without generating other counters", "schema": {"type": "string", "maxLength": 255}}
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/CounterSpec"}}}}
+        },
+        "responses": {
+          "201": {"description": "Generated in the same order", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CounterIDs"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    },
+    "/v1/counter/batch/stop": {
+      "post": {
+        "summary": "Stop counters at once by IDs or a label selector",
+        "description": "With the selector, counters up to the limit of the server are stopped, and more is true if there may be more of them.",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BatchStop"}}}
+        },
+        "responses": {
+          "200": {"description": "Result of each counter", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BatchStopResults"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    },
+    "/v1/counter/{id}": {
+      "get": {
+        "summary": "Return the counter",
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "responses": {
+          "200": {"description": "Counter", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Counter"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      },
+      "delete": {
+        "summary": "Stop and delete the counter, and return its final state",
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "responses": {
+          "200": {"description": "Counter just before it's deleted", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Counter"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    },
+    "/counter": {"$ref": "#/paths/~1v1~1counter"},
+    "/counter/batch": {"$ref": "#/paths/~1v1~1counter~1batch"},
+    "/counter/batch/stop": {"$ref": "#/paths/~1v1~1counter~1batch~1stop"},
+    "/counter/{id}": {"$ref": "#/paths/~1v1~1counter~1%7Bid%7D"},
+    "/counter/{id}/pause": {"$ref": "#/paths/~1v1~1counter~1%7Bid%7D~1pause"},
+    "/counter/{id}/resume": {"$ref": "#/paths/~1v1~1counter~1%7Bid%7D~1resume"},
+    "/counter/{id}/callback": {"$ref": "#/paths/~1v1~1counter~1%7Bid%7D~1callback"},
+    "/counter/{id}/stream": {"$ref": "#/paths/~1v1~1counter~1%7Bid%7D~1stream"},
+    "/watch": {"$ref": "#/paths/~1v1~1watch"},
+    "/counter/{id}/stop": {
+      "post": {
+        "summary": "Stop and delete the counter",
+        "description": "It returns 204 even if the counter doesn't exist. Use DELETE /v1/counter/{id} instead.",
+        "deprecated": true,
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "responses": {
+          "204": {"description": "Stopped"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    },
+    "/v1/counter/{id}/pause": {
+      "post": {
+        "summary": "Pause the counter",
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "responses": {
+          "200": {"description": "Counter", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Counter"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    },
+    "/v1/counter/{id}/resume": {
+      "post": {
+        "summary": "Resume the paused counter",
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "responses": {
+          "200": {"description": "Counter", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Counter"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    },
+    "/v1/counter/{id}/callback": {
+      "get": {
+        "summary": "Return the callback and its delivery status",
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "responses": {
+          "200": {"description": "Callback", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CallbackStatus"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    },
+    "/v1/counter/{id}/stream": {
+      "get": {
+        "summary": "Push the counter every second as Server-Sent Events",
+        "description": "\"tick\" events have the counter, and the stream ends with a \"completed\" or \"stopped\" event.",
+        "parameters": [{"$ref": "#/components/parameters/ID"}],
+        "responses": {
+          "200": {"description": "Event stream", "content": {"text/event-stream": {"schema": {"type": "string"}}}},
+          "401": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    },
+    "/v1/watch": {
+      "get": {
+        "summary": "Watch many counters over WebSocket",
+        "description": "Send {\"type\": \"subscribe\", \"ids\": [...]} or {\"type\": \"unsubscribe\", \"ids\": [...]}. The server sends {\"type\": \"update\", \"counters\": {...}, \"completed\": [...], \"deleted\": [...]} every second, or {\"type\": \"error\", \"error\": \"...\"} if the counters can't be looked up in that tick.",
+        "responses": {
+          "101": {"description": "Switching to WebSocket"},
+          "400": {"description": "Not a WebSocket handshake"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "APIKey": {"type": "apiKey", "in": "header", "name": "X-API-Key", "description": "Required only if API keys are enabled. Each key can only see its own counters."},
+      "AdminToken": {"type": "http", "scheme": "bearer"}
+    },
+    "parameters": {
+      "ID": {"name": "id", "in": "path", "required": true, "schema": {"type": "string", "format": "uuid", "pattern": "^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$"}}
+    },
+    "responses": {
+      "Error": {"description": "Error", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "Unavailable": {
+        "description": "DB didn't respond in time",
+        "headers": {"Retry-After": {"description": "Seconds until the request may be retried", "schema": {"type": "integer"}}},
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}
+      },
+      "TooManyRequests": {
+        "description": "Rate limited. Limited responses have RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers as well.",
+        "headers": {"Retry-After": {"description": "Seconds until the next request is allowed", "schema": {"type": "integer"}}},
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}
+      }
+    },
+    "schemas": {
+      "Error": {
+        "type": "object",
+        "required": ["error"],
+        "properties": {"error": {"type": "string"}}
+      },
+      "APIKeyName": {
+        "type": "object",
+        "required": ["name"],
+        "properties": {"name": {"type": "string", "maxLength": 64}}
+      },
+      "APIKey": {
+        "type": "object",
+        "required": ["id", "name", "api_key"],
+        "properties": {
+          "id": {"type": "string"},
+          "name": {"type": "string"},
+          "api_key": {"type": "string"}
+        }
+      },
+      "Hostname": {
+        "type": "object",
+        "required": ["hostname"],
+        "properties": {"hostname": {"type": "string"}}
+      },
+      "Status": {
+        "type": "object",
+        "required": ["status"],
+        "properties": {"status": {"type": "string"}}
+      },
+      "CounterID": {
+        "type": "object",
+        "required": ["id"],
+        "properties": {"id": {"type": "string"}}
+      },
+      "CounterIDs": {
+        "type": "object",
+        "required": ["ids"],
+        "properties": {
+          "ids": {"type": "array", "items": {"type": "string"}},
+          "next_cursor": {"type": "string", "description": "Omitted on the last page"}
+        }
+      },
+      "Labels": {
+        "type": "object",
+        "maxProperties": 32,
+        "additionalProperties": {"type": "string", "maxLength": 256}
+      },
+      "CounterAttributes": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string", "maxLength": 256},
+          "labels": {"$ref": "#/components/schemas/Labels"},
+          "callback": {"$ref": "#/components/schemas/Callback"}
+        }
+      },
+      "Callback": {
+        "type": "object",
+        "required": ["url"],
+        "properties": {
+          "url": {"type": "string", "description": "http or https URL POSTed when the counter reaches its target"},
+          "payload": {"description": "Any JSON sent back in the callback body"}
+        }
+      },
+      "CounterSpec": {
+        "type": "object",
+        "required": ["to"],
+        "properties": {
+          "to": {"type": "integer", "description": "Target of the counter. In milliseconds with precision ms."},
+          "mode": {"type": "string", "enum": ["countup", "countdown"]},
+          "precision": {"type": "string", "enum": ["s", "ms"]},
+          "name": {"type": "string", "maxLength": 256},
+          "labels": {"$ref": "#/components/schemas/Labels"},
+          "callback": {"$ref": "#/components/schemas/Callback"}
+        }
+      },
+      "BatchStop": {
+        "type": "object",
+        "description": "Either ids or labels",
+        "properties": {
+          "ids": {"type": "array", "items": {"type": "string"}},
+          "labels": {"$ref": "#/components/schemas/Labels"}
+        }
+      },
+      "BatchStopResults": {
+        "type": "object",
+        "required": ["results"],
+        "properties": {
+          "results": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "required": ["id", "status"],
+              "properties": {
+                "id": {"type": "string"},
+                "status": {"type": "string", "enum": ["stopped", "not_found"]}
+              }
+            }
+          },
+          "more": {"type": "boolean"}
+        }
+      },
+      "Counter": {
+        "type": "object",
+        "required": ["current", "to"],
+        "properties": {
+          "current": {"type": "integer"},
+          "to": {"type": "integer"},
+          "paused": {"type": "boolean"},
+          "mode": {"type": "string", "enum": ["countup", "countdown"]},
+          "precision": {"type": "string", "enum": ["s", "ms"]},
+          "name": {"type": "string"},
+          "labels": {"$ref": "#/components/schemas/Labels"}
+        }
+      },
+      "CallbackStatus": {
+        "type": "object",
+        "required": ["url", "status", "attempts"],
+        "properties": {
+          "url": {"type": "string"},
+          "status": {"type": "string", "enum": ["pending", "delivered", "failed"]},
+          "attempts": {"type": "integer"},
+          "last_error": {"type": "string"},
+          "delivered_at": {"type": "integer", "description": "Unix timestamp in milliseconds"}
+        }
+      }
+    }
+  }
+}`
+
+// The subset of OpenAPI used for validation
+type openAPISpec struct {
+	Paths      map[string]*openAPIPathItem `json:"paths"`
+	Components struct {
+		Parameters map[string]*openAPIParameter `json:"parameters"`
+		Responses  map[string]*openAPIResponse  `json:"responses"`
+		Schemas    map[string]*openAPISchema    `json:"schemas"`
+	} `json:"components"`
+}
+
+// Operations by method, or the reference to another path item like {"$ref": "#/paths/~1v1~1counter"}
+type openAPIPathItem struct {
+	Ref        string
+	Operations map[string]*openAPIOperation
+}
+
+func (p *openAPIPathItem) UnmarshalJSON(data []byte) error {
+	var ref struct {
+		Ref string `json:"$ref"`
+	}
+	if err := json.Unmarshal(data, &ref); err != nil {
+		return err
+	}
+	if ref.Ref != "" {
+		p.Ref = ref.Ref
+		return nil
+	}
+	return json.Unmarshal(data, &p.Operations)
+}
+
+type openAPIOperation struct {
+	Parameters  []*openAPIParameter `json:"parameters"`
+	RequestBody *struct {
+		Required bool                         `json:"required"`
+		Content  map[string]*openAPIMediaType `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]*openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Ref      string         `json:"$ref"`
+	Name     string         `json:"name"`
+	In       string         `json:"in"`
+	Required bool           `json:"required"`
+	Schema   *openAPISchema `json:"schema"`
+}
+
+type openAPIResponse struct {
+	Ref     string                       `json:"$ref"`
+	Content map[string]*openAPIMediaType `json:"content"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref"`
+	Type                 string                    `json:"type"`
+	Enum                 []string                  `json:"enum"`
+	Minimum              *float64                  `json:"minimum"`
+	MaxLength            *int                      `json:"maxLength"`
+	MaxProperties        *int                      `json:"maxProperties"`
+	Pattern              string                    `json:"pattern"`
+	Items                *openAPISchema            `json:"items"`
+	Required             []string                  `json:"required"`
+	Properties           map[string]*openAPISchema `json:"properties"`
+	AdditionalProperties *openAPISchema            `json:"additionalProperties"`
+	// Pattern compiled by mustParseOpenAPI
+	pattern *regexp.Regexp
+}
+
+var openAPI = mustParseOpenAPI(openAPIDocument)
+
+func mustParseOpenAPI(document string) *openAPISpec {
+	var spec openAPISpec
+	if err := json.Unmarshal([]byte(document), &spec); err != nil {
+		panic(fmt.Sprintf("invalid OpenAPI document: %s", err))
+	}
+	for path, item := range spec.Paths {
+		if item.Ref == "" {
+			continue
+		}
+		target, ok := spec.Paths[refPath(item.Ref)]
+		if !ok || target.Ref != "" {
+			panic(fmt.Sprintf("invalid OpenAPI document: %s refers to %s", path, item.Ref))
+		}
+		item.Operations = target.Operations
+	}
+	spec.compilePatterns()
+	return &spec
+}
+
+// Compile the patterns of all schemas once, rather than on every request.
+func (s *openAPISpec) compilePatterns() {
+	for _, item := range s.Paths {
+		for _, op := range item.Operations {
+			for _, p := range op.Parameters {
+				p.Schema.compilePatterns()
+			}
+			if op.RequestBody != nil {
+				for _, m := range op.RequestBody.Content {
+					m.Schema.compilePatterns()
+				}
+			}
+		}
+	}
+	for _, p := range s.Components.Parameters {
+		p.Schema.compilePatterns()
+	}
+	for _, sc := range s.Components.Schemas {
+		sc.compilePatterns()
+	}
+}
+
+func (sc *openAPISchema) compilePatterns() {
+	if sc == nil {
+		return
+	}
+	// Path items referring to others share the operations, so they can be visited twice
+	if sc.Pattern != "" && sc.pattern == nil {
+		p, err := regexp.Compile(sc.Pattern)
+		if err != nil {
+			panic(fmt.Sprintf("invalid OpenAPI document: %s", err))
+		}
+		sc.pattern = p
+	}
+	sc.Items.compilePatterns()
+	sc.AdditionalProperties.compilePatterns()
+	for _, child := range sc.Properties {
+		child.compilePatterns()
+	}
+}
+
+// Decode the path in the reference like "#/paths/~1v1~1counter~1%7Bid%7D" to "/v1/counter/{id}".
+func refPath(ref string) string {
+	p, err := url.PathUnescape(strings.TrimPrefix(ref, "#/paths/"))
+	if err != nil {
+		return ""
+	}
+	return strings.NewReplacer("~1", "/", "~0", "~").Replace(p)
+}
+
+var ginPathParamPattern = regexp.MustCompile(`:([^/]+)`)
+
+// Convert the Gin route like "/counter/:id" to the OpenAPI path like "/counter/{id}".
+func toOpenAPIPath(route string) string {
+	return ginPathParamPattern.ReplaceAllString(route, "{$1}")
+}
+
+// Return the operation of the route, or nil if it's not in the document.
+func (s *openAPISpec) operation(method string, route string) *openAPIOperation {
+	item, ok := s.Paths[toOpenAPIPath(route)]
+	if !ok {
+		return nil
+	}
+	return item.Operations[strings.ToLower(method)]
+}
+
+func (s *openAPISpec) parameter(p *openAPIParameter) *openAPIParameter {
+	if p.Ref != "" {
+		return s.Components.Parameters[strings.TrimPrefix(p.Ref, "#/components/parameters/")]
+	}
+	return p
+}
+
+func (s *openAPISpec) response(r *openAPIResponse) *openAPIResponse {
+	if r.Ref != "" {
+		return s.Components.Responses[strings.TrimPrefix(r.Ref, "#/components/responses/")]
+	}
+	return r
+}
+
+func (s *openAPISpec) schema(sc *openAPISchema) *openAPISchema {
+	if sc.Ref != "" {
+		return s.Components.Schemas[strings.TrimPrefix(sc.Ref, "#/components/schemas/")]
+	}
+	return sc
+}
+
+// Validate the query parameters and the JSON body of the request.
+// It returns the error which can be shown to users as it is.
+func (s *openAPISpec) validateRequest(op *openAPIOperation, req *http.Request, body []byte) error {
+	query := req.URL.Query()
+	for _, p := range op.Parameters {
+		p = s.parameter(p)
+		if p.In != "query" {
+			continue
+		}
+		values := query[p.Name]
+		// An empty value is regarded as missing
+		if len(values) == 0 || (len(values) == 1 && values[0] == "") {
+			if p.Required {
+				return fmt.Errorf("param %s is required", p.Name)
+			}
+			continue
+		}
+		sc := s.schema(p.Schema)
+		if sc.Type == "array" {
+			for _, v := range values {
+				if err := s.validateQueryValue(p.Name, s.schema(sc.Items), v); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := s.validateQueryValue(p.Name, sc, values[0]); err != nil {
+			return err
+		}
+	}
+
+	if op.RequestBody == nil || len(body) == 0 {
+		return nil
+	}
+	media, ok := op.RequestBody.Content["application/json"]
+	if !ok {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Errorf("the request body is invalid")
+	}
+	return s.validateValue("body", media.Schema, v)
+}
+
+// Names of the params in the errors, if they differ from the params. "to" has been called "value" since the first version.
+var queryErrorNames = map[string]string{toQueryKey: "value"}
+
+func (s *openAPISpec) validateQueryValue(name string, sc *openAPISchema, value string) error {
+	if len(sc.Enum) > 0 {
+		for _, e := range sc.Enum {
+			if value == e {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s must be %s", name, strings.Join(sc.Enum, " or "))
+	}
+	errorName := name
+	if n, ok := queryErrorNames[name]; ok {
+		errorName = n
+	}
+	invalid := fmt.Errorf("the %s %s is invalid", errorName, value)
+	switch sc.Type {
+	case "integer":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || (sc.Minimum != nil && float64(n) < *sc.Minimum) {
+			return invalid
+		}
+	case "string":
+		if sc.pattern != nil && !sc.pattern.MatchString(value) {
+			return invalid
+		}
+	}
+	return nil
+}
+
+// Validate the value decoded from JSON against the schema. name is the path to the value shown in the error.
+func (s *openAPISpec) validateValue(name string, sc *openAPISchema, value interface{}) error {
+	sc = s.schema(sc)
+	if len(sc.Enum) > 0 {
+		str, _ := value.(string)
+		for _, e := range sc.Enum {
+			if str == e {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s must be %s", name, strings.Join(sc.Enum, " or "))
+	}
+	switch sc.Type {
+	case "object":
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an object", name)
+		}
+		if sc.MaxProperties != nil && len(m) > *sc.MaxProperties {
+			return fmt.Errorf("%s must have at most %d entries", name, *sc.MaxProperties)
+		}
+		for _, r := range sc.Required {
+			if _, ok := m[r]; !ok {
+				return fmt.Errorf("%s is required", joinName(name, r))
+			}
+		}
+		for k, v := range m {
+			child, ok := sc.Properties[k]
+			if !ok {
+				child = sc.AdditionalProperties
+			}
+			if child == nil {
+				continue
+			}
+			if err := s.validateValue(joinName(name, k), child, v); err != nil {
+				return err
+			}
+		}
+	case "array":
+		a, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an array", name)
+		}
+		for i, v := range a {
+			if err := s.validateValue(fmt.Sprintf("%s[%d]", name, i), sc.Items, v); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string", name)
+		}
+		if sc.MaxLength != nil && len(str) > *sc.MaxLength {
+			return fmt.Errorf("%s must be at most %d characters", name, *sc.MaxLength)
+		}
+	case "integer":
+		n, ok := value.(float64)
+		if !ok || n != float64(int64(n)) {
+			return fmt.Errorf("%s must be an integer", name)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s must be a boolean", name)
+		}
+	}
+	return nil
+}
+
+// Validate the status code and the JSON body of the response.
+func (s *openAPISpec) validateResponse(op *openAPIOperation, status int, body []byte) error {
+	res, ok := op.Responses[strconv.Itoa(status)]
+	if !ok {
+		return fmt.Errorf("status %d is not documented", status)
+	}
+	media, ok := s.response(res).Content["application/json"]
+	if !ok {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return err
+	}
+	return s.validateValue("body", media.Schema, v)
+}
+
+// The top level is omitted, so that errors read like "labels.team must be ..."
+func joinName(parent string, child string) string {
+	if parent == "body" {
+		return child
+	}
+	return parent + "." + child
+}
+
+// Return 400 if the request doesn't follow the OpenAPI document.
+// Routes which are not in the document are passed through.
+func (c *Controller) openAPIValidationMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		op := openAPI.operation(ctx.Request.Method, requestRoute(ctx))
+		if op == nil {
+			ctx.Next()
+			return
+		}
+		var body []byte
+		if op.RequestBody != nil && ctx.Request.Body != nil {
+			var err error
+			body, err = ioutil.ReadAll(ctx.Request.Body)
+			if err != nil {
+				ctx.AbortWithStatusJSON(http.StatusBadRequest, errorFormatter("the request body is invalid"))
+				return
+			}
+			// Let the handler read it again
+			ctx.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		if err := openAPI.validateRequest(op, ctx.Request, body); err != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, errorFormatter(err.Error()))
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// Called with every response which doesn't follow the OpenAPI document.
+// Only tests set it, so that the document can't drift from the handlers. Responses aren't checked in production.
+var onInvalidResponse func(method string, route string, err error)
+
+// Check the JSON responses of the routes in the document, and report ones which don't follow it to onInvalidResponse.
+func openAPIResponseValidationMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		// WebSocket connections are hijacked, so there is no response to check
+		if ctx.IsWebsocket() {
+			ctx.Next()
+			return
+		}
+		w := &recordingResponseWriter{ResponseWriter: ctx.Writer}
+		ctx.Writer = w
+		ctx.Next()
+
+		op := openAPI.operation(ctx.Request.Method, requestRoute(ctx))
+		// Streams are documented as text/event-stream, which isn't a single document to check
+		if op == nil || strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+			return
+		}
+		if err := openAPI.validateResponse(op, w.Status(), w.body.Bytes()); err != nil {
+			onInvalidResponse(ctx.Request.Method, requestRoute(ctx), err)
+		}
+	}
+}
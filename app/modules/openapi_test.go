@@ -0,0 +1,206 @@
+package modules
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Check every response of Controller in the tests against the OpenAPI document, and fail if any doesn't follow it
+func TestMain(m *testing.M) {
+	var mu sync.Mutex
+	var invalid []string
+	onInvalidResponse = func(method string, route string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		invalid = append(invalid, fmt.Sprintf("%s %s: %v", method, route, err))
+	}
+	code := m.Run()
+	for _, s := range invalid {
+		fmt.Fprintln(os.Stderr, "response doesn't follow the OpenAPI document:", s)
+	}
+	if code == 0 && len(invalid) > 0 {
+		code = 1
+	}
+	os.Exit(code)
+}
+
+// Every route of Controller is in the OpenAPI document and vice versa
+func TestOpenAPIRoutesMatchController(t *testing.T) {
+	c := NewController(&DummyCounter{}, ControllerConfig{})
+	var routes []string
+	for _, r := range c.router.Routes() {
+		// The batch routes are served by the ID routes
+		if batch, ok := batchRoutes[r.Path]; ok && r.Method == http.MethodPost {
+			routes = append(routes, r.Method+" "+batch)
+			// Some of them serve only the batch routes
+			if r.Path != counterPath+"/:id"+stopPath {
+				continue
+			}
+		}
+		routes = append(routes, r.Method+" "+toOpenAPIPath(r.Path))
+	}
+	var documented []string
+	for path, item := range openAPI.Paths {
+		for method := range item.Operations {
+			documented = append(documented, strings.ToUpper(method)+" "+path)
+		}
+	}
+	sort.Strings(routes)
+	sort.Strings(documented)
+	assert.Equal(t, documented, routes)
+}
+
+// tests of GET /openapi.json
+func TestRouterOpenAPIDocument(t *testing.T) {
+	c := NewController(&DummyCounter{}, ControllerConfig{})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/openapi.json", nil)
+	c.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var document map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &document))
+	assert.Equal(t, "3.0.3", document["openapi"])
+}
+
+// Requests which don't follow the document never reach the handlers
+func TestOpenAPIValidationMiddleware(t *testing.T) {
+	tests := []struct {
+		method       string
+		path         string
+		body         string
+		expectedBody string
+	}{
+		{http.MethodPost, "/counter?to=10&precision=ns", "", "{\"error\":\"precision must be s or ms\"}"},
+		{http.MethodPost, "/counter?to=10", "{\"name\":1}", "{\"error\":\"name must be a string\"}"},
+		{http.MethodPost, "/counter?to=10", "{\"name\":\"" + strings.Repeat("a", 257) + "\"}", "{\"error\":\"name must be at most 256 characters\"}"},
+		{http.MethodPost, "/counter?to=10", "{\"labels\":{\"team\":1}}", "{\"error\":\"labels.team must be a string\"}"},
+		{http.MethodPost, "/counter?to=10", "{\"labels\":[]}", "{\"error\":\"labels must be an object\"}"},
+		{http.MethodPost, "/counter?to=10", "{\"callback\":{}}", "{\"error\":\"callback.url is required\"}"},
+		{http.MethodPost, "/counter?to=10", "[]", "{\"error\":\"body must be an object\"}"},
+		{http.MethodPost, "/counter?to=kondokenji", "", "{\"error\":\"the value kondokenji is invalid\"}"},
+		{http.MethodGet, "/counter?limit=x", "", "{\"error\":\"the limit x is invalid\"}"},
+		{http.MethodGet, "/counter?label=team&label=a=b", "", "{\"error\":\"the label team is invalid\"}"},
+	}
+	for _, tt := range tests {
+		// The handlers must not be called
+		c := NewController(&DummyCounter{}, ControllerConfig{})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		c.router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, tt.path+" "+tt.body)
+		assert.Equal(t, tt.expectedBody, w.Body.String(), tt.path+" "+tt.body)
+	}
+}
+
+// Unauthenticated and rate limited requests are rejected before they are validated
+func TestOpenAPIValidationAfterAuth(t *testing.T) {
+	dao := NewMemoryStore()
+	c := NewController(&DummyCounter{}, ControllerConfig{APIKeys: newTestAPIKeyStore(t, dao, ""), RateLimiter: NewRateLimiter(dao, 1, 1)})
+	assert.Equal(t, http.StatusUnauthorized, requestWithAPIKey(c, http.MethodGet, "/v1/counter?limit=x", "").Code)
+	assert.Equal(t, http.StatusBadRequest, requestWithAPIKey(c, http.MethodGet, "/v1/counter?limit=x", "key-a").Code)
+	assert.Equal(t, http.StatusTooManyRequests, requestWithAPIKey(c, http.MethodGet, "/v1/counter?limit=x", "key-a").Code)
+}
+
+// The patterns are compiled when the document is parsed
+func TestOpenAPIPatternsCompiled(t *testing.T) {
+	sc := openAPI.schema(openAPI.operation(http.MethodGet, "/v1/counter").Parameters[0].Schema)
+	assert.Equal(t, "^[0-9]+$", sc.Pattern)
+	assert.NotNil(t, sc.pattern)
+	assert.Panics(t, func() {
+		mustParseOpenAPI(`{"paths": {"/a": {"get": {"parameters": [{"name": "a", "in": "query", "schema": {"type": "string", "pattern": "("}}]}}}}`)
+	})
+}
+
+// Responses of the handlers follow the document
+func TestOpenAPIResponses(t *testing.T) {
+	counter := CounterResult{Current: 3, To: 10, Mode: CounterModeCountDown, Name: "deploy", Labels: map[string]string{"team": "payments"}, counterExistence: true}
+	d := &DummyCounter{
+		GenerateCounterFunc: func(ctx context.Context, spec CounterSpec) (string, error) {
+			return "3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e", nil
+		},
+		GetCounterFunc: func(ctx context.Context, id string) (CounterResult, error) {
+			if id == "3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e" {
+				return counter, nil
+			}
+			return CounterResult{}, nil
+		},
+		ListCountersFunc: func(ctx context.Context, owner string, labels map[string]string, cursor uint64, limit int64) ([]string, uint64, error) {
+			if len(labels) > 0 {
+				return []string{}, 0, nil
+			}
+			return []string{"3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e"}, 7, nil
+		},
+		DeleteCounterFunc: func(ctx context.Context, id string) (CounterResult, error) {
+			if id == "xyz" {
+				return CounterResult{}, nil
+			}
+			return CounterResult{Current: 3, To: 10, counterExistence: true}, nil
+		},
+		PauseCounterFunc: func(ctx context.Context, id string) (CounterResult, error) {
+			paused := counter
+			paused.Paused = true
+			return paused, nil
+		},
+		ResumeCounterFunc: func(ctx context.Context, id string) (CounterResult, error) {
+			return CounterResult{}, nil
+		},
+		GetCallbackStatusFunc: func(ctx context.Context, id string) (CallbackRecord, bool, error) {
+			return CallbackRecord{URL: "https://example.com/hook", Status: CallbackStatusDelivered, Attempts: 1, DeliveredAt: 1}, true, nil
+		},
+		PingFunc: func(ctx context.Context) error {
+			return nil
+		},
+	}
+	c := NewController(d, ControllerConfig{Hostname: "host"})
+	requests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{http.MethodGet, "/", ""},
+		{http.MethodGet, "/healthz", ""},
+		{http.MethodGet, "/readyz", ""},
+		{http.MethodGet, "/counter", ""},
+		{http.MethodGet, "/counter?label=team=payments", ""},
+		{http.MethodGet, "/counter?cursor=x", ""},
+		{http.MethodPost, "/counter?to=10", "{\"name\":\"deploy\",\"labels\":{\"team\":\"payments\"}}"},
+		{http.MethodPost, "/counter?to=10", "{\"callback\":{\"url\":\"ftp://example.com\"}}"},
+		{http.MethodGet, "/counter/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e", ""},
+		{http.MethodGet, "/counter/xyz", ""},
+		{http.MethodPost, "/counter/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e/pause", ""},
+		{http.MethodPost, "/counter/xyz/resume", ""},
+		{http.MethodGet, "/counter/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e/callback", ""},
+		{http.MethodPost, "/counter/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e/stop", ""},
+		{http.MethodGet, "/v1/counter/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e", ""},
+		{http.MethodDelete, "/v1/counter/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e", ""},
+		{http.MethodDelete, "/v1/counter/xyz", ""},
+	}
+	for _, r := range requests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(r.method, r.path, strings.NewReader(r.body))
+		c.router.ServeHTTP(w, req)
+		route := strings.SplitN(r.path, "?", 2)[0]
+		route = strings.Replace(route, "3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e", ":id", 1)
+		route = strings.Replace(route, "xyz", ":id", 1)
+		assert.NoError(t, validateResponse(r.method, route, w), r.method+" "+r.path)
+	}
+}
+
+// Check that the status code is documented and the JSON body follows its schema.
+func validateResponse(method string, route string, w *httptest.ResponseRecorder) error {
+	op := openAPI.operation(method, route)
+	if op == nil {
+		return fmt.Errorf("%s %s is not documented", method, route)
+	}
+	return openAPI.validateResponse(op, w.Code, w.Body.Bytes())
+}
@@ -0,0 +1,167 @@
+package modules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	rateLimitKeyPrefix       string = "ratelimit:"
+	rateLimitLimitHeader     string = "RateLimit-Limit"
+	rateLimitRemainingHeader string = "RateLimit-Remaining"
+	rateLimitResetHeader     string = "RateLimit-Reset"
+	retryAfterHeader         string = "Retry-After"
+	rateLimitScopeCreate     string = "create"
+	rateLimitScopeRead       string = "read"
+	rateLimitPeriod                 = time.Minute
+)
+
+// RateLimiter limits requests per client with token buckets in DB, so that the limits are shared among replicas.
+// Each client has a bucket per scope. It's refilled continuously, and holds at most the limit of tokens.
+type RateLimiter struct {
+	dao Dao
+	// Requests per minute by scope. 0 means unlimited.
+	limits map[string]int64
+	period time.Duration
+}
+
+// Initialize RateLimiter. createPerMinute limits the requests generating counters, and readPerMinute limits the other
+// counter requests. 0 means unlimited.
+func NewRateLimiter(dao Dao, createPerMinute int64, readPerMinute int64) *RateLimiter {
+	return &RateLimiter{
+		dao: dao,
+		limits: map[string]int64{
+			rateLimitScopeCreate: createPerMinute,
+			rateLimitScopeRead:   readPerMinute,
+		},
+		period: rateLimitPeriod,
+	}
+}
+
+// RateLimitResult is the state of the bucket after a request.
+type RateLimitResult struct {
+	Allowed bool
+	Limit   int64
+	// Tokens left after the request
+	Remaining int64
+	// Until the bucket is full again
+	Reset time.Duration
+	// Until the next request is allowed. 0 if it's allowed now.
+	RetryAfter time.Duration
+}
+
+// Take count tokens from the bucket of the client in the scope. More than the limit takes the whole bucket.
+// The second returned value is false if the scope is unlimited.
+func (l *RateLimiter) Take(ctx context.Context, scope string, client string, count int64) (RateLimitResult, bool, error) {
+	limit := l.limits[scope]
+	if limit <= 0 {
+		return RateLimitResult{}, false, nil
+	}
+	// Otherwise it could never be allowed
+	if count > limit {
+		count = limit
+	}
+	allowed, tokens, err := l.dao.TakeToken(ctx, rateLimitKeyPrefix+scope+":"+client, limit, l.period.Milliseconds(), count)
+	if err != nil {
+		return RateLimitResult{}, true, err
+	}
+	// Time to get one token
+	interval := float64(l.period) / float64(limit)
+	r := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     limit,
+		Remaining: int64(math.Floor(tokens)),
+		Reset:     time.Duration((float64(limit) - tokens) * interval),
+	}
+	if !allowed {
+		r.RetryAfter = time.Duration((float64(count) - tokens) * interval)
+	}
+	return r, true, nil
+}
+
+// Return 429 with "Retry-After" if the client has run out of its limit.
+// Every limited response has "RateLimit-Limit", "RateLimit-Remaining" and "RateLimit-Reset" headers.
+// Requests are let through if DB fails, so that the limiter never takes the API down by itself.
+func (c *Controller) rateLimitMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if c.rateLimiter == nil {
+			ctx.Next()
+			return
+		}
+		reqCtx, cancel := c.requestContext(ctx)
+		r, limited, err := c.rateLimiter.Take(reqCtx, rateLimitScope(ctx), c.rateLimitClient(ctx), c.rateLimitCost(ctx))
+		cancel()
+		if err != nil {
+			logRequestError(ctx, err)
+			ctx.Next()
+			return
+		}
+		if !limited {
+			ctx.Next()
+			return
+		}
+		ctx.Header(rateLimitLimitHeader, strconv.FormatInt(r.Limit, 10))
+		ctx.Header(rateLimitRemainingHeader, strconv.FormatInt(r.Remaining, 10))
+		ctx.Header(rateLimitResetHeader, strconv.FormatInt(ceilSeconds(r.Reset), 10))
+		if !r.Allowed {
+			c.metrics.rateLimited.WithLabelValues(rateLimitScope(ctx)).Inc()
+			ctx.Header(retryAfterHeader, strconv.FormatInt(ceilSeconds(r.RetryAfter), 10))
+			ctx.AbortWithStatusJSON(http.StatusTooManyRequests, errorFormatter(fmt.Sprintf("too many requests, retry after %d seconds", ceilSeconds(r.RetryAfter))))
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// Requests generating counters are limited separately from the others.
+// The "/v1" routes share the limits with their aliases.
+func rateLimitScope(ctx *gin.Context) string {
+	route := strings.TrimPrefix(requestRoute(ctx), v1Path)
+	if ctx.Request.Method == http.MethodPost && (route == counterPath || route == counterPath+batchPath) {
+		return rateLimitScopeCreate
+	}
+	return rateLimitScopeRead
+}
+
+// Batches take a token per counter, so that they can't get around the limit of "POST /counter".
+// Invalid bodies take one token, since the handler rejects them.
+func (c *Controller) rateLimitCost(ctx *gin.Context) int64 {
+	route := strings.TrimPrefix(requestRoute(ctx), v1Path)
+	if ctx.Request.Method != http.MethodPost || route != counterPath+batchPath || ctx.Request.Body == nil {
+		return 1
+	}
+	body, err := ioutil.ReadAll(ctx.Request.Body)
+	if err != nil {
+		return 1
+	}
+	// Leave the body for the handler
+	ctx.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	var specs []json.RawMessage
+	if err := json.Unmarshal(body, &specs); err != nil || len(specs) == 0 || len(specs) > c.maxBatchSize {
+		return 1
+	}
+	return int64(len(specs))
+}
+
+// Clients are identified by their API keys, or by their IP addresses if API keys are disabled.
+func (c *Controller) rateLimitClient(ctx *gin.Context) string {
+	if owner := requestOwner(ctx); owner != "" {
+		return "key=" + owner
+	}
+	return "ip=" + c.clientIP(ctx)
+}
+
+// Round up, so that clients never retry too early
+func ceilSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,248 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"counterapi/pb"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func requestFrom(c *Controller, method string, path string, ip string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, nil)
+	req.RemoteAddr = ip + ":12345"
+	c.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestRouterRateLimit(t *testing.T) {
+	now := time.Unix(1000, 0)
+	dao := newMemoryStore(func() time.Time { return now })
+	c := NewController(NewCounterCalculator(dao), ControllerConfig{RateLimiter: NewRateLimiter(dao, 2, 3)})
+
+	w := requestFrom(c, http.MethodPost, "/counter?to=1000", "10.0.0.1")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "2", w.Header().Get(rateLimitLimitHeader))
+	assert.Equal(t, "1", w.Header().Get(rateLimitRemainingHeader))
+	// A token comes back every 30 seconds
+	assert.Equal(t, "30", w.Header().Get(rateLimitResetHeader))
+	assert.Equal(t, http.StatusCreated, requestFrom(c, http.MethodPost, "/counter?to=1000", "10.0.0.1").Code)
+
+	w = requestFrom(c, http.MethodPost, "/counter?to=1000", "10.0.0.1")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "30", w.Header().Get(retryAfterHeader))
+	assert.Equal(t, "0", w.Header().Get(rateLimitRemainingHeader))
+	assert.Equal(t, "{\"error\":\"too many requests, retry after 30 seconds\"}", w.Body.String())
+	assert.NoError(t, validateResponse(http.MethodPost, counterPath, w))
+
+	// Reads and other clients have their own limits
+	w = requestFrom(c, http.MethodGet, "/counter", "10.0.0.1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "3", w.Header().Get(rateLimitLimitHeader))
+	assert.Equal(t, http.StatusCreated, requestFrom(c, http.MethodPost, "/counter?to=1000", "10.0.0.2").Code)
+
+	// Routes other than the counter API are not limited
+	w = requestFrom(c, http.MethodGet, "/healthz", "10.0.0.1")
+	assert.Equal(t, "", w.Header().Get(rateLimitLimitHeader))
+
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, http.StatusCreated, requestFrom(c, http.MethodPost, "/counter?to=1000", "10.0.0.1").Code)
+	assert.Equal(t, http.StatusTooManyRequests, requestFrom(c, http.MethodPost, "/counter?to=1000", "10.0.0.1").Code)
+}
+
+// Rate limit buckets can't be deleted through the counter routes to reset the limit
+func TestRouterRateLimitBucketNotStoppable(t *testing.T) {
+	dao := newMemoryStore(time.Now)
+	c := NewController(NewCounterCalculator(dao), ControllerConfig{RateLimiter: NewRateLimiter(dao, 1, 100)})
+
+	assert.Equal(t, http.StatusCreated, requestFrom(c, http.MethodPost, "/counter?to=10", "1.2.3.4").Code)
+	for i := 0; i < 2; i++ {
+		w := requestFrom(c, http.MethodPost, "/counter/ratelimit:create:ip=1.2.3.4/stop", "1.2.3.4")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.NoError(t, validateResponse(http.MethodPost, counterPath+"/:id"+stopPath, w))
+		assert.Equal(t, http.StatusTooManyRequests, requestFrom(c, http.MethodPost, "/counter?to=10", "1.2.3.4").Code)
+	}
+	assert.Equal(t, http.StatusNotFound, requestFrom(c, http.MethodGet, "/v1/counter/ratelimit:create:ip=1.2.3.4", "1.2.3.4").Code)
+	assert.Equal(t, http.StatusNotFound, requestFrom(c, http.MethodPost, "/v1/counter/ratelimit:create:ip=1.2.3.4/pause", "1.2.3.4").Code)
+	_, err := dao.Get(context.Background(), "ratelimit:create:ip=1.2.3.4")
+	assert.NoError(t, err)
+}
+
+// Batches take a token per counter
+func TestRouterRateLimitBatch(t *testing.T) {
+	now := time.Unix(1000, 0)
+	dao := newMemoryStore(func() time.Time { return now })
+	c := NewController(NewCounterCalculator(dao), ControllerConfig{RateLimiter: NewRateLimiter(dao, 5, 0), MaxBatchSize: 10})
+	createBatch := func(n int) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		body := "[" + strings.TrimSuffix(strings.Repeat(`{"to": 60},`, n), ",") + "]"
+		req, _ := http.NewRequest(http.MethodPost, "/v1/counter/batch", strings.NewReader(body))
+		req.RemoteAddr = "10.0.0.1:12345"
+		c.router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := createBatch(3)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "2", w.Header().Get(rateLimitRemainingHeader))
+	// Nothing is taken if the bucket doesn't have enough tokens. A token comes back every 12 seconds.
+	w = createBatch(3)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "12", w.Header().Get(retryAfterHeader))
+	assert.NoError(t, validateResponse(http.MethodPost, counterPath+batchPath, w))
+	w = createBatch(2)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "0", w.Header().Get(rateLimitRemainingHeader))
+	assert.Equal(t, http.StatusTooManyRequests, requestFrom(c, http.MethodPost, "/counter?to=1000", "10.0.0.1").Code)
+
+	// Larger than the limit takes the whole bucket
+	now = now.Add(time.Minute)
+	w = createBatch(8)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "0", w.Header().Get(rateLimitRemainingHeader))
+	// Invalid bodies take one token
+	now = now.Add(time.Minute)
+	w = createBatch(11)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "4", w.Header().Get(rateLimitRemainingHeader))
+}
+
+// Clients are identified by their API keys rather than IP addresses
+func TestRouterRateLimitByAPIKey(t *testing.T) {
+	dao := NewMemoryStore()
+	c := NewController(NewCounterCalculator(dao), ControllerConfig{APIKeys: newTestAPIKeyStore(t, dao, ""), RateLimiter: NewRateLimiter(dao, 0, 1)})
+	assert.Equal(t, http.StatusOK, requestWithAPIKey(c, http.MethodGet, "/counter", "key-a").Code)
+	assert.Equal(t, http.StatusTooManyRequests, requestWithAPIKey(c, http.MethodGet, "/counter", "key-a").Code)
+	assert.Equal(t, http.StatusOK, requestWithAPIKey(c, http.MethodGet, "/counter", "key-b").Code)
+
+	// Creation is unlimited with 0
+	w := requestWithAPIKey(c, http.MethodPost, "/counter?to=1000", "key-a")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "", w.Header().Get(rateLimitLimitHeader))
+}
+
+// Requests are let through if DB fails
+func TestRouterRateLimitDBError(t *testing.T) {
+	dao := &DummyDao{TakeTokenFunc: func(ctx context.Context, key string, capacity int64, periodMillisecond int64, count int64) (bool, float64, error) {
+		return false, 0, errors.New("error")
+	}}
+	d := &DummyCounter{ListCountersFunc: func(ctx context.Context, owner string, labels map[string]string, cursor uint64, limit int64) ([]string, uint64, error) {
+		return []string{}, 0, nil
+	}}
+	c := NewController(d, ControllerConfig{RateLimiter: NewRateLimiter(dao, 1, 1)})
+	w := requestFrom(c, http.MethodGet, "/counter", "10.0.0.1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "", w.Header().Get(rateLimitLimitHeader))
+}
+
+// gRPC takes tokens from the same buckets, and gets RESOURCE_EXHAUSTED over the limit
+func TestGRPCRateLimit(t *testing.T) {
+	now := time.Unix(1000, 0)
+	dao := newMemoryStore(func() time.Time { return now })
+	client, stop := newTestGRPCClient(t, NewGRPCServer(NewCounterCalculator(dao), "", nil, NewRateLimiter(dao, 1, 2), NewMetrics(), 0))
+	defer stop()
+	ctx := context.Background()
+
+	created, err := client.CreateCounter(ctx, &pb.CreateCounterRequest{To: 1000})
+	assert.NoError(t, err)
+	var header metadata.MD
+	_, err = client.CreateCounter(ctx, &pb.CreateCounterRequest{To: 1000}, grpc.Header(&header))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, "too many requests, retry after 60 seconds", status.Convert(err).Message())
+	assert.Equal(t, []string{"60"}, header.Get("retry-after"))
+
+	// The other RPCs share the read limit, including the stream
+	_, err = client.GetCounter(ctx, &pb.GetCounterRequest{Id: created.Id})
+	assert.NoError(t, err)
+	_, err = client.ListCounters(ctx, &pb.ListCountersRequest{})
+	assert.NoError(t, err)
+	stream, err := client.WatchCounter(ctx, &pb.WatchCounterRequest{Id: created.Id})
+	assert.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	now = now.Add(time.Minute)
+	_, err = client.CreateCounter(ctx, &pb.CreateCounterRequest{To: 1000})
+	assert.NoError(t, err)
+}
+
+func TestGRPCRateLimitClient(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 12345}
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want string
+	}{
+		{"peer", peer.NewContext(context.Background(), &peer.Peer{Addr: addr}), "ip=10.0.0.1"},
+		{"API key", context.WithValue(peer.NewContext(context.Background(), &peer.Peer{Addr: addr}), grpcOwnerKey{}, "key-a"), "key=key-a"},
+		{"no peer", context.Background(), "ip="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, grpcRateLimitClient(tt.ctx))
+		})
+	}
+}
+
+func TestRateLimiterKeys(t *testing.T) {
+	var keys []string
+	dao := &DummyDao{TakeTokenFunc: func(ctx context.Context, key string, capacity int64, periodMillisecond int64, count int64) (bool, float64, error) {
+		keys = append(keys, key)
+		assert.Equal(t, int64(60000), periodMillisecond)
+		return true, 0, nil
+	}}
+	l := NewRateLimiter(dao, 1, 1)
+	_, limited, err := l.Take(context.Background(), rateLimitScopeCreate, "ip=10.0.0.1", 1)
+	assert.NoError(t, err)
+	assert.True(t, limited)
+	_, _, _ = l.Take(context.Background(), rateLimitScopeRead, "key=a", 1)
+	assert.Equal(t, []string{"ratelimit:create:ip=10.0.0.1", "ratelimit:read:key=a"}, keys)
+}
+
+// Clients can't pretend to be others with "X-Forwarded-For". Only the header of the reverse proxy is trusted.
+func TestRouterRateLimitClientIP(t *testing.T) {
+	tests := []struct {
+		name           string
+		clientIPHeader string
+		headers        map[string]string
+		expectedKey    string
+	}{
+		{"peer", "", nil, "ratelimit:read:ip=10.0.0.1"},
+		{"spoofed forwarded-for", "", map[string]string{"X-Forwarded-For": "10.0.0.2"}, "ratelimit:read:ip=10.0.0.1"},
+		{"spoofed real-ip", "", map[string]string{"X-Real-IP": "10.0.0.2"}, "ratelimit:read:ip=10.0.0.1"},
+		{"proxy", "X-Real-IP", map[string]string{"X-Real-IP": "10.0.0.2", "X-Forwarded-For": "10.0.0.3"}, "ratelimit:read:ip=10.0.0.2"},
+		{"proxy without the header", "X-Real-IP", nil, "ratelimit:read:ip=10.0.0.1"},
+	}
+	for _, tt := range tests {
+		var keys []string
+		dao := &DummyDao{TakeTokenFunc: func(ctx context.Context, key string, capacity int64, periodMillisecond int64, count int64) (bool, float64, error) {
+			keys = append(keys, key)
+			return true, 1, nil
+		}}
+		d := &DummyCounter{ListCountersFunc: func(ctx context.Context, owner string, labels map[string]string, cursor uint64, limit int64) ([]string, uint64, error) {
+			return []string{}, 0, nil
+		}}
+		c := NewController(d, ControllerConfig{ClientIPHeader: tt.clientIPHeader, RateLimiter: NewRateLimiter(dao, 1, 1)})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/v1/counter", nil)
+		req.RemoteAddr = "10.0.0.1:12345"
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+		c.router.ServeHTTP(w, req)
+		assert.Equal(t, []string{tt.expectedKey}, keys, tt.name)
+	}
+}
@@ -0,0 +1,107 @@
+package modules
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	streamEventTick      string = "tick"
+	streamEventCompleted string = "completed"
+	streamEventStopped   string = "stopped"
+	streamEventError     string = "error"
+)
+
+const defaultStreamTickInterval = time.Second
+
+// Push the progress of the counter as Server-Sent Events against "GET /counter/:id/stream".
+// It sends a "tick" event with the counter every tick, and finally "completed" or "stopped" when the counter disappears.
+// It returns when the client disconnects or the server shuts down as well.
+func (c *Controller) streamCounter(ctx *gin.Context) {
+	id := ctx.Params.ByName("id")
+	reqCtx, cancel := c.requestContext(ctx)
+	r, err := c.counter.GetCounter(reqCtx, id)
+	cancel()
+
+	// Return 500 if internal error occurs
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	// Return 404 if such counter doesn't exist.
+	if !r.counterExistence {
+		c.metrics.countersNotFound.Inc()
+		ctx.JSON(http.StatusNotFound, errorFormatter(fmt.Sprintf("no such counter with %s", id)))
+		return
+	}
+
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	// Let Nginx pass events through without buffering
+	ctx.Header("X-Accel-Buffering", "no")
+	ctx.Status(http.StatusOK)
+
+	ticker := time.NewTicker(c.streamTickInterval)
+	defer ticker.Stop()
+	for {
+		ctx.SSEvent(streamEventTick, r)
+		ctx.Writer.Flush()
+
+		select {
+		case <-ctx.Request.Context().Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Let the client reconnect to another replica rather than holding up the shutdown
+		if atomic.LoadInt32(&c.draining) == 1 {
+			return
+		}
+
+		last := r
+		// Every tick has its own timeout, as the stream lasts longer than the request timeout
+		reqCtx, cancel = c.requestContext(ctx)
+		r, err = c.counter.GetCounter(reqCtx, id)
+		cancel()
+		if err != nil {
+			logRequestError(ctx, err)
+			ctx.SSEvent(streamEventError, errorFormatter(http.StatusText(http.StatusInternalServerError)))
+			return
+		}
+		if !r.counterExistence {
+			event := streamEventStopped
+			if hasCompleted(last, c.streamTickInterval) {
+				event = streamEventCompleted
+			}
+			ctx.SSEvent(event, gin.H{"id": id})
+			return
+		}
+	}
+}
+
+// Tell whether the disappeared counter has completed, given the last state seen one tick before.
+// The counter which was about to end has completed, otherwise it has been stopped.
+func hasCompleted(last CounterResult, tick time.Duration) bool {
+	return !last.Paused && remaining(last) <= tickInUnit(tick, last.Precision)
+}
+
+// Return the remaining time of the counter in its precision.
+func remaining(r CounterResult) int64 {
+	if r.Mode == CounterModeCountDown {
+		return r.Current
+	}
+	return r.To - r.Current + 1
+}
+
+func tickInUnit(tick time.Duration, precision string) int64 {
+	if precision == PrecisionMillisecond {
+		return int64(tick / time.Millisecond)
+	}
+	// Round up, so that ticks shorter than a second still cover the last second
+	return int64((tick + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,137 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tests of GET /counter/:id/stream
+func TestRouterStreamCounter(t *testing.T) {
+	tests := []struct {
+		name     string
+		results  []CounterResult
+		err      error
+		wantCode int
+		wantBody string
+	}{
+		{
+			"count up to the end",
+			[]CounterResult{
+				{Current: 9, To: 10, counterExistence: true},
+				{Current: 10, To: 10, counterExistence: true},
+				{},
+			},
+			nil,
+			http.StatusOK,
+			"event:tick\ndata:{\"current\":9,\"to\":10}\n\n" +
+				"event:tick\ndata:{\"current\":10,\"to\":10}\n\n" +
+				"event:completed\ndata:{\"id\":\"3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e\"}\n\n",
+		},
+		{
+			"count down to the end",
+			[]CounterResult{
+				{Current: 1, To: 10, Mode: CounterModeCountDown, counterExistence: true},
+				{},
+			},
+			nil,
+			http.StatusOK,
+			"event:tick\ndata:{\"current\":1,\"to\":10,\"mode\":\"countdown\"}\n\n" +
+				"event:completed\ndata:{\"id\":\"3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e\"}\n\n",
+		},
+		{
+			"stopped on the way",
+			[]CounterResult{
+				{Current: 3, To: 10, counterExistence: true},
+				{},
+			},
+			nil,
+			http.StatusOK,
+			"event:tick\ndata:{\"current\":3,\"to\":10}\n\n" +
+				"event:stopped\ndata:{\"id\":\"3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e\"}\n\n",
+		},
+		{
+			"stopped while paused",
+			[]CounterResult{
+				{Current: 10, To: 10, Paused: true, counterExistence: true},
+				{},
+			},
+			nil,
+			http.StatusOK,
+			"event:tick\ndata:{\"current\":10,\"to\":10,\"paused\":true}\n\n" +
+				"event:stopped\ndata:{\"id\":\"3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e\"}\n\n",
+		},
+		{
+			"no such counter",
+			[]CounterResult{{}},
+			nil,
+			http.StatusNotFound,
+			"{\"error\":\"no such counter with 3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e\"}",
+		},
+		{
+			"internal error",
+			nil,
+			errors.New("error"),
+			http.StatusInternalServerError,
+			"{\"error\":\"Internal Server Error\"}",
+		},
+	}
+	for _, tt := range tests {
+		calls := 0
+		d := &DummyCounter{GetCounterFunc: func(ctx context.Context, id string) (CounterResult, error) {
+			if tt.err != nil {
+				return CounterResult{}, tt.err
+			}
+			r := tt.results[calls]
+			calls++
+			return r, nil
+		}}
+		c := NewController(d, ControllerConfig{})
+		c.streamTickInterval = time.Millisecond
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/counter/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e/stream", nil)
+		c.router.ServeHTTP(w, req)
+		assert.Equal(t, tt.wantCode, w.Code, tt.name)
+		assert.Equal(t, tt.wantBody, w.Body.String(), tt.name)
+		if tt.wantCode == http.StatusOK {
+			assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"), tt.name)
+		}
+	}
+}
+
+// The stream ends when the client disconnects
+func TestRouterStreamCounterClientDisconnect(t *testing.T) {
+	d := &DummyCounter{GetCounterFunc: func(ctx context.Context, id string) (CounterResult, error) {
+		return CounterResult{Current: 1, To: 100, counterExistence: true}, nil
+	}}
+	c := NewController(d, ControllerConfig{})
+	c.streamTickInterval = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest(http.MethodGet, "/counter/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e/stream", nil)
+	req = req.WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		c.router.ServeHTTP(w, req)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the stream didn't end after the client disconnected")
+	}
+}
+
+func TestTickInUnit(t *testing.T) {
+	assert.Equal(t, int64(1), tickInUnit(time.Millisecond, PrecisionSecond))
+	assert.Equal(t, int64(1), tickInUnit(time.Second, PrecisionSecond))
+	assert.Equal(t, int64(2), tickInUnit(1500*time.Millisecond, ""))
+	assert.Equal(t, int64(1000), tickInUnit(time.Second, PrecisionMillisecond))
+}
@@ -0,0 +1,50 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Clients may retry this many seconds after DB didn't respond in time.
+const timeoutRetryAfterSecond = 1
+
+// Return the context for the DB calls of the request.
+// It's canceled when the client disconnects, and times out after the request timeout, so that a slow DB never
+// holds up the handler. Call the returned function to release it.
+func (c *Controller) requestContext(ctx *gin.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx.Request.Context(), c.requestTimeout)
+}
+
+// Respond to the error of DB. Return 503 with "Retry-After" if DB didn't respond in time, otherwise 500.
+func respondError(ctx *gin.Context, err error) {
+	logRequestError(ctx, err)
+	if isTimeout(err) {
+		ctx.Header(retryAfterHeader, strconv.Itoa(timeoutRetryAfterSecond))
+		ctx.JSON(http.StatusServiceUnavailable, errorFormatter("DB didn't respond in time"))
+		return
+	}
+	ctx.JSON(http.StatusInternalServerError, errorFormatter(http.StatusText(http.StatusInternalServerError)))
+}
+
+// Tell whether the error is caused by the deadline of the context, or the read or write timeout of the connection.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Return the context which times out after timeout, or is only cancelable if timeout is 0.
+func withTimeout(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
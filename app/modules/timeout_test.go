@@ -0,0 +1,92 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"counterapi/pb"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Return 503 with "Retry-After" if DB doesn't respond within the request timeout
+func TestRouterRequestTimeout(t *testing.T) {
+	d := &DummyCounter{GetCounterFunc: func(ctx context.Context, id string) (CounterResult, error) {
+		// Never responds until the request times out
+		<-ctx.Done()
+		return CounterResult{}, ctx.Err()
+	}}
+	c := NewController(d, ControllerConfig{RequestTimeout: 10 * time.Millisecond})
+
+	for _, path := range []string{"/v1/counter/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e", "/counter/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		c.router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code, path)
+		assert.Equal(t, "1", w.Header().Get(retryAfterHeader), path)
+		assert.Equal(t, "{\"error\":\"DB didn't respond in time\"}", w.Body.String(), path)
+		assert.NoError(t, validateResponse(http.MethodGet, "/v1/counter/{id}", w), path)
+	}
+}
+
+// The context of DB calls has no deadline with the request timeout 0
+func TestRouterRequestTimeoutDisabled(t *testing.T) {
+	d := &DummyCounter{GetCounterFunc: func(ctx context.Context, id string) (CounterResult, error) {
+		_, ok := ctx.Deadline()
+		assert.False(t, ok)
+		return CounterResult{To: 10, counterExistence: true}, nil
+	}}
+	c := NewController(d, ControllerConfig{})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/v1/counter/3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e", nil)
+	c.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+type dummyNetError struct {
+	timeout bool
+}
+
+func (e dummyNetError) Error() string   { return "net error" }
+func (e dummyNetError) Timeout() bool   { return e.timeout }
+func (e dummyNetError) Temporary() bool { return false }
+
+func TestIsTimeout(t *testing.T) {
+	var _ net.Error = dummyNetError{}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"deadline", context.DeadlineExceeded, true},
+		{"wrapped deadline", fmt.Errorf("failed: %w", context.DeadlineExceeded), true},
+		{"read timeout", dummyNetError{timeout: true}, true},
+		{"other net error", dummyNetError{}, false},
+		{"canceled", context.Canceled, false},
+		{"other", errors.New("error"), false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, isTimeout(tt.err), tt.name)
+	}
+}
+
+// RPCs are UNAVAILABLE if DB doesn't respond within the request timeout
+func TestGRPCRequestTimeout(t *testing.T) {
+	d := &DummyCounter{GetCounterFunc: func(ctx context.Context, id string) (CounterResult, error) {
+		<-ctx.Done()
+		return CounterResult{}, ctx.Err()
+	}}
+	client, stop := newTestGRPCClient(t, NewGRPCServer(d, "", nil, nil, NewMetrics(), 10*time.Millisecond))
+	defer stop()
+
+	_, err := client.GetCounter(context.Background(), &pb.GetCounterRequest{Id: "3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e"})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
@@ -0,0 +1,208 @@
+package modules
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The files are checked for changes at most once in this interval.
+const tlsReloadInterval = 10 * time.Second
+
+// Same as the default of go-redis
+const defaultRedisDialTimeout = 5 * time.Second
+
+// Minimum TLS versions which can be configured
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSFiles is the paths of the PEM files for TLS. They are reloaded from disk when they change.
+type TLSFiles struct {
+	// The certificate and its key. They are optional for clients.
+	CertFile string
+	KeyFile  string
+	// The CA bundle to verify the peer with. Empty means the system roots for clients, and no client certificates for servers.
+	CAFile string
+}
+
+// ServerTLSConfig is the settings of HTTPS.
+type ServerTLSConfig struct {
+	TLSFiles
+	// One of "1.0", "1.1", "1.2" and "1.3"
+	MinVersion string
+}
+
+// Validate the settings and return the error describing the first invalid one.
+func (c ServerTLSConfig) Validate() error {
+	switch {
+	case c.CertFile == "" || c.KeyFile == "":
+		return errors.New("TLS cert file and key file are required")
+	case tlsVersions[c.MinVersion] == 0:
+		return fmt.Errorf("TLS min version must be 1.0, 1.1, 1.2 or 1.3, got %q", c.MinVersion)
+	}
+	return nil
+}
+
+// Return the config of the HTTPS listener. Client certificates are required and verified if the CA file is given.
+// The certificate and the CA bundle are reloaded for new connections when they change on disk.
+func NewServerTLSConfig(config ServerTLSConfig) (*tls.Config, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	r, err := newCertReloader(config.TLSFiles)
+	if err != nil {
+		return nil, err
+	}
+	return r.serverConfig(tlsVersions[config.MinVersion]), nil
+}
+
+// certReloader holds the certificate and the CA bundle loaded from the files, and reloads them when the files change.
+type certReloader struct {
+	files         TLSFiles
+	checkInterval time.Duration
+	mu            sync.Mutex
+	checkedAt     time.Time
+	// The latest modification time of the files when they were loaded
+	modTime time.Time
+	// nil if the files are not given
+	cert   *tls.Certificate
+	caPool *x509.CertPool
+}
+
+// Load the files. It fails if any of them is invalid.
+func newCertReloader(files TLSFiles) (*certReloader, error) {
+	r := &certReloader{files: files, checkInterval: tlsReloadInterval, checkedAt: time.Now()}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) load() error {
+	// Take the time before reading, so that a change while reading is loaded next time
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	var cert *tls.Certificate
+	if r.files.CertFile != "" || r.files.KeyFile != "" {
+		c, err := tls.LoadX509KeyPair(r.files.CertFile, r.files.KeyFile)
+		if err != nil {
+			return err
+		}
+		cert = &c
+	}
+	var caPool *x509.CertPool
+	if r.files.CAFile != "" {
+		pem, err := ioutil.ReadFile(r.files.CAFile)
+		if err != nil {
+			return err
+		}
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s has no certificates", r.files.CAFile)
+		}
+	}
+	r.cert, r.caPool, r.modTime = cert, caPool, modTime
+	return nil
+}
+
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.files.CertFile, r.files.KeyFile, r.files.CAFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Return the certificate and the CA bundle, reloading them if the files have changed.
+// The previous ones are kept if the new files are invalid, such as while the cert and the key are being replaced.
+func (r *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checkedAt) < r.checkInterval {
+		return r.cert, r.caPool
+	}
+	r.checkedAt = time.Now()
+	modTime, err := r.latestModTime()
+	if err == nil && !modTime.Equal(r.modTime) {
+		err = r.load()
+		if err == nil {
+			logrus.Infof("Reloaded TLS files %s", r.files.CertFile)
+		}
+	}
+	if err != nil {
+		logrus.WithError(err).Error("failed to reload TLS files. Keep using the previous ones.")
+	}
+	return r.cert, r.caPool
+}
+
+func (r *certReloader) serverConfig(minVersion uint16) *tls.Config {
+	return &tls.Config{
+		MinVersion: minVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, caPool := r.current()
+			config := &tls.Config{MinVersion: minVersion, Certificates: []tls.Certificate{*cert}}
+			if caPool != nil {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				config.ClientCAs = caPool
+			}
+			return config, nil
+		},
+	}
+}
+
+// Return the dialer which connects over TLS, verifying the server with the CA bundle.
+// Every new connection uses the files as of then, so that they can be replaced without a restart.
+func (r *certReloader) dialer(dialTimeout time.Duration) func(ctx context.Context, network string, addr string) (net.Conn, error) {
+	if dialTimeout == 0 {
+		dialTimeout = defaultRedisDialTimeout
+	}
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		d := &net.Dialer{Timeout: dialTimeout, KeepAlive: 5 * time.Minute}
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		cert, caPool := r.current()
+		config := &tls.Config{ServerName: host, RootCAs: caPool, MinVersion: tls.VersionTLS12}
+		if cert != nil {
+			config.Certificates = []tls.Certificate{*cert}
+		}
+		tlsConn := tls.Client(conn, config)
+		// The handshake has to finish within the dial timeout as well
+		_ = conn.SetDeadline(time.Now().Add(dialTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		_ = conn.SetDeadline(time.Time{})
+		return tlsConn, nil
+	}
+}
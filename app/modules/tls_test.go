@@ -0,0 +1,210 @@
+package modules
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Write a CA and a certificate for 127.0.0.1 signed by it as "<name>-ca.pem", "<name>.pem" and "<name>-key.pem" in dir.
+func writeTestCerts(t *testing.T, dir string, name string) TLSFiles {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name + "-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	assert.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	files := TLSFiles{
+		CertFile: filepath.Join(dir, name+".pem"),
+		KeyFile:  filepath.Join(dir, name+"-key.pem"),
+		CAFile:   filepath.Join(dir, name+"-ca.pem"),
+	}
+	writePEM(t, files.CAFile, "CERTIFICATE", caDER)
+	writePEM(t, files.CertFile, "CERTIFICATE", certDER)
+	writePEM(t, files.KeyFile, "EC PRIVATE KEY", keyDER)
+	return files
+}
+
+func writePEM(t *testing.T, path string, blockType string, der []byte) {
+	assert.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+}
+
+func TestServerTLSConfig_Validate(t *testing.T) {
+	valid := ServerTLSConfig{TLSFiles: TLSFiles{CertFile: "cert.pem", KeyFile: "key.pem"}, MinVersion: "1.2"}
+	assert.Nil(t, valid.Validate())
+
+	tests := []struct {
+		modify        func(c *ServerTLSConfig)
+		expectedError string
+	}{
+		{func(c *ServerTLSConfig) { c.KeyFile = "" }, "TLS cert file and key file are required"},
+		{func(c *ServerTLSConfig) { c.MinVersion = "1.4" }, "TLS min version must be 1.0, 1.1, 1.2 or 1.3, got \"1.4\""},
+	}
+	for _, tt := range tests {
+		c := valid
+		tt.modify(&c)
+		err := c.Validate()
+		if assert.Error(t, err) {
+			assert.Equal(t, tt.expectedError, err.Error())
+		}
+	}
+}
+
+// Serve HTTPS only to the clients with certificates signed by the client CA
+func TestControllerServeTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	server := writeTestCerts(t, dir, "server")
+	client := writeTestCerts(t, dir, "client")
+	tlsConfig, err := NewServerTLSConfig(ServerTLSConfig{
+		TLSFiles:   TLSFiles{CertFile: server.CertFile, KeyFile: server.KeyFile, CAFile: client.CAFile},
+		MinVersion: "1.2",
+	})
+	assert.NoError(t, err)
+
+	c := NewController(&DummyCounter{}, ControllerConfig{TLSConfig: tlsConfig, ShutdownTimeout: 5 * time.Second})
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	quit := make(chan os.Signal, 1)
+	errServe := make(chan error, 1)
+	go func() {
+		errServe <- c.serve(tls.NewListener(listener, tlsConfig), quit)
+	}()
+
+	roots := x509.NewCertPool()
+	caPEM, _ := ioutil.ReadFile(server.CAFile)
+	roots.AppendCertsFromPEM(caPEM)
+	clientCert, err := tls.LoadX509KeyPair(client.CertFile, client.KeyFile)
+	assert.NoError(t, err)
+	get := func(config *tls.Config) (*http.Response, error) {
+		httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		return httpClient.Get("https://" + listener.Addr().String() + "/healthz")
+	}
+
+	res, err := get(&tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}})
+	if assert.NoError(t, err) {
+		_ = res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+	// Without the client certificate
+	_, err = get(&tls.Config{RootCAs: roots})
+	assert.Error(t, err)
+	// Older than the minimum version
+	_, err = get(&tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}, MaxVersion: tls.VersionTLS11})
+	assert.Error(t, err)
+
+	quit <- syscall.SIGTERM
+	assert.Nil(t, <-errServe)
+}
+
+// The certificate is reloaded when the files change, and kept if the new files are invalid
+func TestCertReloader(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	files := writeTestCerts(t, dir, "first")
+	r, err := newCertReloader(TLSFiles{CertFile: files.CertFile, KeyFile: files.KeyFile})
+	assert.NoError(t, err)
+	r.checkInterval = 0
+	assert.Equal(t, "first", leafCommonName(t, r))
+
+	// Make sure the modification time changes
+	touch := func(paths ...string) {
+		future := time.Now().Add(time.Minute)
+		for _, p := range paths {
+			assert.NoError(t, os.Chtimes(p, future, future))
+		}
+	}
+	renewed := writeTestCerts(t, dir, "renewed")
+	assert.NoError(t, os.Rename(renewed.CertFile, files.CertFile))
+	assert.NoError(t, os.Rename(renewed.KeyFile, files.KeyFile))
+	touch(files.CertFile, files.KeyFile)
+	assert.Equal(t, "renewed", leafCommonName(t, r))
+
+	assert.NoError(t, ioutil.WriteFile(files.KeyFile, []byte("broken"), 0600))
+	touch(files.KeyFile)
+	assert.Equal(t, "renewed", leafCommonName(t, r))
+
+	_, err = newCertReloader(TLSFiles{CertFile: files.CertFile, KeyFile: files.KeyFile})
+	assert.Error(t, err)
+}
+
+func leafCommonName(t *testing.T, r *certReloader) string {
+	cert, _ := r.current()
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	return leaf.Subject.CommonName
+}
+
+// The dialer of Redis verifies the server with the CA bundle
+func TestCertReloader_Dialer(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	server := writeTestCerts(t, dir, "redis")
+	other := writeTestCerts(t, dir, "other")
+	cert, err := tls.LoadX509KeyPair(server.CertFile, server.KeyFile)
+	assert.NoError(t, err)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+
+	r, err := newCertReloader(TLSFiles{CAFile: server.CAFile})
+	assert.NoError(t, err)
+	conn, err := r.dialer(time.Second)(context.Background(), "tcp", listener.Addr().String())
+	if assert.NoError(t, err) {
+		_ = conn.Close()
+	}
+
+	r, err = newCertReloader(TLSFiles{CAFile: other.CAFile})
+	assert.NoError(t, err)
+	_, err = r.dialer(time.Second)(context.Background(), "tcp", listener.Addr().String())
+	assert.Error(t, err)
+}
@@ -0,0 +1,33 @@
+package modules
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	v1Path            string = "/v1"
+	deprecationHeader string = "Deprecation"
+	linkHeader        string = "Link"
+)
+
+// Mark the unversioned routes as deprecated aliases of the "/v1" routes.
+// Every response has "Deprecation: true" and "Link" to the route which replaces it, so that clients can migrate.
+func (c *Controller) deprecationMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.Header(deprecationHeader, "true")
+		ctx.Header(linkHeader, fmt.Sprintf("<%s>; rel=\"successor-version\"", successorPath(ctx)))
+		ctx.Next()
+	}
+}
+
+// Return the "/v1" path which replaces the unversioned request.
+// "POST /counter/:id/stop" is replaced by "DELETE /v1/counter/:id".
+func successorPath(ctx *gin.Context) string {
+	if requestRoute(ctx) == counterPath+"/:id"+stopPath {
+		return v1Path + strings.TrimSuffix(ctx.Request.URL.Path, stopPath)
+	}
+	return v1Path + ctx.Request.URL.Path
+}
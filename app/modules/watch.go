@@ -0,0 +1,390 @@
+package modules
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	watchRequestSubscribe   string = "subscribe"
+	watchRequestUnsubscribe string = "unsubscribe"
+	watchMessageUpdate      string = "update"
+	watchMessageError       string = "error"
+)
+
+const (
+	maxWatchedCounters  int   = 1000
+	maxWatchRequestSize int64 = 64 * 1024
+	watchSendBufferSize int   = 16
+	watchWriteTimeout         = 10 * time.Second
+	// Clients have to answer pings within this time, otherwise they are regarded as gone.
+	watchPongTimeout  = 60 * time.Second
+	watchPingInterval = 30 * time.Second
+)
+
+var watchUpgrader = websocket.Upgrader{}
+
+// Message from clients to subscribe or unsubscribe counters
+type watchRequest struct {
+	Type string   `json:"type"`
+	IDs  []string `json:"ids"`
+}
+
+// Message to clients. All counters the client watches are batched into one message per tick.
+type watchMessage struct {
+	Type      string                   `json:"type"`
+	Counters  map[string]CounterResult `json:"counters,omitempty"`
+	Completed []string                 `json:"completed,omitempty"`
+	Deleted   []string                 `json:"deleted,omitempty"`
+	Error     string                   `json:"error,omitempty"`
+}
+
+// watchHub looks up all watched counters with one read per tick, and fans the result out to all its watchers.
+type watchHub struct {
+	counter  Counter
+	interval time.Duration
+	mu       sync.Mutex
+	clients  map[*watcher]struct{}
+	// Watchers by counter ID
+	watchers map[string]map[*watcher]struct{}
+	// The state of each counter seen in the last tick, to tell whether it has completed when it disappears
+	last    map[string]CounterResult
+	closed  bool
+	started sync.Once
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// watcher is a WebSocket connection of a client.
+type watcher struct {
+	conn *websocket.Conn
+	send chan watchMessage
+	// Counter IDs it watches. Guarded by the hub.
+	ids map[string]struct{}
+	// ID of the API key of the client. Empty if API keys are disabled.
+	owner     string
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newWatchHub(counter Counter, interval time.Duration) *watchHub {
+	return &watchHub{
+		counter:  counter,
+		interval: interval,
+		clients:  map[*watcher]struct{}{},
+		watchers: map[string]map[*watcher]struct{}{},
+		last:     map[string]CounterResult{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Upgrade the connection to WebSocket against "GET /watch", and push the counters the client subscribes.
+// It returns when the client disconnects.
+func (c *Controller) watchCounters(ctx *gin.Context) {
+	conn, err := watchUpgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		// Upgrader has already replied with the error status
+		return
+	}
+	w := &watcher{
+		conn:   conn,
+		send:   make(chan watchMessage, watchSendBufferSize),
+		ids:    map[string]struct{}{},
+		owner:  requestOwner(ctx),
+		closed: make(chan struct{}),
+	}
+	if !c.watchHub.register(w) {
+		// The server is shutting down
+		w.close(websocket.CloseGoingAway)
+		return
+	}
+	defer c.watchHub.remove(w)
+	go w.writeLoop()
+	w.readLoop(c.watchHub)
+}
+
+// Start the ticker on the first watcher, and register it. It returns false if the hub has been closed.
+func (h *watchHub) register(w *watcher) bool {
+	h.started.Do(func() {
+		go h.run()
+	})
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return false
+	}
+	h.clients[w] = struct{}{}
+	return true
+}
+
+func (h *watchHub) run() {
+	defer close(h.done)
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.tick()
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+// Stop the ticker and disconnect all watchers, so that they reconnect to another replica.
+func (h *watchHub) close() {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return
+	}
+	h.closed = true
+	clients := make([]*watcher, 0, len(h.clients))
+	for w := range h.clients {
+		clients = append(clients, w)
+	}
+	h.mu.Unlock()
+
+	close(h.stop)
+	started := true
+	h.started.Do(func() {
+		started = false
+	})
+	if started {
+		<-h.done
+	}
+	for _, w := range clients {
+		w.close(websocket.CloseGoingAway)
+	}
+}
+
+// Look up all watched counters and push the result to the watchers.
+func (h *watchHub) tick() {
+	h.mu.Lock()
+	ids := make([]string, 0, len(h.watchers))
+	for id := range h.watchers {
+		ids = append(ids, id)
+	}
+	h.mu.Unlock()
+
+	if len(ids) == 0 {
+		return
+	}
+
+	// Look up without the lock, so that clients can subscribe meanwhile
+	// The lookup has to finish before the next tick.
+	ctx, cancel := context.WithTimeout(context.Background(), h.interval)
+	defer cancel()
+	results, err := h.counter.GetCounters(ctx, ids)
+	if err != nil {
+		logrus.WithError(err).Error("failed to get the watched counters")
+		h.pushError(ids, "failed to get the counters, retrying in the next tick")
+		return
+	}
+
+	messages := map[*watcher]*watchMessage{}
+	h.mu.Lock()
+	for id, r := range results {
+		last, seen := h.last[id]
+		owner := r.owner
+		if !r.counterExistence {
+			owner = last.owner
+		}
+		for w := range h.watchers[id] {
+			m, ok := messages[w]
+			if !ok {
+				m = &watchMessage{Type: watchMessageUpdate}
+				messages[w] = m
+			}
+			switch {
+			case w.owner != "" && w.owner != owner:
+				// Counters of other API keys look like nonexistent ones, and aren't watched any more
+				m.Deleted = append(m.Deleted, id)
+				h.unsubscribeLocked(w, []string{id})
+			case r.counterExistence:
+				if m.Counters == nil {
+					m.Counters = map[string]CounterResult{}
+				}
+				m.Counters[id] = r
+			case seen && hasCompleted(last, h.interval):
+				m.Completed = append(m.Completed, id)
+			default:
+				// It has been stopped, or didn't exist from the beginning
+				m.Deleted = append(m.Deleted, id)
+			}
+		}
+		if _, ok := h.watchers[id]; !ok {
+			// All watchers of it have been unsubscribed above
+			continue
+		}
+		if r.counterExistence {
+			h.last[id] = r
+			continue
+		}
+		// Nothing to watch any more
+		for w := range h.watchers[id] {
+			delete(w.ids, id)
+		}
+		delete(h.watchers, id)
+		delete(h.last, id)
+	}
+	h.mu.Unlock()
+
+	for w, m := range messages {
+		w.push(*m)
+	}
+}
+
+// Tell the watchers of the counters that this tick has failed. They stay subscribed.
+func (h *watchHub) pushError(ids []string, message string) {
+	h.mu.Lock()
+	watchers := map[*watcher]struct{}{}
+	for _, id := range ids {
+		for w := range h.watchers[id] {
+			watchers[w] = struct{}{}
+		}
+	}
+	h.mu.Unlock()
+	for w := range watchers {
+		w.push(watchMessage{Type: watchMessageError, Error: message})
+	}
+}
+
+func (h *watchHub) subscribe(w *watcher, ids []string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	added := 0
+	for _, id := range ids {
+		if _, ok := w.ids[id]; !ok {
+			added++
+		}
+	}
+	if len(w.ids)+added > maxWatchedCounters {
+		return fmt.Errorf("a connection can watch at most %d counters", maxWatchedCounters)
+	}
+	// Internal keys must not be looked up as counters
+	for _, id := range ids {
+		if !isCounterID(id) {
+			return fmt.Errorf("the id %s is invalid", id)
+		}
+	}
+	for _, id := range ids {
+		w.ids[id] = struct{}{}
+		if h.watchers[id] == nil {
+			h.watchers[id] = map[*watcher]struct{}{}
+		}
+		h.watchers[id][w] = struct{}{}
+	}
+	return nil
+}
+
+func (h *watchHub) unsubscribe(w *watcher, ids []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.unsubscribeLocked(w, ids)
+}
+
+func (h *watchHub) unsubscribeLocked(w *watcher, ids []string) {
+	for _, id := range ids {
+		delete(w.ids, id)
+		delete(h.watchers[id], w)
+		if len(h.watchers[id]) == 0 {
+			delete(h.watchers, id)
+			delete(h.last, id)
+		}
+	}
+}
+
+// Unsubscribe all counters of the disconnected watcher.
+func (h *watchHub) remove(w *watcher) {
+	h.mu.Lock()
+	ids := make([]string, 0, len(w.ids))
+	for id := range w.ids {
+		ids = append(ids, id)
+	}
+	h.unsubscribeLocked(w, ids)
+	delete(h.clients, w)
+	h.mu.Unlock()
+	w.close(websocket.CloseNormalClosure)
+}
+
+// Handle requests from the client until it disconnects.
+func (w *watcher) readLoop(h *watchHub) {
+	w.conn.SetReadLimit(maxWatchRequestSize)
+	_ = w.conn.SetReadDeadline(time.Now().Add(watchPongTimeout))
+	w.conn.SetPongHandler(func(string) error {
+		return w.conn.SetReadDeadline(time.Now().Add(watchPongTimeout))
+	})
+	for {
+		_, data, err := w.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var req watchRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			w.push(watchMessage{Type: watchMessageError, Error: "request must be JSON like {\"type\": \"subscribe\", \"ids\": [...]}"})
+			continue
+		}
+		switch req.Type {
+		case watchRequestSubscribe:
+			if err := h.subscribe(w, req.IDs); err != nil {
+				w.push(watchMessage{Type: watchMessageError, Error: err.Error()})
+			}
+		case watchRequestUnsubscribe:
+			h.unsubscribe(w, req.IDs)
+		default:
+			w.push(watchMessage{Type: watchMessageError, Error: fmt.Sprintf("type must be %s or %s", watchRequestSubscribe, watchRequestUnsubscribe)})
+		}
+	}
+}
+
+// Write messages and pings to the client. Only this goroutine writes data frames to the connection.
+func (w *watcher) writeLoop() {
+	ticker := time.NewTicker(watchPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case m := <-w.send:
+			_ = w.conn.SetWriteDeadline(time.Now().Add(watchWriteTimeout))
+			if err := w.conn.WriteJSON(m); err != nil {
+				w.close(websocket.CloseAbnormalClosure)
+				return
+			}
+		case <-ticker.C:
+			if err := w.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(watchWriteTimeout)); err != nil {
+				w.close(websocket.CloseAbnormalClosure)
+				return
+			}
+		case <-w.closed:
+			return
+		}
+	}
+}
+
+// Queue the message without blocking. The client which can't keep up is disconnected rather than blocking others.
+func (w *watcher) push(m watchMessage) {
+	select {
+	case w.send <- m:
+	default:
+		w.close(websocket.ClosePolicyViolation)
+	}
+}
+
+// Close the connection with the given close code. It can be called many times.
+func (w *watcher) close(code int) {
+	w.closeOnce.Do(func() {
+		close(w.closed)
+		if code != websocket.CloseAbnormalClosure {
+			_ = w.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(watchWriteTimeout))
+		}
+		_ = w.conn.Close()
+	})
+}
@@ -0,0 +1,226 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// Counter IDs in the tests, in lexical order
+const (
+	watchIDA = "1a0ca312-558f-4a13-987f-ba86930ec9ef"
+	watchIDB = "3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e"
+	watchIDC = "9dd29757-ed4e-488f-b62c-b8cececbac29"
+)
+
+// Connect to "GET /watch" of the test server
+func dialWatch(t *testing.T, s *httptest.Server) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+watchPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// Wait until the hub has the given number of watched counters
+func waitForWatchedCounters(t *testing.T, h *watchHub, n int) {
+	for i := 0; i < 100; i++ {
+		h.mu.Lock()
+		l := len(h.watchers)
+		h.mu.Unlock()
+		if l == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("the hub didn't get %d watched counters", n)
+}
+
+func readWatchMessage(t *testing.T, conn *websocket.Conn) watchMessage {
+	var m watchMessage
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err := conn.ReadJSON(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// N watchers of M counters cost one lookup per tick
+func TestWatchFanOut(t *testing.T) {
+	var mu sync.Mutex
+	var calls [][]string
+	results := map[string]CounterResult{
+		watchIDA: {Current: 10, To: 10, counterExistence: true},
+		watchIDB: {Current: 3, To: 10000, counterExistence: true},
+	}
+	d := &DummyCounter{GetCountersFunc: func(ctx context.Context, ids []string) (map[string]CounterResult, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		sort.Strings(ids)
+		calls = append(calls, ids)
+		r := map[string]CounterResult{}
+		for _, id := range ids {
+			r[id] = results[id]
+		}
+		return r, nil
+	}}
+	c := NewController(d, ControllerConfig{})
+	// Tick manually in this test. "b" is still far from its end even with this interval.
+	c.watchHub.interval = time.Hour
+	s := httptest.NewServer(c.router)
+	defer s.Close()
+	defer c.watchHub.close()
+
+	conn1 := dialWatch(t, s)
+	defer conn1.Close()
+	conn2 := dialWatch(t, s)
+	defer conn2.Close()
+	assert.NoError(t, conn1.WriteJSON(watchRequest{Type: watchRequestSubscribe, IDs: []string{watchIDA, watchIDB}}))
+	assert.NoError(t, conn2.WriteJSON(watchRequest{Type: watchRequestSubscribe, IDs: []string{watchIDA, watchIDC}}))
+	waitForWatchedCounters(t, c.watchHub, 3)
+
+	c.watchHub.tick()
+	assert.Equal(t, [][]string{{watchIDA, watchIDB, watchIDC}}, calls)
+	assert.Equal(t, watchMessage{Type: watchMessageUpdate, Counters: map[string]CounterResult{watchIDA: {Current: 10, To: 10}, watchIDB: {Current: 3, To: 10000}}}, readWatchMessage(t, conn1))
+	// "c" doesn't exist
+	assert.Equal(t, watchMessage{Type: watchMessageUpdate, Counters: map[string]CounterResult{watchIDA: {Current: 10, To: 10}}, Deleted: []string{watchIDC}}, readWatchMessage(t, conn2))
+
+	// "a" completes and "b" is stopped
+	mu.Lock()
+	results = map[string]CounterResult{}
+	mu.Unlock()
+	c.watchHub.tick()
+	m := readWatchMessage(t, conn1)
+	assert.Equal(t, []string{watchIDA}, m.Completed)
+	assert.Equal(t, []string{watchIDB}, m.Deleted)
+	assert.Equal(t, watchMessage{Type: watchMessageUpdate, Completed: []string{watchIDA}}, readWatchMessage(t, conn2))
+
+	// Nothing is watched any more
+	waitForWatchedCounters(t, c.watchHub, 0)
+}
+
+func TestWatchUnsubscribeAndDisconnect(t *testing.T) {
+	d := &DummyCounter{GetCountersFunc: func(ctx context.Context, ids []string) (map[string]CounterResult, error) {
+		r := map[string]CounterResult{}
+		for _, id := range ids {
+			r[id] = CounterResult{Current: 1, To: 10, counterExistence: true}
+		}
+		return r, nil
+	}}
+	c := NewController(d, ControllerConfig{})
+	c.watchHub.interval = time.Hour
+	s := httptest.NewServer(c.router)
+	defer s.Close()
+	defer c.watchHub.close()
+
+	conn := dialWatch(t, s)
+	assert.NoError(t, conn.WriteJSON(watchRequest{Type: watchRequestSubscribe, IDs: []string{watchIDA, watchIDB}}))
+	waitForWatchedCounters(t, c.watchHub, 2)
+	assert.NoError(t, conn.WriteJSON(watchRequest{Type: watchRequestUnsubscribe, IDs: []string{watchIDA}}))
+	waitForWatchedCounters(t, c.watchHub, 1)
+
+	// Counters of the disconnected client are unsubscribed
+	_ = conn.Close()
+	waitForWatchedCounters(t, c.watchHub, 0)
+}
+
+// The watchers are told about the failed lookup, and keep watching
+func TestWatchLookupError(t *testing.T) {
+	var mu sync.Mutex
+	failing := true
+	d := &DummyCounter{GetCountersFunc: func(ctx context.Context, ids []string) (map[string]CounterResult, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			return nil, errors.New("connection refused")
+		}
+		return map[string]CounterResult{watchIDA: {Current: 1, To: 10, counterExistence: true}}, nil
+	}}
+	c := NewController(d, ControllerConfig{})
+	c.watchHub.interval = time.Hour
+	s := httptest.NewServer(c.router)
+	defer s.Close()
+	defer c.watchHub.close()
+
+	conn := dialWatch(t, s)
+	defer conn.Close()
+	assert.NoError(t, conn.WriteJSON(watchRequest{Type: watchRequestSubscribe, IDs: []string{watchIDA}}))
+	waitForWatchedCounters(t, c.watchHub, 1)
+
+	c.watchHub.tick()
+	assert.Equal(t, watchMessage{Type: watchMessageError, Error: "failed to get the counters, retrying in the next tick"}, readWatchMessage(t, conn))
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	c.watchHub.tick()
+	assert.Equal(t, watchMessage{Type: watchMessageUpdate, Counters: map[string]CounterResult{watchIDA: {Current: 1, To: 10}}}, readWatchMessage(t, conn))
+}
+
+func TestWatchInvalidRequest(t *testing.T) {
+	c := NewController(&DummyCounter{}, ControllerConfig{})
+	s := httptest.NewServer(c.router)
+	defer s.Close()
+	defer c.watchHub.close()
+
+	conn := dialWatch(t, s)
+	defer conn.Close()
+	tests := []struct {
+		name    string
+		request string
+		want    string
+	}{
+		{"not JSON", "subscribe a", "request must be JSON like {\"type\": \"subscribe\", \"ids\": [...]}"},
+		{"unknown type", "{\"type\": \"get\", \"ids\": [\"a\"]}", "type must be subscribe or unsubscribe"},
+		{"internal key", "{\"type\": \"subscribe\", \"ids\": [\"index:expiry\"]}", "the id index:expiry is invalid"},
+	}
+	for _, tt := range tests {
+		assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(tt.request)), tt.name)
+		assert.Equal(t, watchMessage{Type: watchMessageError, Error: tt.want}, readWatchMessage(t, conn), tt.name)
+	}
+
+	ids := make([]string, maxWatchedCounters+1)
+	for i := range ids {
+		ids[i] = string(rune('a'+i%26)) + strings.Repeat("x", i/26)
+	}
+	assert.NoError(t, conn.WriteJSON(watchRequest{Type: watchRequestSubscribe, IDs: ids}))
+	assert.Equal(t, watchMessage{Type: watchMessageError, Error: "a connection can watch at most 1000 counters"}, readWatchMessage(t, conn))
+	// Nothing has been subscribed
+	waitForWatchedCounters(t, c.watchHub, 0)
+}
+
+// Plain HTTP requests are refused
+func TestWatchWithoutUpgrade(t *testing.T) {
+	c := NewController(&DummyCounter{}, ControllerConfig{})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, watchPath, nil)
+	c.router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// Closing the hub disconnects the clients
+func TestWatchHubClose(t *testing.T) {
+	c := NewController(&DummyCounter{}, ControllerConfig{})
+	c.watchHub.interval = time.Hour
+	s := httptest.NewServer(c.router)
+	defer s.Close()
+
+	conn := dialWatch(t, s)
+	defer conn.Close()
+	assert.NoError(t, conn.WriteJSON(watchRequest{Type: watchRequestSubscribe, IDs: []string{watchIDA}}))
+	waitForWatchedCounters(t, c.watchHub, 1)
+	c.watchHub.close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), err)
+}
@@ -0,0 +1,451 @@
+package modules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	callbackKeyPrefix   string = "callback:"
+	callbackScheduleKey string = "callback:schedule"
+	callbackEvent       string = "counter.completed"
+	// Delivered or failed callbacks are kept for a day so that users can check the status.
+	callbackRetentionSecond int64 = 24 * 60 * 60
+	maxCallbackPayloadSize  int   = 16 * 1024
+)
+
+// Paused counters stay in the indexes. They are checked again after this.
+const pausedIndexRecheckInterval = time.Hour
+
+const (
+	CallbackStatusPending   string = "pending"
+	CallbackStatusDelivered string = "delivered"
+	CallbackStatusFailed    string = "failed"
+)
+
+// Callback is the URL which is POSTed when the counter reaches its target.
+type Callback struct {
+	URL     string          `json:"url"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// CallbackRecord is the callback and its delivery status stored in DB.
+// The counter's attributes are copied here, because the counter itself has expired when the callback is fired.
+type CallbackRecord struct {
+	CounterID   string            `json:"counter_id"`
+	URL         string            `json:"url"`
+	Payload     json.RawMessage   `json:"payload,omitempty"`
+	Name        string            `json:"name,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Owner       string            `json:"owner,omitempty"`
+	To          int64             `json:"to"`
+	Status      string            `json:"status"`
+	Attempts    int               `json:"attempts"`
+	LastError   string            `json:"last_error,omitempty"`
+	DeliveredAt int64             `json:"delivered_at,omitempty"` // Unix timestamp in milliseconds
+}
+
+// Body POSTed to the callback URL
+type callbackBody struct {
+	Event   string            `json:"event"`
+	ID      string            `json:"id"`
+	Name    string            `json:"name,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	To      int64             `json:"to"`
+	Payload json.RawMessage   `json:"payload,omitempty"`
+}
+
+// Validate the callback. It returns the error which can be shown to users as it is.
+func (cb Callback) Validate() error {
+	u, err := url.Parse(cb.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("callback url must be an absolute http or https URL")
+	}
+	if len(cb.Payload) > maxCallbackPayloadSize {
+		return fmt.Errorf("callback payload must be at most %d bytes", maxCallbackPayloadSize)
+	}
+	return nil
+}
+
+// Get the callback and its delivery status of the counter with the given ID.
+// The second returned value is false if the counter has no callback.
+func (c *CountCalculator) GetCallbackStatus(ctx context.Context, id string) (CallbackRecord, bool, error) {
+	if !isCounterID(id) {
+		return CallbackRecord{}, false, nil
+	}
+	return getCallbackRecord(ctx, c.dao, id)
+}
+
+// Store the callback of the new counter and schedule it at the end of the counter.
+func (c *CountCalculator) registerCallback(ctx context.Context, id string, v DaoValueFormat, cb Callback) error {
+	if err := setCallbackRecord(ctx, c.dao, newCallbackRecord(id, v, cb), 0); err != nil {
+		return err
+	}
+	return c.scheduleCallback(ctx, id, v)
+}
+
+// Same as registerCallback, but the writes are queued in the batch.
+func queueCallback(b DaoBatch, id string, v DaoValueFormat, cb Callback) error {
+	value, err := json.Marshal(newCallbackRecord(id, v, cb))
+	if err != nil {
+		return err
+	}
+	b.Set(callbackKey(id), string(value), 0)
+	b.AddToSortedSet(callbackScheduleKey, id, dueMillisecond(v))
+	return nil
+}
+
+func newCallbackRecord(id string, v DaoValueFormat, cb Callback) CallbackRecord {
+	return CallbackRecord{
+		CounterID: id,
+		URL:       cb.URL,
+		Payload:   cb.Payload,
+		Name:      v.Name,
+		Labels:    v.Labels,
+		Owner:     v.Owner,
+		To:        v.EndTimestamp - v.StartTimestamp,
+		Status:    CallbackStatusPending,
+	}
+}
+
+// Schedule the callback at the end of the counter, including the time it has been paused.
+func (c *CountCalculator) scheduleCallback(ctx context.Context, id string, v DaoValueFormat) error {
+	return c.dao.AddToSortedSet(ctx, callbackScheduleKey, id, dueMillisecond(v))
+}
+
+// Stop firing the callback until it's scheduled again.
+func (c *CountCalculator) unscheduleCallback(ctx context.Context, id string) error {
+	return c.dao.RemoveFromSortedSet(ctx, callbackScheduleKey, id)
+}
+
+// Cancel the callback of the stopped counter.
+func (c *CountCalculator) cancelCallback(ctx context.Context, id string) error {
+	if err := c.unscheduleCallback(ctx, id); err != nil {
+		return err
+	}
+	return c.dao.Del(ctx, callbackKey(id))
+}
+
+// WebhookDispatcher fires callbacks of completed counters.
+// Every replica runs it, and each callback is claimed by only one of them with a lease, so it's fired once.
+// If the replica dies while delivering, another one takes it over after the lease.
+// It also removes expired counters from the label and owner indexes in the same way.
+type WebhookDispatcher struct {
+	dao         Dao
+	client      *http.Client
+	maxAttempts int
+	interval    time.Duration
+	lease       time.Duration
+	batchSize   int64
+	now         func() time.Time
+	allowIP     func(net.IP) bool
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+// Initialize WebhookDispatcher. Each POST to callback URLs times out after timeout,
+// and a callback is given up after maxAttempts failures.
+func NewWebhookDispatcher(dao Dao, timeout time.Duration, maxAttempts int) *WebhookDispatcher {
+	w := &WebhookDispatcher{
+		dao:         dao,
+		maxAttempts: maxAttempts,
+		interval:    time.Second,
+		// Long enough to finish a delivery, so that no other replica takes it over meanwhile
+		lease:     timeout + 10*time.Second,
+		batchSize: 100,
+		now:       time.Now,
+		allowIP:   isPublicIP,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	w.client = w.newClient(timeout)
+	return w
+}
+
+// Callback URLs are given by users, so they must not reach the internal network.
+// The address is checked when dialing, after the name is resolved, so that DNS can't be used to bypass it.
+// Redirects aren't followed for the same reason, and a proxy is never used as it would be the only address checked.
+func (w *WebhookDispatcher) newClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !w.allowIP(ip) {
+				return fmt.Errorf("callback URL resolves to a non-public address %s", host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Loopback, private, link-local, multicast and other reserved ranges
+var nonPublicNetworks = mustParseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, n)
+	}
+	return networks
+}
+
+func isPublicIP(ip net.IP) bool {
+	// IPv4-mapped IPv6 addresses are checked as IPv4
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, n := range nonPublicNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Start dispatching in the background.
+func (w *WebhookDispatcher) Start() {
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.dispatchDue()
+				w.pruneIndexes()
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop dispatching and wait for the deliveries in progress.
+func (w *WebhookDispatcher) Stop() {
+	close(w.stop)
+	<-w.done
+}
+
+// Claim the due callbacks and deliver them.
+// Deliveries have to finish within the lease, since another replica may take them over after it.
+func (w *WebhookDispatcher) dispatchDue() {
+	ctx, cancel := context.WithTimeout(context.Background(), w.lease)
+	defer cancel()
+	now := w.now()
+	ids, err := w.dao.ClaimFromSortedSet(ctx, callbackScheduleKey, toMillisecond(now), toMillisecond(now.Add(w.lease)), w.batchSize)
+	if err != nil {
+		logrus.WithError(err).Error("failed to claim callbacks")
+		return
+	}
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if err := w.deliver(ctx, id); err != nil {
+				logrus.WithError(err).WithField("counter_id", id).Error("failed to deliver callback")
+			}
+		}(id)
+	}
+	wg.Wait()
+}
+
+// Remove the counters which have expired from the label and owner indexes.
+// Counters still in DB, such as resumed ones, are checked again when they may have expired.
+func (w *WebhookDispatcher) pruneIndexes() {
+	ctx, cancel := context.WithTimeout(context.Background(), w.lease)
+	defer cancel()
+	now := w.now()
+	members, err := w.dao.ClaimFromSortedSet(ctx, indexExpiryKey, toMillisecond(now), toMillisecond(now.Add(w.lease)), w.batchSize)
+	if err != nil || len(members) == 0 {
+		if err != nil {
+			logrus.WithError(err).Error("failed to claim expired counters")
+		}
+		return
+	}
+	ids := make([]string, 0, len(members))
+	for _, m := range members {
+		if id, _, ok := parseIndexExpiryMember(m); ok {
+			ids = append(ids, id)
+		}
+	}
+	values, err := w.dao.GetBatch(ctx, ids)
+	if err != nil {
+		logrus.WithError(err).Error("failed to get expired counters")
+		return
+	}
+
+	b := w.dao.Batch(ctx)
+	for _, m := range members {
+		id, key, ok := parseIndexExpiryMember(m)
+		value, existence := values[id]
+		if !ok || !existence {
+			if ok {
+				b.RemoveFromSet(key, id)
+			}
+			b.RemoveFromSortedSet(indexExpiryKey, m)
+			continue
+		}
+		var v DaoValueFormat
+		if err := json.Unmarshal([]byte(value), &v); err != nil {
+			logrus.WithError(err).WithField("counter_id", id).Error("failed to parse the counter")
+			continue
+		}
+		due := dueMillisecond(v)
+		// Paused counters never expire until they are resumed
+		if v.PausedTimestamp != 0 {
+			due = toMillisecond(now.Add(pausedIndexRecheckInterval))
+		}
+		// It may take a moment until DB expires the key
+		if due <= toMillisecond(now) {
+			due = toMillisecond(now.Add(w.interval))
+		}
+		b.AddToSortedSet(indexExpiryKey, m, due)
+	}
+	if err := b.Exec(); err != nil {
+		logrus.WithError(err).Error("failed to prune indexes")
+	}
+}
+
+// POST the callback, and record the result.
+// The record is updated before the callback is unscheduled, so it's never fired again once it's delivered.
+func (w *WebhookDispatcher) deliver(ctx context.Context, id string) error {
+	r, existence, err := getCallbackRecord(ctx, w.dao, id)
+	if err != nil {
+		return err
+	}
+	// The counter has been stopped, or the callback has already been handled by another replica.
+	if !existence || r.Status != CallbackStatusPending {
+		return w.dao.RemoveFromSortedSet(ctx, callbackScheduleKey, id)
+	}
+
+	r.Attempts++
+	errPost := w.post(ctx, r)
+	now := w.now()
+	switch {
+	case errPost == nil:
+		r.Status = CallbackStatusDelivered
+		r.LastError = ""
+		r.DeliveredAt = toMillisecond(now)
+	case r.Attempts >= w.maxAttempts:
+		r.Status = CallbackStatusFailed
+		r.LastError = errPost.Error()
+	default:
+		// Retry later
+		r.LastError = errPost.Error()
+		if err := setCallbackRecord(ctx, w.dao, r, 0); err != nil {
+			return err
+		}
+		return w.dao.AddToSortedSet(ctx, callbackScheduleKey, id, toMillisecond(now.Add(callbackRetryInterval(r.Attempts))))
+	}
+
+	if err := setCallbackRecord(ctx, w.dao, r, callbackRetentionSecond); err != nil {
+		return err
+	}
+	return w.dao.RemoveFromSortedSet(ctx, callbackScheduleKey, id)
+}
+
+func (w *WebhookDispatcher) post(ctx context.Context, r CallbackRecord) error {
+	body, err := json.Marshal(callbackBody{
+		Event:   callbackEvent,
+		ID:      r.CounterID,
+		Name:    r.Name,
+		Labels:  r.Labels,
+		To:      r.To,
+		Payload: r.Payload,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("callback returned %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Return how long to wait before retrying after the given number of attempts. 1s, 2s, 4s, ... up to 5 minutes.
+func callbackRetryInterval(attempts int) time.Duration {
+	interval := time.Second
+	for i := 1; i < attempts; i++ {
+		interval *= 2
+		if interval >= 5*time.Minute {
+			return 5 * time.Minute
+		}
+	}
+	return interval
+}
+
+func callbackKey(id string) string {
+	return callbackKeyPrefix + id
+}
+
+func getCallbackRecord(ctx context.Context, dao Dao, id string) (CallbackRecord, bool, error) {
+	var r CallbackRecord
+	existence, err := dao.Exists(ctx, callbackKey(id))
+	if err != nil || !convertIntToBool(existence) {
+		return r, false, err
+	}
+	v, err := dao.Get(ctx, callbackKey(id))
+	if err != nil {
+		return r, false, err
+	}
+	if err := json.Unmarshal([]byte(v), &r); err != nil {
+		return r, false, err
+	}
+	return r, true, nil
+}
+
+func setCallbackRecord(ctx context.Context, dao Dao, r CallbackRecord, expirationSecond int64) error {
+	v, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return dao.Set(ctx, callbackKey(r.CounterID), string(v), expirationSecond)
+}
+
+func toMillisecond(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,289 @@
+package modules
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// httptest servers listen on loopback, which the dispatcher refuses by default
+func newLocalWebhookDispatcher(dao Dao, timeout time.Duration, maxAttempts int) *WebhookDispatcher {
+	w := NewWebhookDispatcher(dao, timeout, maxAttempts)
+	w.allowIP = func(net.IP) bool { return true }
+	return w
+}
+
+func TestWebhookDispatcher_Deliver(t *testing.T) {
+	var received []callbackBody
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		var body callbackBody
+		_ = json.Unmarshal(b, &body)
+		received = append(received, body)
+	}))
+	defer server.Close()
+
+	m := newMemoryStore(time.Now)
+	c := NewCounterCalculator(m)
+	c.generateUUID = func() string { return "9dd29757-ed4e-488f-b62c-b8cececbac29" }
+	c.generateTimestamp = func() int64 { return 1591115560 }
+	_, err := c.GenerateCounter(context.Background(), CounterSpec{
+		To:       10,
+		Name:     "deploy",
+		Callback: &Callback{URL: server.URL, Payload: json.RawMessage(`{"k":"v"}`)},
+	})
+	assert.Nil(t, err)
+
+	w := newLocalWebhookDispatcher(m, time.Second, 3)
+	// 1 millisecond before the end of the counter
+	w.now = func() time.Time { return time.Unix(1591115569, 999000000) }
+	w.dispatchDue()
+	assert.Len(t, received, 0)
+
+	w.now = func() time.Time { return time.Unix(1591115570, 0) }
+	w.dispatchDue()
+	assert.Equal(t, []callbackBody{{
+		Event:   "counter.completed",
+		ID:      "9dd29757-ed4e-488f-b62c-b8cececbac29",
+		Name:    "deploy",
+		To:      10,
+		Payload: json.RawMessage(`{"k":"v"}`),
+	}}, received)
+
+	r, existence, _ := c.GetCallbackStatus(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	assert.True(t, existence)
+	assert.Equal(t, CallbackStatusDelivered, r.Status)
+	assert.Equal(t, 1, r.Attempts)
+	assert.Equal(t, int64(1591115570000), r.DeliveredAt)
+
+	// Never fired again
+	w.now = func() time.Time { return time.Unix(1591115600, 0) }
+	w.dispatchDue()
+	assert.Len(t, received, 1)
+}
+
+func TestWebhookDispatcher_Retry(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	m := newMemoryStore(time.Now)
+	c := NewCounterCalculator(m)
+	c.generateUUID = func() string { return "9dd29757-ed4e-488f-b62c-b8cececbac29" }
+	c.generateTimestamp = func() int64 { return 1591115560 }
+	_, _ = c.GenerateCounter(context.Background(), CounterSpec{To: 10, Callback: &Callback{URL: server.URL}})
+
+	w := newLocalWebhookDispatcher(m, time.Second, 2)
+	w.now = func() time.Time { return time.Unix(1591115570, 0) }
+	w.dispatchDue()
+	r, _, _ := c.GetCallbackStatus(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	assert.Equal(t, CallbackStatusPending, r.Status)
+	assert.Equal(t, "callback returned 503", r.LastError)
+
+	// Retried 1 second later, and given up because it's the last attempt
+	w.now = func() time.Time { return time.Unix(1591115571, 0) }
+	w.dispatchDue()
+	r, _, _ = c.GetCallbackStatus(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	assert.Equal(t, CallbackStatusFailed, r.Status)
+	assert.Equal(t, 2, r.Attempts)
+
+	w.now = func() time.Time { return time.Unix(1591115600, 0) }
+	w.dispatchDue()
+	assert.Equal(t, 2, attempts)
+}
+
+func TestWebhookDispatcher_PauseAndStop(t *testing.T) {
+	fired := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fired++
+	}))
+	defer server.Close()
+
+	m := newMemoryStore(time.Now)
+	c := NewCounterCalculator(m)
+	ids := []string{"1a0ca312-558f-4a13-987f-ba86930ec9ef", "3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e"}
+	n := 0
+	c.generateUUID = func() string {
+		n++
+		return ids[n-1]
+	}
+	c.generateTimestamp = func() int64 { return 1591115560 }
+	_, _ = c.GenerateCounter(context.Background(), CounterSpec{To: 10, Callback: &Callback{URL: server.URL}})
+	_, _ = c.GenerateCounter(context.Background(), CounterSpec{To: 10, Callback: &Callback{URL: server.URL}})
+	w := newLocalWebhookDispatcher(m, time.Second, 3)
+
+	// The paused counter doesn't complete
+	c.generateTimestamp = func() int64 { return 1591115565 }
+	_, _ = c.PauseCounter(context.Background(), ids[0])
+	// The stopped counter doesn't complete, and its callback is removed
+	_, _ = c.DeleteCounter(context.Background(), ids[1])
+	_, existence, _ := c.GetCallbackStatus(context.Background(), ids[1])
+	assert.False(t, existence)
+
+	w.now = func() time.Time { return time.Unix(1591115570, 0) }
+	w.dispatchDue()
+	assert.Equal(t, 0, fired)
+
+	// Resumed 20 seconds later, so it completes 20 seconds later than the original end.
+	c.generateTimestamp = func() int64 { return 1591115585 }
+	_, _ = c.ResumeCounter(context.Background(), ids[0])
+	w.now = func() time.Time { return time.Unix(1591115589, 0) }
+	w.dispatchDue()
+	assert.Equal(t, 0, fired)
+	w.now = func() time.Time { return time.Unix(1591115590, 0) }
+	w.dispatchDue()
+	assert.Equal(t, 1, fired)
+}
+
+// Expired counters are removed from the indexes, but paused ones are kept
+func TestWebhookDispatcher_PruneIndexes(t *testing.T) {
+	now := time.Unix(1591115560, 0)
+	m := newMemoryStore(func() time.Time { return now })
+	c := NewCounterCalculator(m)
+	ids := []string{"1a0ca312-558f-4a13-987f-ba86930ec9ef", "3f2ead43-5a97-4b14-8bb9-3fbf1dfe1f4e", "9dd29757-ed4e-488f-b62c-b8cececbac29"}
+	n := 0
+	c.generateUUID = func() string {
+		n++
+		return ids[n-1]
+	}
+	c.generateTimestamp = func() int64 { return 1591115560 }
+	labels := map[string]string{"team": "payments"}
+	_, _ = c.GenerateCounter(context.Background(), CounterSpec{To: 10, Labels: labels, Owner: "a"})
+	_, _ = c.GenerateCounter(context.Background(), CounterSpec{To: 10, Labels: labels})
+	_, _ = c.GenerateCounters(context.Background(), []CounterSpec{{To: 100, Labels: labels}})
+	c.generateTimestamp = func() int64 { return 1591115565 }
+	_, _ = c.PauseCounter(context.Background(), ids[1])
+
+	w := NewWebhookDispatcher(m, time.Second, 3)
+	now = time.Unix(1591115570, 0)
+	w.now = func() time.Time { return now }
+	w.pruneIndexes()
+
+	members, _, _ := m.ScanSet(context.Background(), labelIndexKey("team", "payments"), 0, 100)
+	assert.Equal(t, ids[1:], members)
+	assert.NotContains(t, m.sets, ownerIndexKey("a"))
+	assert.Equal(t, map[string]int64{
+		indexExpiryMember(ids[1], labelIndexKey("team", "payments")): toMillisecond(now.Add(pausedIndexRecheckInterval)),
+		indexExpiryMember(ids[2], labelIndexKey("team", "payments")): 1591115660000,
+	}, m.sortedSets[indexExpiryKey])
+
+	// Stopped counters leave nothing behind
+	_, _ = c.DeleteCounter(context.Background(), ids[1])
+	_, _ = c.DeleteCounters(context.Background(), ids[2:], "")
+	assert.Empty(t, m.sets)
+	assert.Empty(t, m.sortedSets)
+}
+
+func TestWebhookDispatcher_RefuseNonPublic(t *testing.T) {
+	fired := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fired++
+	}))
+	defer server.Close()
+
+	m := newMemoryStore(time.Now)
+	c := NewCounterCalculator(m)
+	c.generateUUID = func() string { return "9dd29757-ed4e-488f-b62c-b8cececbac29" }
+	c.generateTimestamp = func() int64 { return 1591115560 }
+	_, _ = c.GenerateCounter(context.Background(), CounterSpec{To: 10, Callback: &Callback{URL: server.URL}})
+
+	w := NewWebhookDispatcher(m, time.Second, 3)
+	w.now = func() time.Time { return time.Unix(1591115570, 0) }
+	w.dispatchDue()
+	assert.Equal(t, 0, fired)
+	r, _, _ := c.GetCallbackStatus(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	assert.Equal(t, CallbackStatusPending, r.Status)
+	assert.Contains(t, r.LastError, "callback URL resolves to a non-public address 127.0.0.1")
+}
+
+func TestWebhookDispatcher_RefuseRedirect(t *testing.T) {
+	fired := 0
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fired++
+	}))
+	defer target.Close()
+	server := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusFound))
+	defer server.Close()
+
+	m := newMemoryStore(time.Now)
+	c := NewCounterCalculator(m)
+	c.generateUUID = func() string { return "9dd29757-ed4e-488f-b62c-b8cececbac29" }
+	c.generateTimestamp = func() int64 { return 1591115560 }
+	_, _ = c.GenerateCounter(context.Background(), CounterSpec{To: 10, Callback: &Callback{URL: server.URL}})
+
+	w := newLocalWebhookDispatcher(m, time.Second, 3)
+	w.now = func() time.Time { return time.Unix(1591115570, 0) }
+	w.dispatchDue()
+	assert.Equal(t, 0, fired)
+	r, _, _ := c.GetCallbackStatus(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	assert.Equal(t, "callback returned 302", r.LastError)
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"::", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			assert.Equal(t, tt.public, isPublicIP(net.ParseIP(tt.ip)))
+		})
+	}
+}
+
+func TestGetCallbackRecord_Corrupted(t *testing.T) {
+	m := newMemoryStore(time.Now)
+	_ = m.Set(context.Background(), callbackKey("9dd29757-ed4e-488f-b62c-b8cececbac29"), "{", 0)
+	_, existence, err := getCallbackRecord(context.Background(), m, "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	assert.False(t, existence)
+	assert.NotNil(t, err)
+}
+
+// Callback records of other counters can't be stopped as counters
+func TestRouterStopCallbackRecord(t *testing.T) {
+	m := newMemoryStore(time.Now)
+	c := NewCounterCalculator(m)
+	c.generateUUID = func() string { return "9dd29757-ed4e-488f-b62c-b8cececbac29" }
+	_, _ = c.GenerateCounter(context.Background(), CounterSpec{To: 10, Labels: map[string]string{"team": "payments"}, Callback: &Callback{URL: "https://example.com/hook"}})
+	_ = m.Set(context.Background(), idempotencyKeyPrefix+"key", "{}", 0)
+	controller := NewController(c, ControllerConfig{})
+
+	for _, id := range []string{callbackKey("9dd29757-ed4e-488f-b62c-b8cececbac29"), callbackScheduleKey, idempotencyKeyPrefix + "key", labelIndexKey("team", "payments")} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/counter/"+id+"/stop", nil)
+		controller.router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code, id)
+	}
+	r, existence, _ := c.GetCallbackStatus(context.Background(), "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	assert.True(t, existence)
+	assert.Equal(t, CallbackStatusPending, r.Status)
+	assert.Contains(t, m.sortedSets[callbackScheduleKey], "9dd29757-ed4e-488f-b62c-b8cececbac29")
+	assert.Contains(t, m.sets, labelIndexKey("team", "payments"))
+	_, err := m.Get(context.Background(), idempotencyKeyPrefix+"key")
+	assert.NoError(t, err)
+}
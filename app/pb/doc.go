@@ -0,0 +1,5 @@
+// Package pb is the gRPC API generated from counter.proto.
+// Regenerate it with protoc-gen-go v1.4 of github.com/golang/protobuf after editing counter.proto.
+package pb
+
+//go:generate protoc --go_out=plugins=grpc,paths=source_relative:. counter.proto
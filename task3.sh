@@ -1,7 +1,15 @@
 #!/usr/bin/env bash
 
-for i in $(curl -s $NGINX_IP/counter | jq .ids[] -r); do
-    echo ${i[@]}
-    curl $NGINX_IP/counter/${i[@]} -s
-    echo
+cursor=0
+while :; do
+    page=$(curl -s "$NGINX_IP/v1/counter?cursor=${cursor}")
+    for i in $(echo ${page} | jq .ids[] -r); do
+        echo ${i[@]}
+        curl $NGINX_IP/v1/counter/${i[@]} -s
+        echo
+    done
+    cursor=$(echo ${page} | jq '.next_cursor // empty' -r)
+    if [[ -z ${cursor} ]]; then
+        break
+    fi
 done
\ No newline at end of file
@@ -1,11 +1,17 @@
 #!/usr/bin/env bash
 
 echo ### Create 100 (and more) Counters ###
-for i in `seq 1 100`; do curl -XPOST -s $NGINX_IP/counter?to=1000; done
+for i in `seq 1 100`; do curl -XPOST -s $NGINX_IP/v1/counter?to=1000; done
 
 echo ### Delete all registered counters ###
-ids=$(curl -s $NGINX_IP/counter | jq .ids[] -r)
-for i in ${ids}; do curl -XPOST -s $NGINX_IP/counter/${i[@]}/stop; done
-
-echo ### check registered counters ###
-curl $NGINX_IP/counter
\ No newline at end of file
+cursor=0
+ids=""
+while :; do
+    page=$(curl -s "$NGINX_IP/v1/counter?cursor=${cursor}")
+    ids="${ids} $(echo ${page} | jq .ids[] -r)"
+    cursor=$(echo ${page} | jq '.next_cursor // empty' -r)
+    if [[ -z ${cursor} ]]; then
+        break
+    fi
+done
+for i in ${ids}; do curl -XDELETE -s $NGINX_IP/v1/counter/${i[@]}; done